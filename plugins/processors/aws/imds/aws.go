@@ -2,58 +2,304 @@ package aws
 
 import (
 	"context"
+	"crypto/sha256"
 	_ "embed"
 	"errors"
 	"fmt"
+	"math"
+	"math/rand"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/coocood/freecache"
-
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/retry"
 	awsconfig "github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/feature/ec2/imds"
+	"github.com/aws/smithy-go/middleware"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
 	"github.com/influxdata/telegraf"
 	"github.com/influxdata/telegraf/config"
+	"github.com/influxdata/telegraf/filter"
 	"github.com/influxdata/telegraf/plugins/common/parallel"
 	"github.com/influxdata/telegraf/plugins/processors"
+	"golang.org/x/time/rate"
 )
 
 //go:embed sample.conf
 var sampleConfig string
 
 type AwsIMDSProcessor struct {
-	ImdsTags         []string        `toml:"imds_tags"`
-	Timeout          config.Duration `toml:"timeout"`
-	CacheTTL         config.Duration `toml:"cache_ttl"`
-	Ordered          bool            `toml:"ordered"`
-	MaxParallelCalls int             `toml:"max_parallel_calls"`
-	Log              telegraf.Logger `toml:"-"`
-	TagCacheSize     int             `toml:"tag_cache_size"`
-	LogCacheStats    bool            `toml:"log_cache_stats"`
+	ImdsTags                   []string                   `toml:"imds_tags"`
+	Timeout                    config.Duration            `toml:"timeout"`
+	CacheTTL                   config.Duration            `toml:"cache_ttl"`
+	CacheTTLJitter             float64                    `toml:"cache_ttl_jitter"`
+	CacheTTLOverrides          map[string]config.Duration `toml:"cache_ttl_overrides"`
+	MaxValueAge                config.Duration            `toml:"max_value_age"`
+	StaleGracePeriod           config.Duration            `toml:"stale_grace_period"`
+	DisableCache               bool                       `toml:"disable_cache"`
+	NoCacheMinInterval         config.Duration            `toml:"no_cache_min_interval"`
+	Ordered                    bool                       `toml:"ordered"`
+	MaxParallelCalls           int                        `toml:"max_parallel_calls"`
+	DrainTimeout               config.Duration            `toml:"drain_timeout"`
+	StartupJitter              config.Duration            `toml:"startup_jitter"`
+	Log                        telegraf.Logger            `toml:"-"`
+	TagCacheSize               int                        `toml:"tag_cache_size"`
+	FlushCacheOnStart          bool                       `toml:"flush_cache_on_start"`
+	MaxCacheEntries            int                        `toml:"max_cache_entries"`
+	NegativeCacheTTL           config.Duration            `toml:"negative_cache_ttl"`
+	RefreshAhead               config.Duration            `toml:"refresh_ahead"`
+	LogCacheStats              bool                       `toml:"log_cache_stats"`
+	Verbose                    bool                       `toml:"verbose"`
+	EnrichWhen                 string                     `toml:"enrich_when"`
+	MaxValueLength             int                        `toml:"max_value_length"`
+	TruncateSuffix             string                     `toml:"truncate_suffix"`
+	DropOverlong               bool                       `toml:"drop_overlong_values"`
+	MaxAddedTags               int                        `toml:"max_added_tags"`
+	AddFetchTime               bool                       `toml:"add_fetch_time"`
+	AddTagSetHash              bool                       `toml:"add_tag_set_hash"`
+	AddDiagnostics             bool                       `toml:"add_diagnostics"`
+	ReportStats                bool                       `toml:"report_stats"`
+	StatsAsRate                bool                       `toml:"stats_as_rate"`
+	StatsInterval              config.Duration            `toml:"stats_interval"`
+	Alias                      string                     `toml:"alias"`
+	EmitErrorMetrics           bool                       `toml:"emit_error_metrics"`
+	EmitStats                  bool                       `toml:"emit_stats"`
+	NamingConvention           string                     `toml:"naming_convention"`
+	NormalizeKeys              string                     `toml:"normalize_keys"`
+	SanitizeLabelNames         bool                       `toml:"sanitize_label_names"`
+	RegionNames                map[string]string          `toml:"region_names"`
+	RegionMap                  map[string]string          `toml:"region_map"`
+	RegionSources              []string                   `toml:"region_sources"`
+	OnLookupFailure            string                     `toml:"on_lookup_failure"`
+	RemoveOnFailure            []string                   `toml:"remove_on_failure"`
+	RequiredTags               []string                   `toml:"required_tags"`
+	OnRequiredFailure          string                     `toml:"on_required_failure"`
+	HoldInterval               config.Duration            `toml:"hold_interval"`
+	MaxHold                    config.Duration            `toml:"max_hold"`
+	Endpoint                   string                     `toml:"endpoint"`
+	UserAgent                  string                     `toml:"user_agent"`
+	IdentityCacheFile          string                     `toml:"identity_cache_file"`
+	Strict                     bool                       `toml:"strict"`
+	ValidateOnStart            bool                       `toml:"validate_on_start"`
+	StaticTags                 map[string]string          `toml:"static_tags"`
+	InstanceIDCheckInterval    config.Duration            `toml:"instance_id_check_interval"`
+	StatusTag                  string                     `toml:"status_tag"`
+	MaxRetries                 int                        `toml:"max_retries"`
+	RetryBackoff               config.Duration            `toml:"retry_backoff"`
+	TotalTimeout               config.Duration            `toml:"total_timeout"`
+	TimeoutBackoff             config.Duration            `toml:"timeout_backoff"`
+	MaxIMDSRPS                 float64                    `toml:"max_imds_rps"`
+	AwsRetryMode               string                     `toml:"aws_retry_mode"`
+	AtomicEnrichment           bool                       `toml:"atomic_enrichment"`
+	FallbackValues             map[string]string          `toml:"fallback_values"`
+	TagRename                  map[string]string          `toml:"tag_rename"`
+	ValueMap                   map[string]ValueMapping    `toml:"value_map"`
+	Extract                    []Extraction               `toml:"extract"`
+	ComputedTags               map[string]string          `toml:"computed_tags"`
+	WhenMatches                map[string]string          `toml:"when_matches"`
+	UnlessMatches              map[string]string          `toml:"unless_matches"`
+	MetadataPaths              map[string]string          `toml:"metadata_paths"`
+	DynamicPaths               map[string]string          `toml:"dynamic_paths"`
+	JSONQuery                  map[string]string          `toml:"json_query"`
+	MetadataPathList           []string                   `toml:"metadata_path_list"`
+	PathKeyStrategy            string                     `toml:"path_key_strategy"`
+	PathKeySeparator           string                     `toml:"path_key_separator"`
+	InstanceTags               []string                   `toml:"instance_tags"`
+	InstanceTagKeySanitization string                     `toml:"instance_tag_key_sanitization"`
+	InstanceTagsInclude        []string                   `toml:"instance_tags_include"`
+	InstanceTagsExclude        []string                   `toml:"instance_tags_exclude"`
+	InstanceTagsTTL            config.Duration            `toml:"instance_tags_ttl"`
+	InstanceTagsRescanInterval config.Duration            `toml:"instance_tags_rescan_interval"`
+	ConflictPolicy             string                     `toml:"conflict_policy"`
+	PseudonymizeTags           []string                   `toml:"pseudonymize_tags"`
+	PseudonymizeKey            config.Secret              `toml:"pseudonymize_key"`
+	PseudonymizeLength         int                        `toml:"pseudonymize_length"`
+	MaskTags                   []string                   `toml:"mask_tags"`
+	MaskKeepChars              int                        `toml:"mask_keep_chars"`
+	EmitMetadataMetric         bool                       `toml:"emit_metadata_metric"`
+	MetadataMetricName         string                     `toml:"metadata_metric_name"`
+	MetadataMetricInterval     config.Duration            `toml:"metadata_metric_interval"`
+	IncludeIdentityDocument    bool                       `toml:"include_identity_document"`
+	RawExtraFields             bool                       `toml:"raw_extra_fields"`
+	BillingProductTags         map[string]string          `toml:"billing_product_tags"`
+	IdentityDocumentAsTag      bool                       `toml:"identity_document_as_tag"`
+	OnlyAddOnce                bool                       `toml:"only_add_once"`
+	SkipIfComplete             bool                       `toml:"skip_if_complete"`
+	DropWhenTerminating        bool                       `toml:"drop_when_terminating"`
+	TagsByMeasurement          map[string][]string        `toml:"tags_by_measurement"`
+	FailureDomainFormat        string                     `toml:"failure_domain_format"`
+	AllowCacheBypassTag        bool                       `toml:"allow_cache_bypass_tag"`
+	EmptyValueBackoff          config.Duration            `toml:"empty_value_backoff"`
+	EmptyValueBackoffMax       config.Duration            `toml:"empty_value_backoff_max"`
+	MergeStrategy              string                     `toml:"merge_strategy"`
+	SetHostTagFrom             string                     `toml:"set_host_tag_from"`
+	PreserveOriginalHost       bool                       `toml:"preserve_original_host"`
+	NodeNameEnv                string                     `toml:"node_name_env"`
+	NodeNameTag                string                     `toml:"node_name_tag"`
+	LocalOnly                  bool                       `toml:"local_only"`
+	LocalOnlyTag               string                     `toml:"local_only_tag"`
+	ExportFile                 string                     `toml:"export_file"`
+	ExportFileMode             string                     `toml:"export_file_mode"`
+	ExportInterval             config.Duration            `toml:"export_interval"`
+
+	// APIOptions are added to the IMDS client's middleware stack. This is
+	// intended for tests inspecting or manipulating IMDS requests and can't
+	// be set from the configuration file.
+	APIOptions []func(*middleware.Stack) error `toml:"-"`
+
+	tagCache         *tagCache
+	cacheSize        int
+	fingerprint      string
+	cacheFingerprint string
+	cacheIndex       *lruIndex
+	failureDomain    *domainFormat
+	enrichWhen       predicate
+
+	truncatedValues    *counter
+	droppedValues      *counter
+	droppedMetrics     *counter
+	fallbacksUsed      *counter
+	foreignSkipped     *counter
+	terminatingDropped *counter
+	omittedTags        *counter
+	staleServed        *counter
+	cacheEvictions     *counter
+	cacheHits          *counter
+	cacheMisses        *counter
+	negativeHits       *counter
+	imdsRequests       *counter
+	lookupFailures     *counter
+
+	imdsClient             imdsAPI
+	retryMode              aws.RetryMode
+	tags                   atomic.Pointer[tagConfig]
+	extractors             []*extractor
+	tagTemplates           []tagTemplate
+	gates                  map[string]*gate
+	fieldTags              map[string]struct{}
+	fieldKeys              map[string]struct{}
+	sanitizeInstanceTagKey func(string) string
+	collectAllInstanceTags bool
+	instanceTagFilter      filter.Filter
+	nodeName               string
+	regionFallback         bool
+	configRegion           string
+	hostname               string
+	measurementTags        map[string]map[string]struct{}
+	measurementLookups     map[string]map[string]struct{}
+	pseudonymizeTagsMap    map[string]struct{}
+	maskTagsMap            map[string]struct{}
+	pseudonyms             sync.Map
+	parallel               parallel.Parallel
+	instanceID             string
+	cancelWorkers          context.CancelFunc
+	lookupCtx              context.Context
+	cancelLookups          context.CancelFunc
+	startCtx               context.Context
+	cancelStart            context.CancelFunc
+	drainExpired           atomic.Bool
+	drainDropped           int64
+	suspendedUntil         int64
+	limiter                *rate.Limiter
+	removeOnFailure        map[string]string
+	imdsMissing            atomic.Bool
+	missingRetryInterval   time.Duration
+	omittedTagsLogged      atomic.Bool
+	staleRemovalLogged     atomic.Bool
+	terminationLogged      atomic.Bool
+	htmlLogged             atomic.Bool
+	workers                sync.WaitGroup
+	emptyTagsLogged        sync.Map
+	emptyMu                sync.Mutex
+	emptyBackoffs          map[string]*emptyBackoff
+	requiredTags           map[string]struct{}
+	lastKnownMu            sync.Mutex
+	lastKnown              map[string]cacheEntry
 
-	tagCache *freecache.Cache
+	identityMu        sync.Mutex
+	statsMu           sync.Mutex
+	flights           flightGroup
+	counters          map[string]*counter
+	maxValueLength    int
+	instance          int64
+	exportMu          sync.Mutex
+	exportFileMode    os.FileMode
+	exported          time.Time
+	rawDocument       string
+	persistedDocument *imds.GetInstanceIdentityDocumentOutput
+	errorCountsMu     sync.Mutex
+	errorCounts       map[string]int64
+	// randFloat returns random numbers in [0, 1) for cache_ttl_jitter.
+	randFloat func() float64
+}
 
-	imdsClient          *imds.Client
-	imdsTagsMap         map[string]struct{}
-	parallel            parallel.Parallel
-	instanceID          string
-	cancelCleanupWorker context.CancelFunc
+// imdsAPI is the subset of the IMDS client used by the processor.
+type imdsAPI interface {
+	GetInstanceIdentityDocument(
+		context.Context,
+		*imds.GetInstanceIdentityDocumentInput,
+		...func(*imds.Options),
+	) (*imds.GetInstanceIdentityDocumentOutput, error)
+	GetDynamicData(
+		context.Context,
+		*imds.GetDynamicDataInput,
+		...func(*imds.Options),
+	) (*imds.GetDynamicDataOutput, error)
+	GetMetadata(
+		context.Context,
+		*imds.GetMetadataInput,
+		...func(*imds.Options),
+	) (*imds.GetMetadataOutput, error)
 }
 
 const (
-	DefaultMaxOrderedQueueSize = 10_000
-	DefaultMaxParallelCalls    = 10
-	DefaultTimeout             = 10 * time.Second
-	DefaultCacheTTL            = 0 * time.Hour
-	DefaultCacheSize           = 1000
-	DefaultLogCacheStats       = false
+	DefaultMaxOrderedQueueSize  = 10_000
+	DefaultMaxParallelCalls     = 10
+	DefaultTimeout              = 10 * time.Second
+	DefaultTotalTimeout         = 30 * time.Second
+	DefaultDrainTimeout         = 30 * time.Second
+	MaxStartupJitter            = 5 * time.Minute
+	DefaultRetryBackoff         = 100 * time.Millisecond
+	DefaultHoldInterval         = 5 * time.Second
+	DefaultMaxHold              = 5 * time.Minute
+	DefaultMaxAddedTags         = 100
+	DefaultPseudonymizeLength   = 16
+	DefaultMaskKeepChars        = 4
+	DefaultMetadataMetricName   = "aws_imds_host"
+	DefaultFailureDomainFormat  = "{availabilityZone}/{placementGroup}/{partition}"
+	DefaultUserAgent            = "telegraf-processor-aws-imds"
+	DefaultEmptyValueBackoffMax = time.Hour
+	DefaultMetadataInterval     = time.Minute
+	DefaultCacheTTL             = 0 * time.Hour
+	DefaultNegativeCacheTTL     = 5 * time.Minute
+	DefaultInstanceTagsTTL      = 15 * time.Minute
+	DefaultCacheSize            = 1000
+	DefaultStatsInterval        = 10 * time.Second
+	DefaultMaxCacheEntries      = 10_000
+	DefaultNoCacheMinInterval   = time.Second
+	DefaultMissingRetryInterval = 5 * time.Second
+	MaxMissingRetryInterval     = 5 * time.Minute
+	DefaultLogCacheStats        = false
 )
 
+// cacheBypassTag marks metrics to enrich with fresh values if
+// allow_cache_bypass_tag is set. It is removed from the metric.
+const cacheBypassTag = "imds_nocache"
+
 var allowedImdsTags = map[string]struct{}{
 	"accountId":        {},
 	"architecture":     {},
 	"availabilityZone": {},
 	"billingProducts":  {},
+	"cpuArch":          {},
+	"failureDomain":    {},
+	"graviton":         {},
 	"imageId":          {},
 	"instanceId":       {},
 	"instanceType":     {},
@@ -62,6 +308,8 @@ var allowedImdsTags = map[string]struct{}{
 	"privateIp":        {},
 	"ramdiskId":        {},
 	"region":           {},
+	"regionName":       {},
+	"rootDeviceType":   {},
 	"version":          {},
 }
 
@@ -69,7 +317,12 @@ func (*AwsIMDSProcessor) SampleConfig() string {
 	return sampleConfig
 }
 
-func (r *AwsIMDSProcessor) Add(metric telegraf.Metric, _ telegraf.Accumulator) error {
+func (r *AwsIMDSProcessor) Add(metric telegraf.Metric, acc telegraf.Accumulator) error {
+	// Pass complete metrics on right away unless they must keep their order.
+	if r.SkipIfComplete && !r.Ordered && r.complete(r.loadTags(), metric) {
+		acc.AddMetric(metric)
+		return nil
+	}
 	r.parallel.Enqueue(metric)
 	return nil
 }
@@ -80,13 +333,14 @@ func (r *AwsIMDSProcessor) logCacheStatistics(ctx context.Context) {
 	}
 
 	ticker := time.NewTicker(30 * time.Second)
+	defer ticker.Stop()
 
 	for {
 		select {
 		case <-ctx.Done():
 			return
 		case <-ticker.C:
-			r.Log.Debugf("cache: size=%d hit=%d miss=%d full=%d\n",
+			r.logRoutinef("cache: size=%d hit=%d miss=%d full=%d\n",
 				r.tagCache.EntryCount(),
 				r.tagCache.HitCount(),
 				r.tagCache.MissCount(),
@@ -99,52 +353,410 @@ func (r *AwsIMDSProcessor) logCacheStatistics(ctx context.Context) {
 
 func (r *AwsIMDSProcessor) Init() error {
 	r.Log.Debug("Initializing AWS IMDS Processor")
-	if len(r.ImdsTags) == 0 {
+	// Start over if re-initialized with a changed configuration.
+	tc := newTagConfig()
+	if len(r.ImdsTags) == 0 && len(r.MetadataPaths) == 0 && len(r.DynamicPaths) == 0 &&
+		len(r.MetadataPathList) == 0 && len(r.InstanceTags) == 0 && len(r.TagsByMeasurement) == 0 &&
+		len(r.BillingProductTags) == 0 {
 		return errors.New("no tags specified in configuration")
 	}
 
 	for _, tag := range r.ImdsTags {
-		if len(tag) == 0 || !isIMDSTagAllowed(tag) {
+		if len(tag) == 0 || (!isIMDSTagAllowed(tag) && !r.isRawExtraField(tag)) {
 			return fmt.Errorf("not allowed metadata tag specified in configuration: %s", tag)
 		}
-		r.imdsTagsMap[tag] = struct{}{}
+		tc.imdsTagsMap[tag] = struct{}{}
+	}
+	if err := r.initPathTags(tc); err != nil {
+		return err
+	}
+	if err := r.initRawExtraFields(tc); err != nil {
+		return err
 	}
-	if len(r.imdsTagsMap) == 0 {
+	if err := r.initBillingProductTags(tc); err != nil {
+		return err
+	}
+	if err := r.initInstanceTags(tc); err != nil {
+		return err
+	}
+	if err := r.initJSONQueries(tc); err != nil {
+		return err
+	}
+	if err := r.initTagsByMeasurement(tc); err != nil {
+		return err
+	}
+	if len(tc.imdsTagsMap) == 0 && !r.collectAllInstanceTags {
 		return errors.New("no allowed metadata tags specified in configuration")
 	}
 
+	if err := r.buildTagKeys(tc); err != nil {
+		return err
+	}
+
+	r.fieldTags = make(map[string]struct{})
+	r.fieldKeys = make(map[string]struct{})
+	if _, ok := tc.imdsTagsMap["identity_document"]; ok && !r.IdentityDocumentAsTag {
+		r.fieldTags["identity_document"] = struct{}{}
+		r.fieldKeys[tc.tagKey("identity_document")] = struct{}{}
+	}
+
+	tc.lookupTags = tc.defaultTags
+	if r.SetHostTagFrom != "" {
+		if !isIMDSTagAllowed(r.SetHostTagFrom) {
+			return fmt.Errorf("not allowed metadata tag specified in set_host_tag_from: %s", r.SetHostTagFrom)
+		}
+		tc.lookupTags = make(map[string]struct{}, len(tc.defaultTags)+1)
+		for tag := range tc.defaultTags {
+			tc.lookupTags[tag] = struct{}{}
+		}
+		tc.lookupTags[r.SetHostTagFrom] = struct{}{}
+	} else if r.PreserveOriginalHost {
+		return errors.New("preserve_original_host requires set_host_tag_from")
+	}
+	r.initMeasurementLookups()
+	r.tags.Store(tc)
+
+	if r.NodeNameEnv != "" {
+		if r.NodeNameTag == "" {
+			return errors.New("node_name_tag must not be empty")
+		}
+		// Tolerate the variable being absent, e.g. outside of Kubernetes.
+		r.nodeName = os.Getenv(r.NodeNameEnv)
+		if r.nodeName == "" {
+			r.Log.Debugf("Environment variable %s not set, not adding the node name", r.NodeNameEnv)
+		}
+	}
+
+	if r.LocalOnly {
+		if r.LocalOnlyTag == "" {
+			return errors.New("local_only_tag must not be empty")
+		}
+		hostname, err := os.Hostname()
+		if err != nil {
+			return fmt.Errorf("getting hostname for local_only: %w", err)
+		}
+		r.hostname = hostname
+	}
+
+	if r.EnrichWhen != "" {
+		p, err := parsePredicate(r.EnrichWhen)
+		if err != nil {
+			return fmt.Errorf("invalid enrich_when expression: %w", err)
+		}
+		r.enrichWhen = p
+	}
+
+	if r.MaxValueLength < 0 {
+		return fmt.Errorf("invalid max_value_length: %d", r.MaxValueLength)
+	}
+	if r.DropOverlong && r.MaxValueLength == 0 {
+		return errors.New("drop_overlong_values requires max_value_length to be set")
+	}
+	r.maxValueLength = r.MaxValueLength
+	// CloudWatch rejects dimension values longer than its limit.
+	if r.NamingConvention == "cloudwatch" && (r.maxValueLength == 0 || r.maxValueLength > cloudwatchMaxValueLength) {
+		r.maxValueLength = cloudwatchMaxValueLength
+	}
+
+	if r.Endpoint != "" {
+		u, err := url.Parse(r.Endpoint)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("invalid endpoint: %s", r.Endpoint)
+		}
+	}
+
+	switch r.OnLookupFailure {
+	case "pass", "drop":
+	default:
+		return fmt.Errorf("invalid on_lookup_failure: %s", r.OnLookupFailure)
+	}
+
+	for tag := range r.FallbackValues {
+		if _, ok := tc.imdsTagsMap[tag]; !ok {
+			return fmt.Errorf("fallback value specified for tag not in imds_tags: %s", tag)
+		}
+	}
+
+	if _, ok := tc.imdsTagsMap["region"]; len(r.RegionMap) > 0 && !ok {
+		return errors.New("region_map specified but region not in imds_tags")
+	}
+
+	for tag := range r.ValueMap {
+		if _, ok := tc.imdsTagsMap[tag]; !ok {
+			return fmt.Errorf("value_map specified for tag not in imds_tags: %s", tag)
+		}
+	}
+
+	if len(r.PseudonymizeTags) > 0 {
+		if r.PseudonymizeKey.Empty() {
+			return errors.New("pseudonymize_tags requires pseudonymize_key to be set")
+		}
+		if r.PseudonymizeLength < 1 || r.PseudonymizeLength > 2*sha256.Size {
+			return fmt.Errorf("invalid pseudonymize_length: %d", r.PseudonymizeLength)
+		}
+	}
+	r.pseudonymizeTagsMap = make(map[string]struct{}, len(r.PseudonymizeTags))
+	for _, tag := range r.PseudonymizeTags {
+		if _, ok := tc.imdsTagsMap[tag]; !ok {
+			return fmt.Errorf("pseudonymized tag not in imds_tags: %s", tag)
+		}
+		r.pseudonymizeTagsMap[tag] = struct{}{}
+	}
+
+	if r.MaskKeepChars < 0 {
+		return fmt.Errorf("invalid mask_keep_chars: %d", r.MaskKeepChars)
+	}
+	r.maskTagsMap = make(map[string]struct{}, len(r.MaskTags))
+	for _, tag := range r.MaskTags {
+		if _, ok := tc.imdsTagsMap[tag]; !ok {
+			return fmt.Errorf("masked tag not in imds_tags: %s", tag)
+		}
+		if _, ok := r.pseudonymizeTagsMap[tag]; ok {
+			return fmt.Errorf("tag %s can't be both masked and pseudonymized", tag)
+		}
+		r.maskTagsMap[tag] = struct{}{}
+	}
+
+	for tag, m := range r.ValueMap {
+		_, pseudonymized := r.pseudonymizeTagsMap[tag]
+		_, masked := r.maskTagsMap[tag]
+		if m.Dest != "" && (pseudonymized || masked) {
+			return fmt.Errorf("value_map dest specified for pseudonymized or masked tag: %s", tag)
+		}
+	}
+
+	if r.EmitMetadataMetric {
+		if r.MetadataMetricName == "" {
+			return errors.New("metadata_metric_name must not be empty")
+		}
+		if r.MetadataMetricInterval <= 0 {
+			return fmt.Errorf("invalid metadata_metric_interval: %s", time.Duration(r.MetadataMetricInterval))
+		}
+	}
+	if r.IncludeIdentityDocument && !r.EmitMetadataMetric {
+		return errors.New("include_identity_document requires emit_metadata_metric")
+	}
+
+	if r.ExportFile != "" {
+		mode, err := parseFileMode(r.ExportFileMode)
+		if err != nil {
+			return fmt.Errorf("invalid export_file_mode: %w", err)
+		}
+		r.exportFileMode = mode
+	}
+	if r.ExportInterval < 0 {
+		return fmt.Errorf("invalid export_interval: %s", time.Duration(r.ExportInterval))
+	}
+	if r.ExportInterval > 0 && r.ExportFile == "" {
+		return errors.New("export_interval requires export_file")
+	}
+
+	if r.EmptyValueBackoff < 0 {
+		return fmt.Errorf("invalid empty_value_backoff: %s", time.Duration(r.EmptyValueBackoff))
+	}
+	if r.EmptyValueBackoff > 0 && r.EmptyValueBackoffMax < r.EmptyValueBackoff {
+		return errors.New("empty_value_backoff_max must not be less than empty_value_backoff")
+	}
+
+	if r.DrainTimeout < 0 {
+		return fmt.Errorf("invalid drain_timeout: %s", time.Duration(r.DrainTimeout))
+	}
+	r.lookupCtx, r.cancelLookups = context.WithCancel(context.Background())
+	r.drainExpired.Store(false)
+	atomic.StoreInt64(&r.drainDropped, 0)
+
+	if r.StartupJitter < 0 || r.StartupJitter > config.Duration(MaxStartupJitter) {
+		return fmt.Errorf("invalid startup_jitter: %s, must be between 0s and %s", time.Duration(r.StartupJitter), MaxStartupJitter)
+	}
+	r.startCtx, r.cancelStart = context.WithCancel(context.Background())
+
+	if err := r.initExtractors(tc); err != nil {
+		return err
+	}
+	if err := r.initComputedTags(tc); err != nil {
+		return err
+	}
+	r.fingerprint = r.configFingerprint()
+	if err := r.initGates(tc); err != nil {
+		return err
+	}
+	if err := r.initRequiredTags(tc); err != nil {
+		return err
+	}
+	if err := r.initRegionSources(); err != nil {
+		return err
+	}
+	if err := r.initRemoveOnFailure(tc); err != nil {
+		return err
+	}
+	if err := r.initStaticTags(tc); err != nil {
+		return err
+	}
+
+	if r.MaxAddedTags < 1 {
+		return fmt.Errorf("invalid max_added_tags: %d", r.MaxAddedTags)
+	}
+	mode, err := aws.ParseRetryMode(r.AwsRetryMode)
+	if err != nil {
+		return fmt.Errorf("invalid aws_retry_mode: %s", r.AwsRetryMode)
+	}
+	r.retryMode = mode
+	if r.MaxRetries < 0 {
+		return fmt.Errorf("invalid max_retries: %d", r.MaxRetries)
+	}
+	// The cache expires entries in whole seconds.
+	if r.CacheTTL < 0 || (r.CacheTTL > 0 && r.CacheTTL < config.Duration(time.Second)) {
+		return fmt.Errorf("invalid cache_ttl: %s, must be 0 or at least 1s", time.Duration(r.CacheTTL))
+	}
+	if r.CacheTTLJitter < 0 || r.CacheTTLJitter >= 1 {
+		return fmt.Errorf("invalid cache_ttl_jitter: %v, must be at least 0 and less than 1", r.CacheTTLJitter)
+	}
+	r.randFloat = newRandFloat()
+	if r.NegativeCacheTTL < 0 || (r.NegativeCacheTTL > 0 && r.NegativeCacheTTL < config.Duration(time.Second)) {
+		return fmt.Errorf("invalid negative_cache_ttl: %s, must be 0 or at least 1s", time.Duration(r.NegativeCacheTTL))
+	}
+	if r.RefreshAhead < 0 {
+		return fmt.Errorf("invalid refresh_ahead: %s", time.Duration(r.RefreshAhead))
+	}
+	if r.RefreshAhead > 0 && r.DisableCache {
+		return errors.New("refresh_ahead requires the cache, unset disable_cache")
+	}
+	for tag, ttl := range r.CacheTTLOverrides {
+		if _, ok := tc.imdsTagsMap[tag]; !ok {
+			return fmt.Errorf("cache_ttl_overrides specified for tag not in imds_tags: %s", tag)
+		}
+		if ttl < 0 || (ttl > 0 && ttl < config.Duration(time.Second)) {
+			return fmt.Errorf("invalid cache_ttl_overrides for tag %s: %s, must be 0 or at least 1s", tag, time.Duration(ttl))
+		}
+	}
+	if r.StaleGracePeriod < 0 {
+		return fmt.Errorf("invalid stale_grace_period: %s", time.Duration(r.StaleGracePeriod))
+	}
+	if r.MaxValueAge < 0 {
+		return fmt.Errorf("invalid max_value_age: %s", time.Duration(r.MaxValueAge))
+	}
+	if r.NoCacheMinInterval < 0 {
+		return fmt.Errorf("invalid no_cache_min_interval: %s", time.Duration(r.NoCacheMinInterval))
+	}
+	if r.DisableCache && (r.CacheTTL > 0 || len(r.CacheTTLOverrides) > 0) {
+		r.Log.Warn("Ignoring cache_ttl and cache_ttl_overrides since disable_cache is set")
+	}
+	if r.TotalTimeout < 0 {
+		return fmt.Errorf("invalid total_timeout: %s", time.Duration(r.TotalTimeout))
+	}
+	if r.TimeoutBackoff < 0 {
+		return fmt.Errorf("invalid timeout_backoff: %s", time.Duration(r.TimeoutBackoff))
+	}
+	if r.MaxIMDSRPS < 0 || math.IsNaN(r.MaxIMDSRPS) || math.IsInf(r.MaxIMDSRPS, 0) {
+		return fmt.Errorf("invalid max_imds_rps: %v", r.MaxIMDSRPS)
+	}
+	r.limiter = newLimiter(r.MaxIMDSRPS)
+
+	if _, ok := tc.imdsTagsMap[failureDomainTag]; ok {
+		f, err := parseDomainFormat(r.FailureDomainFormat)
+		if err != nil {
+			return fmt.Errorf("invalid failure_domain_format: %w", err)
+		}
+		r.failureDomain = f
+	}
+
+	if (r.StatsAsRate || r.EmitErrorMetrics || r.EmitStats) && r.StatsInterval <= 0 {
+		return fmt.Errorf("invalid stats_interval: %s", time.Duration(r.StatsInterval))
+	}
+
+	if r.MaxCacheEntries < 1 {
+		return fmt.Errorf("invalid max_cache_entries: %d", r.MaxCacheEntries)
+	}
+	r.cacheIndex = newLRUIndex(r.MaxCacheEntries)
+
+	switch r.StatusTag {
+	case "none", "error", "failed_tags":
+	default:
+		return fmt.Errorf("invalid status_tag: %s", r.StatusTag)
+	}
+
+	r.truncatedValues = r.counter("truncated_values", map[string]string{})
+	r.droppedValues = r.counter("dropped_values", map[string]string{})
+	r.droppedMetrics = r.counter("dropped_metrics", map[string]string{})
+	r.fallbacksUsed = r.counter("fallback_values_used", map[string]string{})
+	r.foreignSkipped = r.counter("foreign_metrics_skipped", map[string]string{})
+	r.terminatingDropped = r.counter("terminating_metrics_dropped", map[string]string{})
+	r.omittedTags = r.counter("omitted_tags", map[string]string{})
+	r.staleServed = r.counter("stale_values_served", map[string]string{})
+	r.cacheEvictions = r.counter("cache_evictions", map[string]string{})
+	r.cacheHits = r.counter("cache_hits", map[string]string{})
+	r.cacheMisses = r.counter("cache_misses", map[string]string{})
+	r.negativeHits = r.counter("negative_hits", map[string]string{})
+	r.imdsRequests = r.counter("imds_requests", map[string]string{})
+	r.lookupFailures = r.counter("lookup_failures", map[string]string{})
+
 	return nil
 }
 
 func (r *AwsIMDSProcessor) Start(acc telegraf.Accumulator) error {
-	r.tagCache = freecache.NewCache(r.TagCacheSize)
-	if r.LogCacheStats {
-		ctx, cancel := context.WithCancel(context.Background())
-		r.cancelCleanupWorker = cancel
-		go r.logCacheStatistics(ctx)
-	}
+	r.initCache()
 
-	r.Log.Debugf("cache: size=%d\n", r.TagCacheSize)
+	r.logRoutinef("cache: size=%d\n", r.TagCacheSize)
 	if r.CacheTTL > 0 {
-		r.Log.Debugf("cache timeout: seconds=%d\n", int(time.Duration(r.CacheTTL).Seconds()))
+		r.logRoutinef("cache timeout: seconds=%d\n", int(time.Duration(r.CacheTTL).Seconds()))
 	}
 
-	ctx := context.Background()
-	cfg, err := awsconfig.LoadDefaultConfig(ctx)
+	ctx := r.startCtx
+	cfg, err := awsconfig.LoadDefaultConfig(ctx, awsconfig.WithRetryMode(r.retryMode))
 	if err != nil {
 		return fmt.Errorf("failed loading default AWS config: %w", err)
 	}
-	r.imdsClient = imds.NewFromConfig(cfg)
+	r.configRegion = cfg.Region
+	r.imdsClient = imds.NewFromConfig(cfg, func(o *imds.Options) {
+		// The IMDS client doesn't create its retryer from the configured
+		// retry mode, only from a configured retryer.
+		if r.retryMode == aws.RetryModeAdaptive {
+			o.Retryer = retry.NewAdaptiveMode()
+		}
+		if r.Endpoint != "" {
+			o.Endpoint = r.Endpoint
+		}
+		if r.UserAgent != "" {
+			o.APIOptions = append(o.APIOptions, setUserAgent(r.UserAgent))
+		}
+		if r.ReportStats {
+			o.APIOptions = append(o.APIOptions, r.newSDKStats().addMiddleware)
+		}
+		o.APIOptions = append(o.APIOptions, r.APIOptions...)
+	})
 
-	iido, err := r.imdsClient.GetInstanceIdentityDocument(
-		ctx,
-		&imds.GetInstanceIdentityDocumentInput{},
-	)
+	if err := r.waitStartupJitter(ctx); err != nil {
+		return err
+	}
+
+	// The tags taken from the document need no further request once it is
+	// cached.
+	r.imdsMissing.Store(false)
+	iido, _, err := r.identityDocument(ctx, false)
 	if err != nil {
-		return fmt.Errorf("failed getting instance identity document: %w", err)
+		iido, err = r.usePersistedDocument(err)
+		if err != nil {
+			if r.ValidateOnStart {
+				return fmt.Errorf("validating tags failed: IMDS unreachable: %w", err)
+			}
+			if r.Strict {
+				return err
+			}
+			r.Log.Warnf("Running without IMDS, passing metrics with static_tags only until IMDS is reachable: %v", err)
+			r.imdsMissing.Store(true)
+		}
+	} else if r.IdentityCacheFile != "" {
+		r.saveIdentityDocument(iido)
 	}
 
-	r.instanceID = iido.InstanceID
+	if !r.imdsMissing.Load() {
+		r.startIMDS(ctx, iido)
+		if r.ValidateOnStart {
+			if err := r.validateTags(ctx); err != nil {
+				return err
+			}
+		}
+	}
 
 	if r.Ordered {
 		r.parallel = parallel.NewOrdered(acc, r.asyncAdd, DefaultMaxOrderedQueueSize, r.MaxParallelCalls)
@@ -152,68 +764,560 @@ func (r *AwsIMDSProcessor) Start(acc telegraf.Accumulator) error {
 		r.parallel = parallel.NewUnordered(acc, r.asyncAdd, r.MaxParallelCalls)
 	}
 
+	workerCtx, cancel := context.WithCancel(context.Background())
+	r.cancelWorkers = cancel
+	if r.LogCacheStats {
+		r.startWorker(workerCtx, r.logCacheStatistics)
+	}
+	if r.StatsAsRate || r.EmitStats {
+		r.startWorker(workerCtx, func(ctx context.Context) {
+			r.reportStats(ctx, acc)
+		})
+	}
+	if r.imdsMissing.Load() {
+		r.startWorker(workerCtx, func(ctx context.Context) {
+			r.awaitIMDS(ctx, acc)
+		})
+		return nil
+	}
+	r.startIMDSWorkers(workerCtx, acc)
 	return nil
 }
 
+// startIMDS prepares the lookups once the identity document is known.
+func (r *AwsIMDSProcessor) startIMDS(ctx context.Context, iido *imds.GetInstanceIdentityDocumentOutput) {
+	r.identityMu.Lock()
+	r.instanceID = iido.InstanceID
+	r.identityMu.Unlock()
+
+	if r.collectAllInstanceTags {
+		r.discoverInstanceTags(ctx)
+	}
+
+	// Resolve all tags up front, so the first metrics find them cached and
+	// the export file is written right away.
+	r.prewarm(ctx)
+}
+
+// startIMDSWorkers starts the background workers querying IMDS.
+func (r *AwsIMDSProcessor) startIMDSWorkers(workerCtx context.Context, acc telegraf.Accumulator) {
+	if r.InstanceIDCheckInterval > 0 {
+		r.startWorker(workerCtx, r.checkInstanceID)
+	}
+	if r.EmitMetadataMetric {
+		r.startWorker(workerCtx, func(ctx context.Context) {
+			r.emitMetadataMetrics(ctx, acc)
+		})
+	}
+	if r.ExportInterval > 0 {
+		r.startWorker(workerCtx, r.exportPeriodically)
+	}
+	if r.RefreshAhead > 0 {
+		r.startWorker(workerCtx, r.refreshPeriodically)
+	}
+	if r.collectAllInstanceTags && r.InstanceTagsRescanInterval > 0 {
+		r.startWorker(workerCtx, r.rescanInstanceTags)
+	}
+	if r.EmitErrorMetrics {
+		r.startWorker(workerCtx, func(ctx context.Context) {
+			r.emitErrorMetrics(ctx, acc)
+		})
+	}
+}
+
+// waitStartupJitter delays the first IMDS request by a random duration of up
+// to startup_jitter, spreading the requests of agents restarted at once. The
+// wait ends early if the processor is stopped.
+func (r *AwsIMDSProcessor) waitStartupJitter(ctx context.Context) error {
+	if r.StartupJitter <= 0 {
+		return nil
+	}
+	rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
+	delay := time.Duration(rnd.Int63n(int64(r.StartupJitter) + 1))
+	r.Log.Debugf("Delaying startup by %s", delay)
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return fmt.Errorf("startup canceled: %w", ctx.Err())
+	case <-timer.C:
+		return nil
+	}
+}
+
+// setUserAgent returns a middleware replacing the User-Agent header of IMDS
+// requests, so the metadata traffic can be attributed to telegraf.
+func setUserAgent(userAgent string) func(*middleware.Stack) error {
+	return func(stack *middleware.Stack) error {
+		return stack.Build.Add(middleware.BuildMiddlewareFunc("SetUserAgent",
+			func(
+				ctx context.Context,
+				in middleware.BuildInput,
+				next middleware.BuildHandler,
+			) (middleware.BuildOutput, middleware.Metadata, error) {
+				if req, ok := in.Request.(*smithyhttp.Request); ok {
+					req.Header.Set("User-Agent", userAgent)
+				}
+				return next.HandleBuild(ctx, in)
+			}), middleware.After)
+	}
+}
+
 func (r *AwsIMDSProcessor) Stop() {
+	if r.cancelStart != nil {
+		r.cancelStart()
+	}
 	if r.parallel != nil {
+		r.drain()
+	}
+	if r.cancelWorkers != nil {
+		r.cancelWorkers()
+		r.workers.Wait()
+	}
+}
+
+// drain waits for the queued metrics to be enriched and passed on. Once
+// drain_timeout is exceeded, lookups in flight are canceled and the remaining
+// metrics are dropped, so Stop doesn't block on an unresponsive IMDS.
+func (r *AwsIMDSProcessor) drain() {
+	done := make(chan struct{})
+	go func() {
 		r.parallel.Stop()
+		close(done)
+	}()
+
+	if r.DrainTimeout > 0 {
+		timer := time.NewTimer(time.Duration(r.DrainTimeout))
+		defer timer.Stop()
+		select {
+		case <-done:
+			return
+		case <-timer.C:
+			r.drainExpired.Store(true)
+			r.cancelLookups()
+		}
+	}
+	<-done
+
+	if dropped := atomic.LoadInt64(&r.drainDropped); dropped > 0 {
+		r.Log.Warnf("Dropped %d metrics not enriched within drain_timeout", dropped)
 	}
-	r.cancelCleanupWorker()
+}
+
+// startWorker runs fn in a background goroutine until ctx is canceled in Stop.
+func (r *AwsIMDSProcessor) startWorker(ctx context.Context, fn func(context.Context)) {
+	r.workers.Add(1)
+	go func() {
+		defer r.workers.Done()
+		fn(ctx)
+	}()
+}
+
+// isForeign reports whether the metric carries local_only_tag with a value
+// other than the local hostname or instance ID. Metrics without the tag are
+// considered local.
+func (r *AwsIMDSProcessor) isForeign(metric telegraf.Metric) bool {
+	v, ok := metric.GetTag(r.LocalOnlyTag)
+	if !ok || v == r.hostname {
+		return false
+	}
+
+	r.identityMu.Lock()
+	defer r.identityMu.Unlock()
+	return v != r.instanceID
 }
 
 func (r *AwsIMDSProcessor) LookupIMDSTags(metric telegraf.Metric) telegraf.Metric {
-	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(r.Timeout))
-	defer cancel()
+	r.enrich(r.loadTags(), metric, false)
+	return metric
+}
 
-	var tagsNotFound []string
+// enrich adds the configured tags to the metric and returns the tags whose
+// lookup failed. With atomic_enrichment no tags are added if any lookup
+// failed. If noCache is set, all values are fetched from IMDS.
+func (r *AwsIMDSProcessor) enrich(tc *tagConfig, metric telegraf.Metric, noCache bool) []string {
+	tags := r.tagsToLookup(tc, metric)
+	if r.OnlyAddOnce {
+		tags = r.missingTags(tc, metric)
+		if len(tags) == 0 {
+			return nil
+		}
+	}
 
-	for tag := range r.imdsTagsMap {
-		val, err := r.tagCache.Get([]byte(tag))
-		if err != nil {
-			tagsNotFound = append(tagsNotFound, tag)
-		} else {
-			metric.AddTag(tag, string(val))
+	values, failed := r.resolveTags(r.lookupCtx, tc, tags, noCache)
+	if len(failed) > 0 && r.StaleGracePeriod > 0 {
+		failed = r.useStale(values, failed)
+	}
+	if len(failed) > 0 && len(r.requiredTags) > 0 {
+		// A stale value beats dropping or holding the metric.
+		failed = r.useLastKnown(values, failed)
+	}
+	if r.AtomicEnrichment && len(failed) > 0 {
+		return failed
+	}
+
+	resolved := make(map[string]string, len(values))
+	var oldest time.Time
+	for tag, e := range values {
+		resolved[tag] = e.value
+		if oldest.IsZero() || e.fetched.Before(oldest) {
+			oldest = e.fetched
 		}
 	}
 
-	if len(tagsNotFound) == 0 {
-		return metric
+	for _, tag := range failed {
+		if v, ok := r.FallbackValues[tag]; ok {
+			resolved[tag] = v
+			r.fallbacksUsed.Incr(1)
+		}
+	}
+	added := r.addTags(tc, metric, resolved)
+	if r.AddTagSetHash && len(added) > 0 {
+		metric.AddField("imds_tag_set_hash", tagSetHash(added))
+	}
+	if r.SetHostTagFrom != "" {
+		r.setHostTag(metric, resolved)
+	}
+	if r.nodeName != "" {
+		metric.AddTag(r.NodeNameTag, r.nodeName)
 	}
 
-	iido, err := r.imdsClient.GetInstanceIdentityDocument(
-		ctx,
-		&imds.GetInstanceIdentityDocumentInput{},
-	)
+	if r.AddFetchTime && !oldest.IsZero() {
+		metric.AddField("imds_fetch_time", oldest.Unix())
+	}
+	if r.AddDiagnostics {
+		if ttl, ok := r.cacheTTLBucket(values); ok {
+			metric.AddField("imds_cache_ttl_bucket", ttl)
+		}
+	}
 
-	if err != nil {
-		r.Log.Errorf("Error when calling GetInstanceIdentityDocument: %v", err)
-		return metric
+	return failed
+}
+
+// complete reports whether the metric already has all configured tag keys.
+func (r *AwsIMDSProcessor) complete(tc *tagConfig, metric telegraf.Metric) bool {
+	for tag := range r.configuredTags(tc, metric) {
+		if _, ok := r.fieldTags[tag]; ok {
+			continue
+		}
+		if !metric.HasTag(tc.tagKey(tag)) {
+			return false
+		}
+	}
+	return true
+}
+
+// missingTags returns the configured tags whose key isn't set on the metric
+// yet, e.g. by an earlier instance of the processor in the chain.
+func (r *AwsIMDSProcessor) missingTags(tc *tagConfig, metric telegraf.Metric) map[string]struct{} {
+	configured := r.configuredTags(tc, metric)
+	tags := make(map[string]struct{}, len(configured)+1)
+	for tag := range configured {
+		if !metric.HasTag(tc.tagKey(tag)) {
+			tags[tag] = struct{}{}
+		}
+	}
+	if r.SetHostTagFrom != "" {
+		tags[r.SetHostTagFrom] = struct{}{}
+	}
+	return tags
+}
+
+// setHostTag replaces the host tag by the value of the set_host_tag_from tag,
+// keeping the previous host as original_host if preserve_original_host is set.
+// Metrics without a host tag gain one.
+func (r *AwsIMDSProcessor) setHostTag(metric telegraf.Metric, values map[string]string) {
+	value, ok := values[r.SetHostTagFrom]
+	if !ok {
+		return
+	}
+	value, ok = r.transformValue(r.SetHostTagFrom, value)
+	if !ok {
+		return
+	}
+
+	if r.PreserveOriginalHost {
+		if host, ok := metric.GetTag("host"); ok && host != value {
+			metric.AddTag("original_host", host)
+		}
+	}
+	metric.AddTag("host", value)
+}
+
+// resolveTags returns the non-empty values of the given tags, served from
+// the cache where possible unless noCache is set. Fresh values are cached in
+// either case. Tags whose lookup failed are returned separately.
+func (r *AwsIMDSProcessor) resolveTags(
+	ctx context.Context,
+	tc *tagConfig,
+	tags map[string]struct{},
+	noCache bool,
+) (values map[string]cacheEntry, failed []string) {
+	values, failed, _ = r.resolveTagErrors(ctx, tc, tags, noCache)
+	return values, failed
+}
+
+// resolveTagErrors is resolveTags additionally returning the error each
+// failed tag's lookup failed with.
+func (r *AwsIMDSProcessor) resolveTagErrors(
+	ctx context.Context,
+	tc *tagConfig,
+	tags map[string]struct{},
+	noCache bool,
+) (values map[string]cacheEntry, failed []string, errs map[string]error) {
+	values = make(map[string]cacheEntry, len(tags))
+	errs = make(map[string]error)
+	fail := func(err error, tags ...string) {
+		for _, tag := range tags {
+			errs[tag] = err
+		}
+		failed = append(failed, tags...)
 	}
 
-	for _, tag := range tagsNotFound {
-		if v := getTagFromInstanceIdentityDocument(iido, tag); v != "" {
-			metric.AddTag(tag, v)
-			expiration := int(time.Duration(r.CacheTTL).Seconds())
-			err = r.tagCache.Set([]byte(tag), []byte(v), expiration)
-			if err != nil {
-				r.Log.Errorf("Error when setting IMDS tag cache value: %v", err)
+	now := time.Now()
+	var documentTags, pathTags, regionTags []string
+	var computed []string
+	for tag := range tags {
+		if !noCache {
+			if e, ok := r.getCached(tag); ok {
+				// Cached empty values are negative-cached query misses.
+				if e.value != "" {
+					values[tag] = e
+				} else {
+					r.negativeHits.Incr(1)
+				}
+				continue
+			}
+			if r.inEmptyBackoff(tag, now) {
+				continue
 			}
 		}
+
+		if _, ok := tc.pathTags[tag]; ok {
+			pathTags = append(pathTags, tag)
+		} else if r.regionFallback && isRegionTag(tag) {
+			regionTags = append(regionTags, tag)
+		} else if _, ok := computedTags[tag]; ok {
+			computed = append(computed, tag)
+		} else {
+			documentTags = append(documentTags, tag)
+		}
 	}
 
-	return metric
+	var refreshed bool
+	if r.ExportFile != "" {
+		defer func() {
+			if refreshed {
+				r.exportValues(tc)
+			}
+		}()
+	}
+
+	var document *imds.GetInstanceIdentityDocumentOutput
+	if len(documentTags) > 0 {
+		iido, fetched, err := r.identityDocument(ctx, noCache)
+		if err != nil {
+			r.Log.Errorf("Error when calling GetInstanceIdentityDocument: %v", err)
+			r.recordLookupError(err)
+			if persisted := r.fallbackIdentityDocument(); persisted != nil {
+				document = persisted
+				// Serve the persisted document without caching its values,
+				// so the document is fetched again once IMDS recovers.
+				for _, tag := range documentTags {
+					if v := r.documentTagValue(persisted, tag); v != "" {
+						values[tag] = cacheEntry{value: v, fetched: now}
+					}
+				}
+			} else {
+				fail(err, documentTags...)
+			}
+		} else {
+			document = iido
+			for _, tag := range documentTags {
+				if v := r.documentTagValue(iido, tag); v != "" {
+					values[tag] = cacheEntry{value: v, fetched: fetched}
+					r.setCached(tag, v, fetched)
+					r.valueResolved(tag)
+					refreshed = true
+				} else {
+					r.absentResolved(tc, tag, now)
+				}
+			}
+		}
+	}
+
+	if len(regionTags) > 0 {
+		if region, fromIMDS := r.resolveRegion(ctx, document, len(documentTags) == 0); region != "" {
+			for _, tag := range regionTags {
+				v := region
+				if tag == "regionName" {
+					v = r.regionName(region)
+				}
+				values[tag] = cacheEntry{value: v, fetched: now}
+				// Fallback regions are resolved again for every lookup
+				// until IMDS reports the region.
+				if fromIMDS {
+					r.setCached(tag, v, now)
+					refreshed = true
+				}
+			}
+		} else {
+			r.Log.Errorf("Error when resolving region: none of %s reported a region", strings.Join(r.RegionSources, ", "))
+			r.recordLookupError(errNoRegion)
+			fail(errNoRegion, regionTags...)
+		}
+	}
+
+	if len(computed) > 0 && document == nil && len(documentTags) == 0 {
+		document = r.fetchDocument(ctx)
+	}
+	for _, tag := range computed {
+		v, err := computedTags[tag](r, ctx, document)
+		if err != nil {
+			r.Log.Errorf("Error when resolving %s: %v", tag, err)
+			r.recordLookupError(err)
+			fail(err, tag)
+		} else if v != "" {
+			values[tag] = cacheEntry{value: v, fetched: now}
+			r.setCached(tag, v, now)
+			r.valueResolved(tag)
+			refreshed = true
+		} else {
+			r.absentResolved(tc, tag, now)
+		}
+	}
+
+	for _, tag := range pathTags {
+		v, err := r.lookupMetadataTag(ctx, tc.pathTags[tag])
+		if isNotFound(err) && r.NegativeCacheTTL > 0 {
+			// The path definitively doesn't exist on this instance.
+			r.absentResolved(tc, tag, now)
+			continue
+		} else if err != nil {
+			r.Log.Errorf("Error when fetching metadata for %s: %v", tag, err)
+			r.recordLookupError(err)
+			fail(err, tag)
+			continue
+		}
+		if v != "" {
+			values[tag] = cacheEntry{value: v, fetched: now}
+			r.setCached(tag, v, now)
+			r.valueResolved(tag)
+			refreshed = true
+		} else {
+			r.absentResolved(tc, tag, now)
+		}
+	}
+
+	r.lookupFailures.Incr(int64(len(failed)))
+	return values, failed, errs
 }
 
 func (r *AwsIMDSProcessor) asyncAdd(metric telegraf.Metric) []telegraf.Metric {
+	if r.drainExpired.Load() {
+		atomic.AddInt64(&r.drainDropped, 1)
+		metric.Drop()
+		return []telegraf.Metric{}
+	}
+
+	tc := r.loadTags()
+
+	// Pass through metrics which don't satisfy the enrich_when predicate.
+	if r.enrichWhen != nil && !r.enrichWhen.match(metric) {
+		return []telegraf.Metric{metric}
+	}
+
+	// Metrics carrying the bypass marker are enriched with fresh values, e.g.
+	// to verify the current metadata through a synthetic metric.
+	var noCache bool
+	if r.AllowCacheBypassTag && metric.HasTag(cacheBypassTag) {
+		metric.RemoveTag(cacheBypassTag)
+		noCache = true
+	}
+
+	// Pass through metrics received from other hosts, they must not carry
+	// this host's metadata.
+	if r.LocalOnly && r.isForeign(metric) {
+		r.foreignSkipped.Incr(1)
+		return []telegraf.Metric{metric}
+	}
+
+	if r.SkipIfComplete && r.complete(tc, metric) {
+		return []telegraf.Metric{metric}
+	}
+
+	if r.imdsMissing.Load() {
+		r.addStaticTags(tc, metric)
+		return []telegraf.Metric{metric}
+	}
+
+	if r.DropWhenTerminating && r.terminating(tc) {
+		r.terminatingDropped.Incr(1)
+		metric.Drop()
+		return []telegraf.Metric{}
+	}
+
 	// Add IMDS Instance Identity Document tags.
-	if len(r.imdsTagsMap) > 0 {
-		metric = r.LookupIMDSTags(metric)
+	if len(r.tagsToLookup(tc, metric)) > 0 {
+		failed := r.enrich(tc, metric, noCache)
+		if r.OnRequiredFailure == "hold" && r.requiredFailed(failed) {
+			failed = r.holdMetric(tc, metric, noCache, failed)
+		}
+		if len(r.removeOnFailure) > 0 {
+			r.removeStaleTags(metric, failed)
+		}
+		if (len(failed) > 0 && r.OnLookupFailure == "drop") || r.requiredFailed(failed) {
+			r.droppedMetrics.Incr(1)
+			metric.Drop()
+			return []telegraf.Metric{}
+		}
+		r.addStatusTag(metric, failed)
+	}
+
+	// Fields rather than tags, so the diagnostics don't add series.
+	if r.AddDiagnostics {
+		metric.AddField("imds_max_parallel_calls", int64(r.MaxParallelCalls))
+		metric.AddField("imds_ordered", r.Ordered)
 	}
 
 	return []telegraf.Metric{metric}
 }
 
+// logRoutinef logs routine events, such as cache statistics, at debug level
+// or at info level if verbose is set.
+func (r *AwsIMDSProcessor) logRoutinef(format string, args ...interface{}) {
+	if r.Verbose {
+		r.Log.Infof(format, args...)
+	} else {
+		r.Log.Debugf(format, args...)
+	}
+}
+
+// logEmptyValue notes once per tag that it has no value on this instance,
+// e.g. kernelId on Nitro instances.
+func (r *AwsIMDSProcessor) logEmptyValue(tag string) {
+	if _, logged := r.emptyTagsLogged.LoadOrStore(tag, struct{}{}); !logged {
+		r.logRoutinef("No value for tag %s, skipping it", tag)
+	}
+}
+
+// addStatusTag marks metrics for which a lookup failed, so the missing tags
+// can be told apart from tags that don't apply to the instance.
+func (r *AwsIMDSProcessor) addStatusTag(metric telegraf.Metric, failed []string) {
+	if len(failed) == 0 {
+		return
+	}
+
+	switch r.StatusTag {
+	case "error":
+		metric.AddTag("imds_status", "error")
+	case "failed_tags":
+		sort.Strings(failed)
+		metric.AddTag("imds_status", strings.Join(failed, ","))
+	}
+}
+
 func init() {
 	processors.AddStreaming("aws_imds", func() telegraf.StreamingProcessor {
 		return newAwsIMDSProcessor()
@@ -221,13 +1325,73 @@ func init() {
 }
 
 func newAwsIMDSProcessor() *AwsIMDSProcessor {
-	return &AwsIMDSProcessor{
-		MaxParallelCalls: DefaultMaxParallelCalls,
-		TagCacheSize:     DefaultCacheSize,
-		Timeout:          config.Duration(DefaultTimeout),
-		CacheTTL:         config.Duration(DefaultCacheTTL),
-		imdsTagsMap:      make(map[string]struct{}),
+	r := &AwsIMDSProcessor{
+		instance:                   atomic.AddInt64(&instances, 1),
+		MaxParallelCalls:           DefaultMaxParallelCalls,
+		MaxAddedTags:               DefaultMaxAddedTags,
+		TagCacheSize:               DefaultCacheSize,
+		FlushCacheOnStart:          true,
+		MaxCacheEntries:            DefaultMaxCacheEntries,
+		Timeout:                    config.Duration(DefaultTimeout),
+		TotalTimeout:               config.Duration(DefaultTotalTimeout),
+		DrainTimeout:               config.Duration(DefaultDrainTimeout),
+		RetryBackoff:               config.Duration(DefaultRetryBackoff),
+		PseudonymizeLength:         DefaultPseudonymizeLength,
+		MaskKeepChars:              DefaultMaskKeepChars,
+		MetadataMetricName:         DefaultMetadataMetricName,
+		MergeStrategy:              "first",
+		NodeNameTag:                "node_name",
+		LocalOnlyTag:               "host",
+		InstanceTagKeySanitization: "underscore",
+		PathKeyStrategy:            "configured_name",
+		PathKeySeparator:           "_",
+		ConflictPolicy:             "suffix_instance_tag",
+		ExportFileMode:             "0644",
+		UserAgent:                  DefaultUserAgent,
+		MetadataMetricInterval:     config.Duration(DefaultMetadataInterval),
+		CacheTTL:                   config.Duration(DefaultCacheTTL),
+		StatsInterval:              config.Duration(DefaultStatsInterval),
+		NegativeCacheTTL:           config.Duration(DefaultNegativeCacheTTL),
+		InstanceTagsTTL:            config.Duration(DefaultInstanceTagsTTL),
+		NoCacheMinInterval:         config.Duration(DefaultNoCacheMinInterval),
+		OnLookupFailure:            "pass",
+		AwsRetryMode:               string(aws.RetryModeStandard),
+		OnRequiredFailure:          "drop",
+		HoldInterval:               config.Duration(DefaultHoldInterval),
+		MaxHold:                    config.Duration(DefaultMaxHold),
+		RegionSources:              []string{"identity_document"},
+		StatusTag:                  "none",
+		FailureDomainFormat:        DefaultFailureDomainFormat,
+		EmptyValueBackoffMax:       config.Duration(DefaultEmptyValueBackoffMax),
+		emptyBackoffs:              make(map[string]*emptyBackoff),
+		missingRetryInterval:       DefaultMissingRetryInterval,
 	}
+	r.tags.Store(newTagConfig())
+	return r
+}
+
+// computedTags are resolved from the identity document, nil if unavailable,
+// combined with further requests.
+var computedTags = map[string]func(*AwsIMDSProcessor, context.Context, *imds.GetInstanceIdentityDocumentOutput) (string, error){
+	rootDeviceTag:    (*AwsIMDSProcessor).resolveRootDeviceType,
+	failureDomainTag: (*AwsIMDSProcessor).resolveFailureDomain,
+}
+
+// documentTagValue returns the value of a tag derived from the identity
+// document, including tags that depend on the processor's configuration.
+func (r *AwsIMDSProcessor) documentTagValue(o *imds.GetInstanceIdentityDocumentOutput, tag string) string {
+	if code, ok := r.BillingProductTags[tag]; ok {
+		return strconv.FormatBool(hasBillingProduct(o, code))
+	}
+	switch tag {
+	case "regionName":
+		return r.regionName(o.Region)
+	case "cpuArch":
+		return cpuArch(o.Architecture)
+	case "graviton":
+		return strconv.FormatBool(isGraviton(o.InstanceType))
+	}
+	return getTagFromInstanceIdentityDocument(o, tag)
 }
 
 func getTagFromInstanceIdentityDocument(o *imds.GetInstanceIdentityDocumentOutput, tag string) string {
@@ -249,6 +1413,9 @@ func getTagFromInstanceIdentityDocument(o *imds.GetInstanceIdentityDocumentOutpu
 	case "kernelId":
 		return o.KernelID
 	case "pendingTime":
+		if o.PendingTime.IsZero() {
+			return ""
+		}
 		return o.PendingTime.String()
 	case "privateIp":
 		return o.PrivateIP
@@ -264,6 +1431,9 @@ func getTagFromInstanceIdentityDocument(o *imds.GetInstanceIdentityDocumentOutpu
 }
 
 func isIMDSTagAllowed(tag string) bool {
+	if _, ok := metadataTags[tag]; ok {
+		return true
+	}
 	_, ok := allowedImdsTags[tag]
 	return ok
 }
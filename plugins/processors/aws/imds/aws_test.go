@@ -1,12 +1,167 @@
 package aws
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/aws/aws-sdk-go-v2/feature/ec2/imds"
+	"github.com/aws/smithy-go/middleware"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+	"github.com/influxdata/telegraf"
+	"github.com/influxdata/telegraf/config"
+	"github.com/influxdata/telegraf/metric"
+	"github.com/influxdata/telegraf/plugins/common/parallel"
 	"github.com/influxdata/telegraf/testutil"
 	"github.com/stretchr/testify/require"
 )
 
+// mockIMDSClient serves a fixed identity document, meta-data and dynamic data
+// paths and counts the calls made.
+type mockIMDSClient struct {
+	document imds.InstanceIdentityDocument
+	metadata map[string]string
+	dynamic  map[string]string
+	err      error
+	// pathErrs holds errors of individual meta-data paths.
+	pathErrs map[string]error
+	delay    time.Duration
+	calls    int32
+}
+
+// wait simulates the latency of a request, honoring cancellation.
+func (c *mockIMDSClient) wait(ctx context.Context) error {
+	if c.delay == 0 {
+		return nil
+	}
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(c.delay):
+		return nil
+	}
+}
+
+func (c *mockIMDSClient) GetInstanceIdentityDocument(
+	ctx context.Context,
+	_ *imds.GetInstanceIdentityDocumentInput,
+	_ ...func(*imds.Options),
+) (*imds.GetInstanceIdentityDocumentOutput, error) {
+	atomic.AddInt32(&c.calls, 1)
+	if err := c.wait(ctx); err != nil {
+		return nil, err
+	}
+	if c.err != nil {
+		return nil, c.err
+	}
+	return &imds.GetInstanceIdentityDocumentOutput{InstanceIdentityDocument: c.document}, nil
+}
+
+func (c *mockIMDSClient) GetMetadata(
+	ctx context.Context,
+	in *imds.GetMetadataInput,
+	_ ...func(*imds.Options),
+) (*imds.GetMetadataOutput, error) {
+	atomic.AddInt32(&c.calls, 1)
+	if err := c.wait(ctx); err != nil {
+		return nil, err
+	}
+	if c.err != nil {
+		return nil, c.err
+	}
+	if err, ok := c.pathErrs[in.Path]; ok {
+		return nil, err
+	}
+	v, ok := c.metadata[in.Path]
+	if !ok {
+		return nil, notFoundError(in.Path)
+	}
+	return &imds.GetMetadataOutput{Content: io.NopCloser(strings.NewReader(v))}, nil
+}
+
+func (c *mockIMDSClient) GetDynamicData(
+	ctx context.Context,
+	in *imds.GetDynamicDataInput,
+	_ ...func(*imds.Options),
+) (*imds.GetDynamicDataOutput, error) {
+	atomic.AddInt32(&c.calls, 1)
+	if err := c.wait(ctx); err != nil {
+		return nil, err
+	}
+	if c.err != nil {
+		return nil, c.err
+	}
+	v, ok := c.dynamic[in.Path]
+	if !ok {
+		return nil, notFoundError(in.Path)
+	}
+	return &imds.GetDynamicDataOutput{Content: io.NopCloser(strings.NewReader(v))}, nil
+}
+
+// recordingLogger records all formatted log messages prefixed with their level.
+type recordingLogger struct {
+	testutil.Logger
+	mu       sync.Mutex
+	messages []string
+}
+
+func (l *recordingLogger) record(level, format string, args ...interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.messages = append(l.messages, level+" "+fmt.Sprintf(format, args...))
+}
+
+func (l *recordingLogger) Errorf(format string, args ...interface{}) { l.record("E!", format, args...) }
+func (l *recordingLogger) Warnf(format string, args ...interface{})  { l.record("W!", format, args...) }
+func (l *recordingLogger) Infof(format string, args ...interface{})  { l.record("I!", format, args...) }
+func (l *recordingLogger) Debugf(format string, args ...interface{}) { l.record("D!", format, args...) }
+
+// matching returns the recorded messages containing substr.
+func (l *recordingLogger) matching(substr string) []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var messages []string
+	for _, msg := range l.messages {
+		if strings.Contains(msg, substr) {
+			messages = append(messages, msg)
+		}
+	}
+	return messages
+}
+
+// newTestProcessor returns an initialized processor for the given tags which
+// talks to the given client instead of IMDS.
+func newTestProcessor(t *testing.T, client imdsAPI, tags ...string) *AwsIMDSProcessor {
+	p := newAwsIMDSProcessor()
+	p.Log = &testutil.Logger{}
+	p.ImdsTags = tags
+	require.NoError(t, p.Init())
+	p.tagCache = newTagCache(p.TagCacheSize)
+	p.imdsClient = client
+	return p
+}
+
+// notFoundError is the error of the IMDS client for paths that don't exist.
+func notFoundError(path string) error {
+	return &smithyhttp.ResponseError{
+		Response: &smithyhttp.Response{Response: &http.Response{StatusCode: http.StatusNotFound}},
+		Err:      fmt.Errorf("path %s not found", path),
+	}
+}
+
+func newTestMetric() telegraf.Metric {
+	return metric.New("m", map[string]string{}, map[string]interface{}{"v": 1}, time.Unix(0, 0))
+}
+
 func TestBasicStartup(t *testing.T) {
 	p := newAwsIMDSProcessor()
 	p.Log = &testutil.Logger{}
@@ -17,3 +172,621 @@ func TestBasicStartup(t *testing.T) {
 	require.Len(t, acc.GetTelegrafMetrics(), 0)
 	require.Len(t, acc.Errors, 0)
 }
+
+func TestPartialIdentityDocument(t *testing.T) {
+	client := &mockIMDSClient{
+		document: imds.InstanceIdentityDocument{
+			InstanceID: "i-0123456789abcdef0",
+			Region:     "us-east-1",
+		},
+	}
+	p := newTestProcessor(t, client,
+		"instanceId",
+		"region",
+		"accountId",
+		"billingProducts",
+		"kernelId",
+		"pendingTime",
+		"ramdiskId",
+	)
+
+	m := p.LookupIMDSTags(newTestMetric())
+	require.Equal(t, map[string]string{
+		"instanceId": "i-0123456789abcdef0",
+		"region":     "us-east-1",
+	}, m.Tags())
+	require.EqualValues(t, 1, client.calls)
+}
+
+func TestOnLookupFailure(t *testing.T) {
+	client := &mockIMDSClient{err: errors.New("connection refused")}
+
+	p := newTestProcessor(t, client, "accountId")
+	require.Equal(t, "pass", p.OnLookupFailure)
+	out := p.asyncAdd(newTestMetric())
+	require.Len(t, out, 1)
+	require.Empty(t, out[0].Tags())
+
+	p.OnLookupFailure = "drop"
+	before := p.droppedMetrics.Get()
+	require.Empty(t, p.asyncAdd(newTestMetric()))
+	require.Equal(t, before+1, p.droppedMetrics.Get())
+
+	// Cached values count as resolved.
+	p.setCached("accountId", "123456789012", time.Now())
+	out = p.asyncAdd(newTestMetric())
+	require.Len(t, out, 1)
+	require.Equal(t, map[string]string{"accountId": "123456789012"}, out[0].Tags())
+}
+
+func TestInvalidOnLookupFailure(t *testing.T) {
+	p := newAwsIMDSProcessor()
+	p.Log = &testutil.Logger{}
+	p.ImdsTags = []string{"region"}
+	p.OnLookupFailure = "hold"
+	require.Error(t, p.Init())
+}
+
+// newIMDSServer returns a test server emulating the IMDSv2 token and identity
+// document endpoints. An empty document is served as 404 Not Found.
+func newIMDSServer(t *testing.T, document string) *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/latest/api/token", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Aws-Ec2-Metadata-Token-Ttl-Seconds", "21600")
+		_, _ = w.Write([]byte("token"))
+	})
+	mux.HandleFunc("/latest/dynamic/instance-identity/document", func(w http.ResponseWriter, r *http.Request) {
+		if document == "" {
+			http.NotFound(w, r)
+			return
+		}
+		_, _ = w.Write([]byte(document))
+	})
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestStartWithEndpoint(t *testing.T) {
+	server := newIMDSServer(t, `{"instanceId": "i-0123456789abcdef0", "region": "eu-west-1"}`)
+
+	var mu sync.Mutex
+	var paths []string
+	p := newAwsIMDSProcessor()
+	p.Log = &testutil.Logger{}
+	p.ImdsTags = []string{"region"}
+	p.Endpoint = server.URL
+	p.APIOptions = []func(*middleware.Stack) error{
+		func(stack *middleware.Stack) error {
+			return stack.Build.Add(middleware.BuildMiddlewareFunc("recordPath",
+				func(
+					ctx context.Context,
+					in middleware.BuildInput,
+					next middleware.BuildHandler,
+				) (middleware.BuildOutput, middleware.Metadata, error) {
+					if req, ok := in.Request.(*smithyhttp.Request); ok {
+						mu.Lock()
+						paths = append(paths, req.URL.Path)
+						mu.Unlock()
+					}
+					return next.HandleBuild(ctx, in)
+				}), middleware.After)
+		},
+	}
+	require.NoError(t, p.Init())
+
+	acc := &testutil.Accumulator{}
+	require.NoError(t, p.Start(acc))
+	require.Equal(t, "i-0123456789abcdef0", p.instanceID)
+	mu.Lock()
+	require.Contains(t, paths, "/latest/dynamic/instance-identity/document")
+	mu.Unlock()
+
+	require.NoError(t, p.Add(newTestMetric(), acc))
+	p.Stop()
+
+	metrics := acc.GetTelegrafMetrics()
+	require.Len(t, metrics, 1)
+	require.Equal(t, map[string]string{"region": "eu-west-1"}, metrics[0].Tags())
+}
+
+func TestUserAgent(t *testing.T) {
+	var mu sync.Mutex
+	var agents []string
+	mux := http.NewServeMux()
+	mux.HandleFunc("/latest/api/token", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("token"))
+	})
+	mux.HandleFunc("/latest/dynamic/instance-identity/document", func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		agents = append(agents, r.UserAgent())
+		mu.Unlock()
+		_, _ = w.Write([]byte(`{"instanceId": "i-0123456789abcdef0"}`))
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	for _, userAgent := range []string{DefaultUserAgent, "my-agent/1.0"} {
+		p := newAwsIMDSProcessor()
+		p.Log = &testutil.Logger{}
+		p.ImdsTags = []string{"instanceId"}
+		p.Endpoint = server.URL
+		if userAgent != DefaultUserAgent {
+			p.UserAgent = userAgent
+		}
+		require.NoError(t, p.Init())
+		require.NoError(t, p.Start(&testutil.Accumulator{}))
+		p.Stop()
+
+		mu.Lock()
+		require.Equal(t, userAgent, agents[len(agents)-1])
+		mu.Unlock()
+	}
+}
+
+func TestStartupJitter(t *testing.T) {
+	server := newIMDSServer(t, `{"instanceId": "i-0123456789abcdef0", "region": "eu-west-1"}`)
+
+	p := newAwsIMDSProcessor()
+	p.Log = &testutil.Logger{}
+	p.ImdsTags = []string{"region"}
+	p.Endpoint = server.URL
+	p.StartupJitter = config.Duration(10 * time.Millisecond)
+	require.NoError(t, p.Init())
+	require.NoError(t, p.Start(&testutil.Accumulator{}))
+	require.Equal(t, "i-0123456789abcdef0", p.instanceID)
+	p.Stop()
+
+	// Stopping the processor ends the delay.
+	p = newAwsIMDSProcessor()
+	p.Log = &testutil.Logger{}
+	p.ImdsTags = []string{"region"}
+	p.Endpoint = server.URL
+	p.StartupJitter = config.Duration(MaxStartupJitter)
+	require.NoError(t, p.Init())
+	time.AfterFunc(50*time.Millisecond, p.Stop)
+	start := time.Now()
+	require.ErrorIs(t, p.Start(&testutil.Accumulator{}), context.Canceled)
+	require.Less(t, time.Since(start), time.Minute)
+
+	p.StartupJitter = config.Duration(MaxStartupJitter + time.Second)
+	require.Error(t, p.Init())
+}
+
+func TestInvalidEndpoint(t *testing.T) {
+	p := newAwsIMDSProcessor()
+	p.Log = &testutil.Logger{}
+	p.ImdsTags = []string{"region"}
+	p.Endpoint = "169.254.169.254"
+	require.Error(t, p.Init())
+}
+
+func TestStatusTag(t *testing.T) {
+	tests := []struct {
+		mode     string
+		expected map[string]string
+	}{
+		{"none", map[string]string{}},
+		{"error", map[string]string{"imds_status": "error"}},
+		{"failed_tags", map[string]string{"imds_status": "accountId,region"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.mode, func(t *testing.T) {
+			client := &mockIMDSClient{err: errors.New("connection refused")}
+			p := newTestProcessor(t, client, "region", "accountId")
+			p.StatusTag = tt.mode
+
+			out := p.asyncAdd(newTestMetric())
+			require.Len(t, out, 1)
+			require.Equal(t, tt.expected, out[0].Tags())
+
+			// The status is not cached and not added on success.
+			client.err = nil
+			client.document = imds.InstanceIdentityDocument{AccountID: "123456789012", Region: "us-east-1"}
+			out = p.asyncAdd(newTestMetric())
+			require.Len(t, out, 1)
+			require.Equal(t, map[string]string{"accountId": "123456789012", "region": "us-east-1"}, out[0].Tags())
+		})
+	}
+}
+
+func TestEmptyValuesSkipped(t *testing.T) {
+	client := &mockIMDSClient{
+		document: imds.InstanceIdentityDocument{
+			InstanceID: "i-0123456789abcdef0",
+			KernelID:   "",
+			RamdiskID:  "",
+		},
+	}
+	p := newTestProcessor(t, client, "instanceId", "kernelId", "ramdiskId")
+	logger := &recordingLogger{}
+	p.Log = logger
+
+	for i := 0; i < 2; i++ {
+		m := p.LookupIMDSTags(newTestMetric())
+		require.Equal(t, map[string]string{"instanceId": "i-0123456789abcdef0"}, m.Tags())
+	}
+
+	require.ElementsMatch(t, []string{
+		"D! No value for tag kernelId, skipping it",
+		"D! No value for tag ramdiskId, skipping it",
+	}, logger.matching("No value for tag"))
+}
+
+func TestAtomicEnrichment(t *testing.T) {
+	client := &mockIMDSClient{
+		metadata: map[string]string{"events/maintenance/scheduled": "not json"},
+	}
+	p := newTestProcessor(t, client, "region", "scheduledMaintenance")
+	p.setCached("region", "us-east-1", time.Now())
+
+	m := p.LookupIMDSTags(newTestMetric())
+	require.Equal(t, map[string]string{"region": "us-east-1"}, m.Tags())
+
+	p.AtomicEnrichment = true
+	m = p.LookupIMDSTags(newTestMetric())
+	require.Empty(t, m.Tags())
+
+	client.metadata["events/maintenance/scheduled"] = "[]"
+	m = p.LookupIMDSTags(newTestMetric())
+	require.Equal(t, map[string]string{"region": "us-east-1", "scheduledMaintenance": "false"}, m.Tags())
+}
+
+func TestOnlyAddOnce(t *testing.T) {
+	client := &mockIMDSClient{
+		document: imds.InstanceIdentityDocument{Region: "us-east-1", InstanceType: "m5.large"},
+	}
+	p := newTestProcessor(t, client, "region", "instanceType")
+	p.OnlyAddOnce = true
+
+	m := newTestMetric()
+	m.AddTag("region", "eu-west-1")
+	m = p.LookupIMDSTags(m)
+	require.Equal(t, map[string]string{"region": "eu-west-1", "instanceType": "m5.large"}, m.Tags())
+
+	// Metrics already carrying all tags don't trigger a lookup.
+	p.tagCache.Clear()
+	calls := atomic.LoadInt32(&client.calls)
+	m = p.LookupIMDSTags(m)
+	require.Equal(t, map[string]string{"region": "eu-west-1", "instanceType": "m5.large"}, m.Tags())
+	require.Equal(t, calls, atomic.LoadInt32(&client.calls))
+}
+
+func TestFallbackValues(t *testing.T) {
+	client := &mockIMDSClient{err: errors.New("connection refused")}
+	p := newTestProcessor(t, client, "region", "accountId")
+	p.FallbackValues = map[string]string{"region": "unknown"}
+
+	before := p.fallbacksUsed.Get()
+	m := p.LookupIMDSTags(newTestMetric())
+	require.Equal(t, map[string]string{"region": "unknown"}, m.Tags())
+	require.Equal(t, before+1, p.fallbacksUsed.Get())
+
+	// A cached value wins over the fallback.
+	p.setCached("region", "us-east-1", time.Now())
+	m = p.LookupIMDSTags(newTestMetric())
+	require.Equal(t, map[string]string{"region": "us-east-1"}, m.Tags())
+	require.Equal(t, before+1, p.fallbacksUsed.Get())
+}
+
+func TestFallbackValuesUnknownTag(t *testing.T) {
+	p := newAwsIMDSProcessor()
+	p.Log = &testutil.Logger{}
+	p.ImdsTags = []string{"region"}
+	p.FallbackValues = map[string]string{"accountId": "unknown"}
+	require.Error(t, p.Init())
+}
+
+func TestSetHostTagFrom(t *testing.T) {
+	client := &mockIMDSClient{
+		document: imds.InstanceIdentityDocument{InstanceID: "i-0123456789abcdef0", Region: "us-east-1"},
+	}
+	p := newTestProcessor(t, client, "region")
+	p.SetHostTagFrom = "instanceId"
+	p.PreserveOriginalHost = true
+	require.NoError(t, p.Init())
+
+	m := newTestMetric()
+	m.AddTag("host", "ip-10-0-0-1")
+	m = p.LookupIMDSTags(m)
+	require.Equal(t, map[string]string{
+		"region":        "us-east-1",
+		"host":          "i-0123456789abcdef0",
+		"original_host": "ip-10-0-0-1",
+	}, m.Tags())
+
+	// Metrics without a host tag gain one.
+	m = p.LookupIMDSTags(newTestMetric())
+	require.Equal(t, map[string]string{"region": "us-east-1", "host": "i-0123456789abcdef0"}, m.Tags())
+}
+
+func TestSetHostTagFromInvalid(t *testing.T) {
+	p := newAwsIMDSProcessor()
+	p.Log = &testutil.Logger{}
+	p.ImdsTags = []string{"region"}
+	p.SetHostTagFrom = "hostname"
+	require.Error(t, p.Init())
+
+	p = newAwsIMDSProcessor()
+	p.Log = &testutil.Logger{}
+	p.ImdsTags = []string{"region"}
+	p.PreserveOriginalHost = true
+	require.Error(t, p.Init())
+}
+
+func TestStopDrainsQueuedMetrics(t *testing.T) {
+	client := &mockIMDSClient{
+		document: imds.InstanceIdentityDocument{Region: "us-east-1"},
+		delay:    10 * time.Millisecond,
+	}
+	p := newTestProcessor(t, client, "region")
+
+	acc := &testutil.Accumulator{}
+	p.parallel = parallel.NewUnordered(acc, p.asyncAdd, 2)
+	for i := 0; i < 20; i++ {
+		require.NoError(t, p.Add(newTestMetric(), acc))
+	}
+	p.Stop()
+
+	metrics := acc.GetTelegrafMetrics()
+	require.Len(t, metrics, 20)
+	for _, m := range metrics {
+		require.Equal(t, map[string]string{"region": "us-east-1"}, m.Tags())
+	}
+}
+
+func TestStopDrainTimeout(t *testing.T) {
+	client := &mockIMDSClient{
+		document: imds.InstanceIdentityDocument{Region: "us-east-1"},
+		delay:    time.Hour,
+	}
+	p := newTestProcessor(t, client, "region")
+	p.DrainTimeout = config.Duration(50 * time.Millisecond)
+	logger := &recordingLogger{}
+	p.Log = logger
+
+	acc := &testutil.Accumulator{}
+	// With a single worker, one metric is in flight and one is queued.
+	p.parallel = parallel.NewUnordered(acc, p.asyncAdd, 1)
+	for i := 0; i < 2; i++ {
+		require.NoError(t, p.Add(newTestMetric(), acc))
+	}
+
+	start := time.Now()
+	p.Stop()
+	require.Less(t, time.Since(start), time.Duration(p.Timeout))
+
+	// The metric in flight is passed on without tags, the queued one is
+	// dropped.
+	require.Len(t, acc.GetTelegrafMetrics(), 1)
+	require.Empty(t, acc.GetTelegrafMetrics()[0].Tags())
+	require.Equal(t, []string{"W! Dropped 1 metrics not enriched within drain_timeout"}, logger.matching("Dropped"))
+
+	// Metrics are enriched again after a restart.
+	require.NoError(t, p.Init())
+	p.imdsClient = &mockIMDSClient{document: imds.InstanceIdentityDocument{Region: "us-east-1"}}
+	acc = &testutil.Accumulator{}
+	p.parallel = parallel.NewUnordered(acc, p.asyncAdd, 1)
+	require.NoError(t, p.Add(newTestMetric(), acc))
+	p.Stop()
+	require.Len(t, acc.GetTelegrafMetrics(), 1)
+	require.Equal(t, map[string]string{"region": "us-east-1"}, acc.GetTelegrafMetrics()[0].Tags())
+	require.Len(t, logger.matching("Dropped"), 1)
+}
+
+func TestVerboseLogging(t *testing.T) {
+	client := &mockIMDSClient{document: imds.InstanceIdentityDocument{Region: "us-east-1"}}
+	p := newTestProcessor(t, client, "region", "kernelId")
+	p.Verbose = true
+	logger := &recordingLogger{}
+	p.Log = logger
+
+	p.LookupIMDSTags(newTestMetric())
+	require.Equal(t, []string{"I! No value for tag kernelId, skipping it"}, logger.matching("No value for tag"))
+}
+
+func TestAddDiagnostics(t *testing.T) {
+	client := &mockIMDSClient{document: imds.InstanceIdentityDocument{Region: "us-east-1"}}
+	p := newTestProcessor(t, client, "region")
+	p.AddDiagnostics = true
+	p.Ordered = true
+	p.MaxParallelCalls = 4
+
+	out := p.asyncAdd(newTestMetric())
+	require.Len(t, out, 1)
+	require.Equal(t, map[string]string{"region": "us-east-1"}, out[0].Tags())
+	require.Equal(t, map[string]interface{}{
+		"v":                       int64(1),
+		"imds_max_parallel_calls": int64(4),
+		"imds_ordered":            true,
+	}, out[0].Fields())
+}
+
+func TestCacheBypassTag(t *testing.T) {
+	client := &mockIMDSClient{document: imds.InstanceIdentityDocument{Region: "us-east-1"}}
+	p := newTestProcessor(t, client, "region")
+	p.setCached("region", "eu-west-1", time.Now())
+
+	bypass := func() telegraf.Metric {
+		m := newTestMetric()
+		m.AddTag("imds_nocache", "true")
+		return m
+	}
+
+	// Without allow_cache_bypass_tag the marker is an ordinary tag.
+	out := p.asyncAdd(bypass())
+	require.Equal(t, map[string]string{"region": "eu-west-1", "imds_nocache": "true"}, out[0].Tags())
+	require.EqualValues(t, 0, client.calls)
+
+	p.AllowCacheBypassTag = true
+	out = p.asyncAdd(bypass())
+	require.Equal(t, map[string]string{"region": "us-east-1"}, out[0].Tags())
+	require.EqualValues(t, 1, client.calls)
+
+	// The fresh value is cached.
+	out = p.asyncAdd(newTestMetric())
+	require.Equal(t, map[string]string{"region": "us-east-1"}, out[0].Tags())
+	require.EqualValues(t, 1, client.calls)
+}
+
+func TestNodeNameEnv(t *testing.T) {
+	t.Setenv("TEST_NODE_NAME", "ip-10-0-0-1.ec2.internal")
+
+	client := &mockIMDSClient{document: imds.InstanceIdentityDocument{InstanceID: "i-0123456789abcdef0"}}
+	p := newTestProcessor(t, client, "instanceId")
+	p.NodeNameEnv = "TEST_NODE_NAME"
+	require.NoError(t, p.Init())
+
+	m := p.LookupIMDSTags(newTestMetric())
+	require.Equal(t, map[string]string{
+		"instanceId": "i-0123456789abcdef0",
+		"node_name":  "ip-10-0-0-1.ec2.internal",
+	}, m.Tags())
+
+	// A missing variable is tolerated.
+	p = newTestProcessor(t, client, "instanceId")
+	p.NodeNameEnv = "TEST_NODE_NAME_MISSING"
+	require.NoError(t, p.Init())
+	m = p.LookupIMDSTags(newTestMetric())
+	require.Equal(t, map[string]string{"instanceId": "i-0123456789abcdef0"}, m.Tags())
+}
+
+func TestLocalOnly(t *testing.T) {
+	hostname, err := os.Hostname()
+	require.NoError(t, err)
+
+	client := &mockIMDSClient{document: imds.InstanceIdentityDocument{InstanceID: "i-0123456789abcdef0"}}
+	p := newTestProcessor(t, client, "instanceId")
+	p.LocalOnly = true
+	require.NoError(t, p.Init())
+	p.instanceID = "i-0123456789abcdef0"
+
+	for _, host := range []string{hostname, "i-0123456789abcdef0", ""} {
+		tags := map[string]string{}
+		if host != "" {
+			tags["host"] = host
+		}
+		m := metric.New("m", tags, map[string]interface{}{"v": 1}, time.Unix(0, 0))
+		out := p.asyncAdd(m)
+		require.Len(t, out, 1)
+		value, ok := out[0].GetTag("instanceId")
+		require.True(t, ok, "host %q", host)
+		require.Equal(t, "i-0123456789abcdef0", value)
+	}
+
+	m := metric.New("m", map[string]string{"host": "other-host"}, map[string]interface{}{"v": 1}, time.Unix(0, 0))
+	out := p.asyncAdd(m)
+	require.Len(t, out, 1)
+	require.Equal(t, map[string]string{"host": "other-host"}, out[0].Tags())
+	require.Equal(t, int64(1), p.foreignSkipped.Get())
+}
+
+func TestRequiredTags(t *testing.T) {
+	client := &mockIMDSClient{
+		document: imds.InstanceIdentityDocument{AccountID: "123456789012"},
+		metadata: map[string]string{},
+	}
+	p := newAwsIMDSProcessor()
+	p.Log = &testutil.Logger{}
+	p.ImdsTags = []string{"accountId"}
+	p.MetadataPaths = map[string]string{"publicIpv4": "public-ipv4"}
+	p.RequiredTags = []string{"accountId"}
+	require.NoError(t, p.Init())
+	p.tagCache = newTagCache(p.TagCacheSize)
+	p.imdsClient = client
+
+	// Optional tags are skipped.
+	out := p.asyncAdd(newTestMetric())
+	require.Len(t, out, 1)
+	require.Equal(t, map[string]string{"accountId": "123456789012"}, out[0].Tags())
+
+	// Expired values of required tags still count as resolved.
+	p.tagCache.Clear()
+	client.err = errors.New("connection refused")
+	out = p.asyncAdd(newTestMetric())
+	require.Len(t, out, 1)
+	require.Equal(t, map[string]string{"accountId": "123456789012"}, out[0].Tags())
+
+	p.resetLastKnown()
+	before := p.droppedMetrics.Get()
+	require.Empty(t, p.asyncAdd(newTestMetric()))
+	require.Equal(t, before+1, p.droppedMetrics.Get())
+}
+
+func TestRequiredTagsHold(t *testing.T) {
+	client := &mockIMDSClient{err: errors.New("connection refused")}
+	p := newTestProcessor(t, client, "accountId")
+	p.RequiredTags = []string{"accountId"}
+	p.OnRequiredFailure = "hold"
+	p.HoldInterval = config.Duration(10 * time.Millisecond)
+	require.NoError(t, p.Init())
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		p.setCached("accountId", "123456789012", time.Now())
+	}()
+	out := p.asyncAdd(newTestMetric())
+	require.Len(t, out, 1)
+	require.Equal(t, map[string]string{"accountId": "123456789012"}, out[0].Tags())
+
+	// Metrics are held for at most max_hold.
+	p.resetLastKnown()
+	p.tagCache.Clear()
+	p.MaxHold = config.Duration(50 * time.Millisecond)
+	start := time.Now()
+	require.Empty(t, p.asyncAdd(newTestMetric()))
+	require.GreaterOrEqual(t, time.Since(start), time.Duration(p.MaxHold))
+
+	// Held metrics are dropped on shutdown.
+	p.MaxHold = config.Duration(time.Hour)
+	p.cancelLookups()
+	require.Empty(t, p.asyncAdd(newTestMetric()))
+}
+
+func TestInvalidRequiredTags(t *testing.T) {
+	p := newAwsIMDSProcessor()
+	p.Log = &testutil.Logger{}
+	p.ImdsTags = []string{"region"}
+	p.RequiredTags = []string{"accountId"}
+	require.Error(t, p.Init())
+
+	p.RequiredTags = []string{"region"}
+	p.OnRequiredFailure = "pass"
+	require.Error(t, p.Init())
+
+	p.OnRequiredFailure = "hold"
+	p.MaxHold = 0
+	require.Error(t, p.Init())
+}
+
+func TestSkipIfComplete(t *testing.T) {
+	client := &mockIMDSClient{
+		document: imds.InstanceIdentityDocument{Region: "us-east-1", InstanceType: "m5.large"},
+	}
+	p := newTestProcessor(t, client, "region", "instanceType")
+	p.SkipIfComplete = true
+	acc := &testutil.Accumulator{}
+	p.parallel = parallel.NewUnordered(acc, p.asyncAdd, 1)
+
+	complete := newTestMetric()
+	complete.AddTag("region", "eu-west-1")
+	complete.AddTag("instanceType", "t3.micro")
+	partial := newTestMetric()
+	partial.AddTag("region", "eu-west-1")
+
+	// Complete metrics are passed on right away, without reading the cache.
+	cache := p.tagCache
+	p.tagCache = nil
+	require.NoError(t, p.Add(complete, acc))
+	require.Len(t, acc.GetTelegrafMetrics(), 1)
+	require.EqualValues(t, 0, atomic.LoadInt32(&client.calls))
+	p.tagCache = cache
+
+	require.NoError(t, p.Add(partial, acc))
+	p.parallel.Stop()
+	metrics := acc.GetTelegrafMetrics()
+	require.Len(t, metrics, 2)
+	require.Equal(t, map[string]string{"region": "eu-west-1", "instanceType": "t3.micro"}, metrics[0].Tags())
+	require.Equal(t, map[string]string{"region": "us-east-1", "instanceType": "m5.large"}, metrics[1].Tags())
+}
@@ -0,0 +1,42 @@
+package aws
+
+import (
+	"fmt"
+
+	"github.com/aws/aws-sdk-go-v2/feature/ec2/imds"
+)
+
+// initBillingProductTags adds the tags of billing_product_tags, each telling
+// whether the identity document lists the given billing product.
+func (r *AwsIMDSProcessor) initBillingProductTags(tc *tagConfig) error {
+	for tag, code := range r.BillingProductTags {
+		if tag == "" || isIMDSTagAllowed(tag) {
+			return fmt.Errorf("invalid tag name in billing_product_tags: %q", tag)
+		}
+		if _, ok := tc.imdsTagsMap[tag]; ok {
+			return fmt.Errorf("tag %s of billing_product_tags already configured", tag)
+		}
+		if code == "" {
+			return fmt.Errorf("empty billing product code for tag %s", tag)
+		}
+		tc.imdsTagsMap[tag] = struct{}{}
+	}
+	return nil
+}
+
+// billingProductTag reports whether the tag is one of billing_product_tags.
+func (r *AwsIMDSProcessor) billingProductTag(tag string) bool {
+	_, ok := r.BillingProductTags[tag]
+	return ok
+}
+
+// hasBillingProduct reports whether the billing products of the document
+// include the code.
+func hasBillingProduct(o *imds.GetInstanceIdentityDocumentOutput, code string) bool {
+	for _, product := range o.BillingProducts {
+		if product == code {
+			return true
+		}
+	}
+	return false
+}
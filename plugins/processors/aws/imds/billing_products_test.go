@@ -0,0 +1,47 @@
+package aws
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/feature/ec2/imds"
+	"github.com/influxdata/telegraf/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBillingProductTags(t *testing.T) {
+	client := &mockIMDSClient{
+		document: imds.InstanceIdentityDocument{BillingProducts: []string{"bp-6fa54006", "bp-63a5400a"}},
+	}
+	p := newAwsIMDSProcessor()
+	p.Log = &testutil.Logger{}
+	p.ImdsTags = []string{"billingProducts"}
+	p.BillingProductTags = map[string]string{
+		"windows": "bp-6fa54006",
+		"rhel":    "bp-6fa54000",
+	}
+	require.NoError(t, p.Init())
+	p.tagCache = newTagCache(p.TagCacheSize)
+	p.imdsClient = client
+
+	m := p.LookupIMDSTags(newTestMetric())
+	require.Equal(t, map[string]string{
+		"billingProducts": "bp-6fa54006,bp-63a5400a",
+		"windows":         "true",
+		"rhel":            "false",
+	}, m.Tags())
+	require.EqualValues(t, 1, client.calls, "billing product tags reuse the identity document")
+}
+
+func TestBillingProductTagsInvalid(t *testing.T) {
+	for _, tags := range []map[string]string{
+		{"": "bp-6fa54006"},
+		{"region": "bp-6fa54006"},
+		{"windows": ""},
+	} {
+		p := newAwsIMDSProcessor()
+		p.Log = &testutil.Logger{}
+		p.ImdsTags = []string{"region"}
+		p.BillingProductTags = tags
+		require.Error(t, p.Init(), tags)
+	}
+}
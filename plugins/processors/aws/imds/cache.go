@@ -0,0 +1,214 @@
+package aws
+
+import (
+	"encoding/binary"
+	"errors"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// cacheEntry is a resolved metadata value as stored in the tag cache. The
+// fetch time is kept alongside the value since freecache only exposes the
+// expiry of an entry.
+type cacheEntry struct {
+	value   string
+	fetched time.Time
+}
+
+func (e cacheEntry) encode() []byte {
+	b := make([]byte, 8+len(e.value))
+	binary.BigEndian.PutUint64(b, uint64(e.fetched.UnixNano()))
+	copy(b[8:], e.value)
+	return b
+}
+
+func decodeCacheEntry(b []byte) (cacheEntry, error) {
+	if len(b) < 8 {
+		return cacheEntry{}, errors.New("cache entry too short")
+	}
+	return cacheEntry{
+		value:   string(b[8:]),
+		fetched: time.Unix(0, int64(binary.BigEndian.Uint64(b[:8]))),
+	}, nil
+}
+
+// initCache sets up the tag cache when starting. The cache is rebuilt unless
+// flush_cache_on_start is disabled and a cache of the same size remains from
+// an earlier start, in which case only the entries of tags no longer
+// configured, and of derived tags if the options deriving them changed, are
+// removed and the others stay warm.
+func (r *AwsIMDSProcessor) initCache() {
+	if r.FlushCacheOnStart || r.tagCache == nil || r.cacheSize != r.TagCacheSize {
+		r.tagCache = newTagCache(r.TagCacheSize)
+		r.cacheSize = r.TagCacheSize
+		r.cacheFingerprint = r.fingerprint
+		return
+	}
+	if r.cacheFingerprint != r.fingerprint {
+		n := r.invalidateDerived()
+		r.cacheFingerprint = r.fingerprint
+		r.logRoutinef("Configuration changed, removed %d cached values derived from it", n)
+	}
+
+	tc := r.loadTags()
+	var keys []string
+	it := r.tagCache.NewIterator()
+	for entry := it.Next(); entry != nil; entry = it.Next() {
+		keys = append(keys, string(entry.Key))
+	}
+	var kept int
+	for _, tag := range keys {
+		_, configured := tc.imdsTagsMap[tag]
+		if _, ok := tc.lookupTags[tag]; ok {
+			configured = true
+		}
+		if !configured {
+			r.tagCache.Del([]byte(tag))
+			continue
+		}
+		kept++
+		if pinnedTag(tag) {
+			continue
+		}
+		// The index was recreated by Init.
+		for _, key := range r.cacheIndex.add(tag) {
+			r.tagCache.Del([]byte(key))
+			r.cacheEvictions.Incr(1)
+			kept--
+		}
+	}
+	r.logRoutinef("Kept %d of %d cached values", kept, len(keys))
+}
+
+// getCached returns the cached entry for the given tag, if any. Entries older
+// than max_value_age are ignored even if they haven't expired yet. With
+// disable_cache, only entries fetched within no_cache_min_interval are
+// returned, which rate limits the lookups of each tag.
+func (r *AwsIMDSProcessor) getCached(tag string) (cacheEntry, bool) {
+	e, ok := r.tagCache.lookup(tag, time.Now())
+	if !ok {
+		r.cacheIndex.remove(tag)
+		r.cacheMisses.Incr(1)
+		return cacheEntry{}, false
+	}
+	if !pinnedTag(tag) {
+		r.cacheIndex.touch(tag)
+	}
+	if r.tooOld(e) ||
+		(r.DisableCache && time.Since(e.fetched) >= time.Duration(r.NoCacheMinInterval)) {
+		r.cacheMisses.Incr(1)
+		return cacheEntry{}, false
+	}
+	r.cacheHits.Incr(1)
+	return e, true
+}
+
+// tooOld reports whether the entry exceeds max_value_age.
+func (r *AwsIMDSProcessor) tooOld(e cacheEntry) bool {
+	return r.MaxValueAge > 0 && time.Since(e.fetched) > time.Duration(r.MaxValueAge)
+}
+
+// setCached stores a freshly fetched value for the given tag. Values taken
+// from an earlier fetch, e.g. of the cached identity document, expire as if
+// cached at their fetch time.
+func (r *AwsIMDSProcessor) setCached(tag, value string, fetched time.Time) {
+	var expiration int
+	if ttl := r.jitteredTTL(r.cacheTTL(tag)); ttl > 0 {
+		expiration = int((ttl - time.Since(fetched)).Round(time.Second).Seconds())
+		if expiration < 1 {
+			expiration = 1
+		}
+	}
+	e := cacheEntry{value: value, fetched: fetched}
+	r.rememberValue(tag, e)
+	if err := r.setCacheEntry(tag, e, expiration); err != nil {
+		r.Log.Errorf("Error when setting IMDS tag cache value: %v", err)
+	}
+}
+
+// setNegativeCached caches the absence of a value for the given tag for
+// negative_cache_ttl, but no longer than values of the tag are cached.
+func (r *AwsIMDSProcessor) setNegativeCached(tag string, fetched time.Time) {
+	ttl := time.Duration(r.NegativeCacheTTL)
+	if limit := r.cacheTTL(tag); limit > 0 && limit < ttl {
+		ttl = limit
+	}
+	e := cacheEntry{fetched: fetched}
+	if err := r.setCacheEntry(tag, e, int(ttl.Seconds())); err != nil {
+		r.Log.Errorf("Error when setting IMDS tag cache value: %v", err)
+	}
+}
+
+// jitteredTTL varies ttl randomly by up to cache_ttl_jitter in either
+// direction, so the values of agents started at once don't all expire at
+// once. Values cached without expiry and with disable_cache aren't affected.
+func (r *AwsIMDSProcessor) jitteredTTL(ttl time.Duration) time.Duration {
+	if ttl <= 0 || r.CacheTTLJitter <= 0 || r.DisableCache {
+		return ttl
+	}
+	ttl = time.Duration(float64(ttl) * (1 + r.CacheTTLJitter*(2*r.randFloat()-1)))
+	if ttl < time.Second {
+		return time.Second
+	}
+	return ttl
+}
+
+// cacheTTLBucket returns the TTL in whole seconds, including
+// cache_ttl_jitter, of the first expiring of the given cached values. It is
+// derived from the remaining TTL and the age of the value, so it is off by a
+// second at most. Values cached without expiry are skipped.
+func (r *AwsIMDSProcessor) cacheTTLBucket(values map[string]cacheEntry) (int64, bool) {
+	var bucket int64
+	var expires time.Time
+	for tag, e := range values {
+		remaining, err := r.tagCache.TTL([]byte(tag))
+		if err != nil || remaining == 0 {
+			continue
+		}
+		exp := time.Now().Add(time.Duration(remaining) * time.Second)
+		if expires.IsZero() || exp.Before(expires) {
+			expires = exp
+			bucket = int64(exp.Sub(e.fetched).Round(time.Second).Seconds())
+		}
+	}
+	return bucket, !expires.IsZero()
+}
+
+// newRandFloat returns a source of random numbers in [0, 1) safe for use by
+// the parallel workers.
+func newRandFloat() func() float64 {
+	rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
+	var mu sync.Mutex
+	return func() float64 {
+		mu.Lock()
+		defer mu.Unlock()
+		return rnd.Float64()
+	}
+}
+
+// cacheTTL returns how long values of the given tag may be cached. An entry
+// in cache_ttl_overrides takes precedence. Instance tags, which are edited
+// while the instance runs, are cached according to instance_tags_ttl
+// independent of cache_ttl. Otherwise tags resolved from frequently changing
+// meta-data paths are capped to a shorter TTL than cache_ttl. A TTL of zero
+// means the entry never expires. A tag's entry is the same in every tag
+// configuration containing it, so the one in effect is used.
+func (r *AwsIMDSProcessor) cacheTTL(tag string) time.Duration {
+	if r.DisableCache {
+		// Keep entries long enough for getCached to rate limit lookups.
+		return time.Duration(r.NoCacheMinInterval).Truncate(time.Second) + time.Second
+	}
+	if ttl, ok := r.CacheTTLOverrides[tag]; ok {
+		return time.Duration(ttl)
+	}
+	mt, ok := r.loadTags().pathTags[tag]
+	if ok && mt.instanceTag {
+		return time.Duration(r.InstanceTagsTTL)
+	}
+	ttl := time.Duration(r.CacheTTL)
+	if ok && mt.ttl > 0 && (ttl == 0 || mt.ttl < ttl) {
+		return mt.ttl
+	}
+	return ttl
+}
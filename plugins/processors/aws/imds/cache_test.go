@@ -0,0 +1,343 @@
+package aws
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/feature/ec2/imds"
+	"github.com/coocood/freecache"
+	"github.com/influxdata/telegraf/config"
+	"github.com/influxdata/telegraf/metric"
+	"github.com/influxdata/telegraf/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCacheEntryRoundTrip(t *testing.T) {
+	e := cacheEntry{value: "us-east-1", fetched: time.Unix(1700000000, 42)}
+	decoded, err := decodeCacheEntry(e.encode())
+	require.NoError(t, err)
+	require.Equal(t, e.value, decoded.value)
+	require.True(t, e.fetched.Equal(decoded.fetched))
+
+	_, err = decodeCacheEntry([]byte("abc"))
+	require.Error(t, err)
+}
+
+func TestAddFetchTime(t *testing.T) {
+	p := newAwsIMDSProcessor()
+	p.Log = &testutil.Logger{}
+	p.ImdsTags = []string{"region", "accountId"}
+	p.AddFetchTime = true
+	require.NoError(t, p.Init())
+	p.tagCache = newTagCache(p.TagCacheSize)
+
+	p.setCached("region", "us-east-1", time.Unix(2000, 0))
+	p.setCached("accountId", "123456789012", time.Unix(1000, 0))
+
+	m := metric.New("m", map[string]string{}, map[string]interface{}{"v": 1}, time.Unix(0, 0))
+	m = p.LookupIMDSTags(m)
+	require.Equal(t, map[string]string{"region": "us-east-1", "accountId": "123456789012"}, m.Tags())
+
+	v, ok := m.GetField("imds_fetch_time")
+	require.True(t, ok)
+	require.Equal(t, int64(1000), v)
+}
+
+func TestMaxValueAge(t *testing.T) {
+	client := &mockIMDSClient{document: imds.InstanceIdentityDocument{Region: "us-west-2"}}
+	p := newTestProcessor(t, client, "region")
+	p.CacheTTL = config.Duration(24 * time.Hour)
+	p.MaxValueAge = config.Duration(time.Hour)
+	require.NoError(t, p.Init())
+
+	// A fresh value within max_value_age is served from the cache.
+	p.setCached("region", "us-east-1", time.Now())
+	m := p.LookupIMDSTags(newTestMetric())
+	require.Equal(t, map[string]string{"region": "us-east-1"}, m.Tags())
+	require.EqualValues(t, 0, client.calls)
+
+	// A value past max_value_age is fetched again although still cached.
+	p.setCached("region", "us-east-1", time.Now().Add(-2*time.Hour))
+	m = p.LookupIMDSTags(newTestMetric())
+	require.Equal(t, map[string]string{"region": "us-west-2"}, m.Tags())
+	require.EqualValues(t, 1, client.calls)
+}
+
+func TestCacheTTLInvalid(t *testing.T) {
+	for _, ttl := range []time.Duration{-time.Minute, 500 * time.Millisecond} {
+		p := newAwsIMDSProcessor()
+		p.Log = &testutil.Logger{}
+		p.ImdsTags = []string{"region"}
+		p.CacheTTL = config.Duration(ttl)
+		require.Error(t, p.Init(), ttl)
+	}
+
+	p := newAwsIMDSProcessor()
+	p.Log = &testutil.Logger{}
+	p.ImdsTags = []string{"region"}
+	p.CacheTTL = config.Duration(15 * time.Minute)
+	require.NoError(t, p.Init())
+	require.Equal(t, 15*time.Minute, p.cacheTTL("region"))
+}
+
+func TestCacheTTLOverrides(t *testing.T) {
+	p := newAwsIMDSProcessor()
+	p.Log = &testutil.Logger{}
+	p.ImdsTags = []string{"region", "instanceType", "scheduledMaintenance"}
+	p.CacheTTL = config.Duration(24 * time.Hour)
+	p.CacheTTLOverrides = map[string]config.Duration{
+		"instanceType":         config.Duration(10 * time.Minute),
+		"scheduledMaintenance": config.Duration(time.Hour),
+	}
+	require.NoError(t, p.Init())
+	require.Equal(t, 24*time.Hour, p.cacheTTL("region"))
+	require.Equal(t, 10*time.Minute, p.cacheTTL("instanceType"))
+	// Overrides take precedence over built-in caps as well.
+	require.Equal(t, time.Hour, p.cacheTTL("scheduledMaintenance"))
+
+	p.tagCache = newTagCache(p.TagCacheSize)
+	p.setCached("instanceType", "m5.large", time.Now())
+	ttl, err := p.tagCache.TTL([]byte("instanceType"))
+	require.NoError(t, err)
+	require.InDelta(t, (10 * time.Minute).Seconds(), float64(ttl), 1)
+}
+
+func TestCacheTTLOverridesInvalid(t *testing.T) {
+	for _, overrides := range []map[string]config.Duration{
+		{"accountId": config.Duration(time.Minute)},
+		{"region": config.Duration(-time.Minute)},
+		{"region": config.Duration(100 * time.Millisecond)},
+	} {
+		p := newAwsIMDSProcessor()
+		p.Log = &testutil.Logger{}
+		p.ImdsTags = []string{"region"}
+		p.CacheTTLOverrides = overrides
+		require.Error(t, p.Init(), overrides)
+	}
+}
+
+func TestDisableCache(t *testing.T) {
+	client := &mockIMDSClient{document: imds.InstanceIdentityDocument{Region: "us-east-1"}}
+	p := newAwsIMDSProcessor()
+	p.Log = &testutil.Logger{}
+	p.ImdsTags = []string{"region"}
+	p.DisableCache = true
+	p.NoCacheMinInterval = config.Duration(time.Minute)
+	require.NoError(t, p.Init())
+	p.tagCache = newTagCache(p.TagCacheSize)
+	p.imdsClient = client
+
+	// Lookups within no_cache_min_interval reuse the fetched value.
+	for i := 0; i < 100; i++ {
+		m := p.LookupIMDSTags(newTestMetric())
+		require.Equal(t, map[string]string{"region": "us-east-1"}, m.Tags())
+	}
+	require.EqualValues(t, 1, client.calls)
+
+	// Once the interval passed, the value is fetched again.
+	past := time.Now().Add(-time.Minute)
+	p.cacheDocument(&imds.GetInstanceIdentityDocumentOutput{InstanceIdentityDocument: client.document}, past)
+	p.setCached("region", "us-east-1", past)
+	client.document.Region = "us-west-2"
+	m := p.LookupIMDSTags(newTestMetric())
+	require.Equal(t, map[string]string{"region": "us-west-2"}, m.Tags())
+	require.EqualValues(t, 2, client.calls)
+
+	// Without an interval every lookup goes to IMDS.
+	p.NoCacheMinInterval = 0
+	p.LookupIMDSTags(newTestMetric())
+	p.LookupIMDSTags(newTestMetric())
+	require.EqualValues(t, 4, client.calls)
+}
+
+func TestMaxCacheEntries(t *testing.T) {
+	p := newAwsIMDSProcessor()
+	p.Log = &testutil.Logger{}
+	p.ImdsTags = []string{"region"}
+	p.MetadataPaths = map[string]string{
+		"a": "placement/a",
+		"b": "placement/b",
+		"c": "placement/c",
+	}
+	p.MaxCacheEntries = 2
+	require.NoError(t, p.Init())
+	p.tagCache = newTagCache(p.TagCacheSize)
+	evictions := p.cacheEvictions.Get()
+
+	now := time.Now()
+	p.setCached("region", "us-east-1", now)
+	p.setCached("a", "1", now)
+	p.setCached("b", "2", now)
+	_, ok := p.getCached("a")
+	require.True(t, ok)
+
+	// b is the least recently used entry, the pinned region isn't counted.
+	p.setCached("c", "3", now)
+	_, ok = p.getCached("b")
+	require.False(t, ok)
+	for _, tag := range []string{"region", "a", "c"} {
+		_, ok := p.getCached(tag)
+		require.True(t, ok, tag)
+	}
+	require.Equal(t, evictions+1, p.cacheEvictions.Get())
+
+	// Reads before the limit is reached count as well.
+	p = newAwsIMDSProcessor()
+	p.Log = &testutil.Logger{}
+	p.ImdsTags = []string{"region"}
+	p.MetadataPaths = map[string]string{
+		"a": "placement/a",
+		"b": "placement/b",
+		"c": "placement/c",
+		"d": "placement/d",
+	}
+	p.MaxCacheEntries = 3
+	require.NoError(t, p.Init())
+	p.tagCache = newTagCache(p.TagCacheSize)
+
+	p.setCached("a", "1", now)
+	p.setCached("b", "2", now)
+	_, ok = p.getCached("a")
+	require.True(t, ok)
+	p.setCached("c", "3", now)
+	p.setCached("d", "4", now)
+	_, ok = p.getCached("b")
+	require.False(t, ok)
+	for _, tag := range []string{"a", "c", "d"} {
+		_, ok := p.getCached(tag)
+		require.True(t, ok, tag)
+	}
+
+	p = newAwsIMDSProcessor()
+	p.Log = &testutil.Logger{}
+	p.ImdsTags = []string{"region"}
+	p.MaxCacheEntries = 0
+	require.Error(t, p.Init())
+}
+
+func TestNegativeCache(t *testing.T) {
+	client := &mockIMDSClient{document: imds.InstanceIdentityDocument{Region: "us-east-1"}}
+	p := newAwsIMDSProcessor()
+	p.Log = &testutil.Logger{}
+	p.ImdsTags = []string{"region", "kernelId"}
+	p.MetadataPaths = map[string]string{"placementGroup": "placement/group-name"}
+	require.NoError(t, p.Init())
+	p.tagCache = newTagCache(p.TagCacheSize)
+	p.imdsClient = client
+
+	// The empty kernelId and the missing path are served from the cache.
+	for i := 0; i < 3; i++ {
+		m := p.LookupIMDSTags(newTestMetric())
+		require.Equal(t, map[string]string{"region": "us-east-1"}, m.Tags())
+	}
+	require.EqualValues(t, 2, client.calls)
+	ttl, err := p.tagCache.TTL([]byte("kernelId"))
+	require.NoError(t, err)
+	require.InDelta(t, DefaultNegativeCacheTTL.Seconds(), float64(ttl), 1)
+
+	// Transient errors aren't cached.
+	client = &mockIMDSClient{err: errors.New("connection refused")}
+	p.tagCache.Clear()
+	p.imdsClient = client
+	for i := 0; i < 2; i++ {
+		require.ElementsMatch(t, []string{"region", "kernelId", "placementGroup"}, p.enrich(p.loadTags(), newTestMetric(), false))
+	}
+	require.EqualValues(t, 4, client.calls)
+}
+
+func TestFlushCacheOnStart(t *testing.T) {
+	server := newIMDSServer(t, `{"instanceId": "i-0123456789abcdef0", "region": "eu-west-1"}`)
+
+	for _, flush := range []bool{true, false} {
+		t.Run(fmt.Sprintf("flush=%t", flush), func(t *testing.T) {
+			p := newAwsIMDSProcessor()
+			p.Log = &testutil.Logger{}
+			p.ImdsTags = []string{"region", "instanceId"}
+			p.Endpoint = server.URL
+			p.FlushCacheOnStart = flush
+			require.NoError(t, p.Init())
+			require.NoError(t, p.Start(&testutil.Accumulator{}))
+			p.LookupIMDSTags(newTestMetric())
+			p.Stop()
+			e, ok := p.getCached("instanceId")
+			require.True(t, ok)
+			fetched := e.fetched
+
+			// Reconfigure and restart like on a reload.
+			p.ImdsTags = []string{"instanceId"}
+			require.NoError(t, p.Init())
+			require.NoError(t, p.Start(&testutil.Accumulator{}))
+			defer p.Stop()
+
+			_, err := p.tagCache.Get([]byte("region"))
+			require.ErrorIs(t, err, freecache.ErrNotFound)
+			// Start looks up the configured tags again, unless still cached.
+			e, ok = p.getCached("instanceId")
+			require.True(t, ok)
+			if flush {
+				require.True(t, e.fetched.After(fetched))
+			} else {
+				require.Equal(t, fetched, e.fetched)
+			}
+		})
+	}
+}
+
+func TestCacheTTLJitter(t *testing.T) {
+	tests := []struct {
+		name     string
+		rand     float64
+		expected uint32
+	}{
+		{"shortest", 0, 90},
+		{"unchanged", 0.5, 100},
+		{"longest", 0.999999, 109},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newTestProcessor(t, &mockIMDSClient{}, "region")
+			p.CacheTTL = config.Duration(100 * time.Second)
+			p.CacheTTLJitter = 0.1
+			p.randFloat = func() float64 { return tt.rand }
+
+			p.setCached("region", "us-east-1", time.Now())
+			ttl, err := p.tagCache.TTL([]byte("region"))
+			require.NoError(t, err)
+			// The remaining TTL drops once the second ticks over.
+			require.InDelta(t, tt.expected, ttl, 1)
+		})
+	}
+
+	p := newAwsIMDSProcessor()
+	p.Log = &testutil.Logger{}
+	p.ImdsTags = []string{"region"}
+	p.CacheTTLJitter = 1
+	require.Error(t, p.Init())
+}
+
+func TestCacheTTLBucket(t *testing.T) {
+	client := &mockIMDSClient{
+		document: imds.InstanceIdentityDocument{Region: "us-east-1", InstanceType: "m5.large"},
+	}
+	p := newTestProcessor(t, client, "region", "instanceType")
+	p.AddDiagnostics = true
+	p.CacheTTL = config.Duration(time.Hour)
+	p.CacheTTLOverrides = map[string]config.Duration{"instanceType": config.Duration(10 * time.Minute)}
+	p.CacheTTLJitter = 0.1
+	p.randFloat = func() float64 { return 1 }
+
+	// The first expiring value is reported, including the jitter.
+	m := p.LookupIMDSTags(newTestMetric())
+	bucket, ok := m.GetField("imds_cache_ttl_bucket")
+	require.True(t, ok)
+	require.InDelta(t, 660, bucket, 1)
+
+	// Values cached without expiry add no bucket.
+	p = newTestProcessor(t, client, "region")
+	p.AddDiagnostics = true
+	m = p.LookupIMDSTags(newTestMetric())
+	require.False(t, m.HasField("imds_cache_ttl_bucket"))
+}
@@ -0,0 +1,39 @@
+package aws
+
+import (
+	"strings"
+	"unicode"
+)
+
+// cpuArch normalizes the architecture of the identity document into "x86" or
+// "arm". Unknown architectures are returned as-is.
+func cpuArch(architecture string) string {
+	switch architecture {
+	case "x86_64", "i386":
+		return "x86"
+	case "arm64":
+		return "arm"
+	}
+	return architecture
+}
+
+// isGraviton reports whether the instance type belongs to an AWS Graviton
+// family. These families carry a "g" after the generation, e.g. "c6g",
+// "m7gd" or "r6gn"; the first generation a1 family is Graviton as well.
+// Only the letter following the generation counts, as GPU families such as
+// "g4dn" start with a "g" themselves.
+func isGraviton(instanceType string) bool {
+	family, _, _ := strings.Cut(instanceType, ".")
+	if family == "a1" {
+		return true
+	}
+
+	i := strings.IndexFunc(family, unicode.IsDigit)
+	if i < 0 {
+		return false
+	}
+	for i < len(family) && unicode.IsDigit(rune(family[i])) {
+		i++
+	}
+	return i < len(family) && family[i] == 'g'
+}
@@ -0,0 +1,62 @@
+package aws
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/feature/ec2/imds"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIsGraviton(t *testing.T) {
+	tests := []struct {
+		instanceType string
+		expected     bool
+	}{
+		{"c6g.large", true},
+		{"m7gd.xlarge", true},
+		{"r6gn.2xlarge", true},
+		{"x2gd.medium", true},
+		{"a1.medium", true},
+		{"g5g.xlarge", true},
+		{"m5.large", false},
+		{"g4dn.xlarge", false},
+		{"c7i.large", false},
+		{"t3a.nano", false},
+		{"", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.instanceType, func(t *testing.T) {
+			require.Equal(t, tt.expected, isGraviton(tt.instanceType))
+		})
+	}
+}
+
+func TestCPUTags(t *testing.T) {
+	tests := []struct {
+		name     string
+		document imds.InstanceIdentityDocument
+		expected map[string]string
+	}{
+		{
+			name:     "graviton",
+			document: imds.InstanceIdentityDocument{Architecture: "arm64", InstanceType: "c6g.large"},
+			expected: map[string]string{"cpuArch": "arm", "graviton": "true"},
+		},
+		{
+			name:     "x86",
+			document: imds.InstanceIdentityDocument{Architecture: "x86_64", InstanceType: "m5.large"},
+			expected: map[string]string{"cpuArch": "x86", "graviton": "false"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &mockIMDSClient{document: tt.document}
+			p := newTestProcessor(t, client, "cpuArch", "graviton")
+			m := p.LookupIMDSTags(newTestMetric())
+			require.Equal(t, tt.expected, m.Tags())
+			require.EqualValues(t, 1, client.calls)
+		})
+	}
+}
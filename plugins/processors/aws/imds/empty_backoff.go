@@ -0,0 +1,89 @@
+package aws
+
+import (
+	"time"
+)
+
+// emptyBackoff tracks a tag which repeatedly resolved to an empty value.
+type emptyBackoff struct {
+	streak int
+	next   time.Time
+}
+
+// inEmptyBackoff reports whether the lookup of a tag that resolved empty
+// before should be skipped until its re-check interval has passed.
+func (r *AwsIMDSProcessor) inEmptyBackoff(tag string, now time.Time) bool {
+	if r.EmptyValueBackoff <= 0 {
+		return false
+	}
+
+	r.emptyMu.Lock()
+	defer r.emptyMu.Unlock()
+	b, ok := r.emptyBackoffs[tag]
+	return ok && now.Before(b.next)
+}
+
+// absentResolved records that a tag has no value on this instance, i.e. it
+// resolved empty or its path doesn't exist. The absence is cached so it is
+// served from the cache: for cache_ttl if the tag caches empty values, such
+// as JSON queries, otherwise for negative_cache_ttl. Without negative caching
+// the empty value backoff applies.
+func (r *AwsIMDSProcessor) absentResolved(tc *tagConfig, tag string, now time.Time) {
+	switch {
+	case tc.pathTags[tag].cacheEmpty:
+		r.setCached(tag, "", now)
+	case r.NegativeCacheTTL > 0:
+		r.setNegativeCached(tag, now)
+	default:
+		r.emptyResolved(tag, now)
+		return
+	}
+	r.logEmptyValue(tag)
+}
+
+// emptyResolved records that a tag resolved to an empty value. The re-check
+// interval starts at empty_value_backoff and doubles with every further empty
+// result up to empty_value_backoff_max.
+func (r *AwsIMDSProcessor) emptyResolved(tag string, now time.Time) {
+	r.logEmptyValue(tag)
+	if r.EmptyValueBackoff <= 0 {
+		return
+	}
+
+	r.emptyMu.Lock()
+	defer r.emptyMu.Unlock()
+	b, ok := r.emptyBackoffs[tag]
+	if !ok {
+		b = &emptyBackoff{}
+		r.emptyBackoffs[tag] = b
+	}
+
+	interval := time.Duration(r.EmptyValueBackoff)
+	limit := time.Duration(r.EmptyValueBackoffMax)
+	for i := 0; i < b.streak && interval < limit; i++ {
+		interval *= 2
+	}
+	if interval > limit {
+		interval = limit
+	}
+	b.streak++
+	b.next = now.Add(interval)
+}
+
+// valueResolved resets the backoff of a tag once it resolved to a value.
+func (r *AwsIMDSProcessor) valueResolved(tag string) {
+	if r.EmptyValueBackoff <= 0 {
+		return
+	}
+
+	r.emptyMu.Lock()
+	defer r.emptyMu.Unlock()
+	delete(r.emptyBackoffs, tag)
+}
+
+// resetEmptyBackoffs re-checks all tags on the next lookup.
+func (r *AwsIMDSProcessor) resetEmptyBackoffs() {
+	r.emptyMu.Lock()
+	defer r.emptyMu.Unlock()
+	r.emptyBackoffs = make(map[string]*emptyBackoff)
+}
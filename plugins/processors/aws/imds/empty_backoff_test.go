@@ -0,0 +1,55 @@
+package aws
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/feature/ec2/imds"
+	"github.com/influxdata/telegraf/config"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEmptyValueBackoff(t *testing.T) {
+	client := &mockIMDSClient{document: imds.InstanceIdentityDocument{Region: "us-east-1"}}
+	p := newTestProcessor(t, client, "region", "kernelId")
+	p.NegativeCacheTTL = 0
+	p.EmptyValueBackoff = config.Duration(time.Minute)
+	p.EmptyValueBackoffMax = config.Duration(3 * time.Minute)
+
+	// The empty tag is only looked up once within the backoff interval.
+	for i := 0; i < 3; i++ {
+		m := p.LookupIMDSTags(newTestMetric())
+		require.Equal(t, map[string]string{"region": "us-east-1"}, m.Tags())
+	}
+	require.EqualValues(t, 1, atomic.LoadInt32(&client.calls))
+
+	// The interval doubles with every empty result up to the cap.
+	now := time.Now()
+	var intervals []time.Duration
+	for i := 0; i < 4; i++ {
+		p.emptyResolved("kernelId", now)
+		intervals = append(intervals, p.emptyBackoffs["kernelId"].next.Sub(now))
+	}
+	require.Equal(t, []time.Duration{2 * time.Minute, 3 * time.Minute, 3 * time.Minute, 3 * time.Minute}, intervals)
+	require.True(t, p.inEmptyBackoff("kernelId", now.Add(2*time.Minute)))
+	require.False(t, p.inEmptyBackoff("kernelId", now.Add(3*time.Minute)))
+
+	// A value resets the backoff.
+	p.valueResolved("kernelId")
+	require.False(t, p.inEmptyBackoff("kernelId", now))
+}
+
+func TestEmptyValueBackoffDisabled(t *testing.T) {
+	client := &mockIMDSClient{document: imds.InstanceIdentityDocument{Region: "us-east-1"}}
+	p := newTestProcessor(t, client, "region", "kernelId")
+	p.NegativeCacheTTL = 0
+
+	// The empty kernelId is resolved again on every lookup, from the cached
+	// identity document.
+	for i := 0; i < 3; i++ {
+		p.LookupIMDSTags(newTestMetric())
+	}
+	require.EqualValues(t, 1, atomic.LoadInt32(&client.calls))
+	require.False(t, p.inEmptyBackoff("kernelId", time.Now()))
+}
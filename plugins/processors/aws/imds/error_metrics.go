@@ -0,0 +1,110 @@
+package aws
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"time"
+
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+	"github.com/influxdata/telegraf"
+)
+
+// errorMetricName is the name of the metric counting failed lookups.
+const errorMetricName = "aws_imds_errors"
+
+// errNoRegion is the error of region lookups none of region_sources
+// answered.
+var errNoRegion = errors.New("no region source reported a region")
+
+// errorCategory classifies lookup errors for the error metric.
+func errorCategory(err error) string {
+	var respErr *smithyhttp.ResponseError
+	var netErr net.Error
+	switch {
+	case errors.Is(err, errNoRegion):
+		return "no_region"
+	case errors.Is(err, errHTMLResponse):
+		return "html_response"
+	case errors.Is(err, ErrTimeout), errors.Is(err, context.DeadlineExceeded):
+		return "timeout"
+	case errors.Is(err, context.Canceled):
+		return "canceled"
+	case errors.As(err, &respErr):
+		switch code := respErr.HTTPStatusCode(); {
+		case code == http.StatusNotFound:
+			return "not_found"
+		case code == http.StatusTooManyRequests:
+			return "throttled"
+		case code >= 500:
+			return "server_error"
+		default:
+			return "client_error"
+		}
+	case errors.As(err, &netErr):
+		if netErr.Timeout() {
+			return "timeout"
+		}
+		return "connection"
+	default:
+		return "other"
+	}
+}
+
+// recordLookupError counts the failed lookup for the error metric.
+func (r *AwsIMDSProcessor) recordLookupError(err error) {
+	if !r.EmitErrorMetrics {
+		return
+	}
+	category := errorCategory(err)
+	r.errorCountsMu.Lock()
+	defer r.errorCountsMu.Unlock()
+	if r.errorCounts == nil {
+		r.errorCounts = make(map[string]int64)
+	}
+	r.errorCounts[category]++
+}
+
+// emitErrorMetrics adds the error metric every stats_interval. Failures
+// since the last metric aren't reported when stopped, as the execd shim
+// closes the accumulator before stopping the processor.
+func (r *AwsIMDSProcessor) emitErrorMetrics(ctx context.Context, acc telegraf.Accumulator) {
+	ticker := time.NewTicker(time.Duration(r.StatsInterval))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			r.emitErrorMetric(acc)
+		}
+	}
+}
+
+// emitErrorMetric adds a metric per category of the lookups failed since the
+// last call, counting them in the "count" field. Nothing is added if no
+// lookup failed.
+func (r *AwsIMDSProcessor) emitErrorMetric(acc telegraf.Accumulator) {
+	r.errorCountsMu.Lock()
+	counts := r.errorCounts
+	r.errorCounts = nil
+	r.errorCountsMu.Unlock()
+	if len(counts) == 0 {
+		return
+	}
+
+	r.identityMu.Lock()
+	instanceID := r.instanceID
+	r.identityMu.Unlock()
+
+	now := time.Now()
+	for category, n := range counts {
+		tags := map[string]string{"category": category}
+		if instanceID != "" {
+			tags["instance_id"] = instanceID
+		}
+		acc.AddFields(errorMetricName, map[string]interface{}{"count": n}, tags, now)
+	}
+}
@@ -0,0 +1,106 @@
+package aws
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/feature/ec2/imds"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+	"github.com/influxdata/telegraf"
+	"github.com/influxdata/telegraf/agent"
+	"github.com/influxdata/telegraf/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func responseError(code int) error {
+	return &smithyhttp.ResponseError{
+		Response: &smithyhttp.Response{Response: &http.Response{StatusCode: code}},
+		Err:      fmt.Errorf("status %d", code),
+	}
+}
+
+func TestErrorCategory(t *testing.T) {
+	tests := []struct {
+		err      error
+		expected string
+	}{
+		{fmt.Errorf("attempt: %w", context.DeadlineExceeded), "timeout"},
+		{context.Canceled, "canceled"},
+		{errNoRegion, "no_region"},
+		{fmt.Errorf("%w for mac", errHTMLResponse), "html_response"},
+		{notFoundError("mac"), "not_found"},
+		{responseError(http.StatusTooManyRequests), "throttled"},
+		{responseError(http.StatusForbidden), "client_error"},
+		{responseError(http.StatusServiceUnavailable), "server_error"},
+		{&net.OpError{Op: "dial", Err: errors.New("connection refused")}, "connection"},
+		{errors.New("unexpected"), "other"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.expected, func(t *testing.T) {
+			require.Equal(t, tt.expected, errorCategory(tt.err))
+		})
+	}
+}
+
+// shimMetricMaker passes metrics through unchanged, like the execd shim.
+type shimMetricMaker struct{}
+
+func (shimMetricMaker) LogName() string                              { return "shim" }
+func (shimMetricMaker) MakeMetric(m telegraf.Metric) telegraf.Metric { return m }
+func (shimMetricMaker) Log() telegraf.Logger                         { return &testutil.Logger{} }
+
+func TestEmitErrorMetricsClosedAccumulator(t *testing.T) {
+	server := newIMDSServer(t, `{"instanceId": "i-0123456789abcdef0", "region": "eu-west-1"}`)
+
+	p := newAwsIMDSProcessor()
+	p.Log = &testutil.Logger{}
+	p.ImdsTags = []string{"region"}
+	p.Endpoint = server.URL
+	p.EmitErrorMetrics = true
+	require.NoError(t, p.Init())
+
+	// The shim closes the channel of the accumulator before stopping the
+	// processor, sending to it must not happen afterwards.
+	metrics := make(chan telegraf.Metric, 10)
+	require.NoError(t, p.Start(agent.NewAccumulator(shimMetricMaker{}, metrics)))
+	p.recordLookupError(errNoRegion)
+	close(metrics)
+	p.Stop()
+}
+
+func TestEmitErrorMetrics(t *testing.T) {
+	client := &mockIMDSClient{
+		document: imds.InstanceIdentityDocument{Region: "us-east-1"},
+		err:      &net.OpError{Op: "dial", Err: errors.New("connection refused")},
+	}
+	p := newTestProcessor(t, client, "region")
+	p.MetadataPaths = map[string]string{"mac": "mac"}
+	p.EmitErrorMetrics = true
+	require.NoError(t, p.Init())
+	p.instanceID = "i-0123456789abcdef0"
+
+	acc := &testutil.Accumulator{}
+	p.emitErrorMetric(acc)
+	require.Empty(t, acc.GetTelegrafMetrics())
+
+	p.LookupIMDSTags(newTestMetric())
+	p.LookupIMDSTags(newTestMetric())
+	p.emitErrorMetric(acc)
+
+	// The document and the path failed on both lookups.
+	require.Len(t, acc.GetTelegrafMetrics(), 1)
+	m := acc.GetTelegrafMetrics()[0]
+	require.Equal(t, "aws_imds_errors", m.Name())
+	require.Equal(t, map[string]string{"category": "connection", "instance_id": "i-0123456789abcdef0"}, m.Tags())
+	require.Equal(t, map[string]interface{}{"count": int64(4)}, m.Fields())
+
+	// The counts start over with every metric.
+	acc.ClearMetrics()
+	p.emitErrorMetric(acc)
+	require.Empty(t, acc.GetTelegrafMetrics())
+}
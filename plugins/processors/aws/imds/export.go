@@ -0,0 +1,87 @@
+package aws
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+)
+
+// exportFetchTimeKey holds the Unix time in seconds at which the oldest of the
+// exported values was fetched from IMDS.
+const exportFetchTimeKey = "imds_fetch_time"
+
+// parseFileMode parses an octal file mode such as "0644".
+func parseFileMode(mode string) (os.FileMode, error) {
+	m, err := strconv.ParseUint(mode, 8, 32)
+	if err != nil || m > 0o777 {
+		return 0, fmt.Errorf("invalid file mode %q", mode)
+	}
+	return os.FileMode(m), nil
+}
+
+// exportValues writes the cached values of the configured tags, keyed and
+// transformed as they are added to metrics, as a JSON object to export_file
+// along with the fetch time of the oldest value. Errors are logged only, so
+// exporting never affects metric processing.
+func (r *AwsIMDSProcessor) exportValues(tc *tagConfig) {
+	values := make(map[string]string, len(tc.imdsTagsMap))
+	var oldest time.Time
+	for tag := range tc.imdsTagsMap {
+		if e, ok := r.getCached(tag); ok && e.value != "" {
+			values[tag] = e.value
+			if oldest.IsZero() || e.fetched.Before(oldest) {
+				oldest = e.fetched
+			}
+		}
+	}
+
+	exported := make(map[string]interface{}, len(values)+1)
+	for key, value := range r.keyedValues(tc, values) {
+		exported[key] = value
+	}
+	if !oldest.IsZero() {
+		exported[exportFetchTimeKey] = oldest.Unix()
+	}
+
+	b, err := json.Marshal(exported)
+	if err != nil {
+		r.Log.Errorf("Error when encoding exported metadata: %v", err)
+		return
+	}
+
+	r.exportMu.Lock()
+	defer r.exportMu.Unlock()
+	if err := writeFileAtomic(r.ExportFile, b, r.exportFileMode); err != nil {
+		r.Log.Errorf("Error when writing export file: %v", err)
+		return
+	}
+	r.exported = time.Now()
+}
+
+// exportPeriodically rewrites export_file every export_interval, fetching
+// expired values again, so readers can rely on the file being current even
+// while no metrics are processed.
+func (r *AwsIMDSProcessor) exportPeriodically(ctx context.Context) {
+	ticker := time.NewTicker(time.Duration(r.ExportInterval))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case tick := <-ticker.C:
+			tc := r.loadTags()
+			r.resolveTags(ctx, tc, tc.imdsTagsMap, false)
+			// Skip writing again if refreshed values were just exported.
+			r.exportMu.Lock()
+			exported := r.exported
+			r.exportMu.Unlock()
+			if exported.Before(tick) {
+				r.exportValues(tc)
+			}
+		}
+	}
+}
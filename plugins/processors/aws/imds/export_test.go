@@ -0,0 +1,123 @@
+package aws
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/feature/ec2/imds"
+	"github.com/influxdata/telegraf/config"
+	"github.com/stretchr/testify/require"
+)
+
+// readExport reads the export file and returns its values without the fetch
+// time, which is returned separately.
+func readExport(t *testing.T, path string) (map[string]string, int64) {
+	b, err := os.ReadFile(path)
+	require.NoError(t, err)
+
+	var exported map[string]interface{}
+	require.NoError(t, json.Unmarshal(b, &exported))
+	fetched, ok := exported[exportFetchTimeKey].(float64)
+	require.True(t, ok, "missing fetch time")
+	delete(exported, exportFetchTimeKey)
+
+	values := make(map[string]string, len(exported))
+	for key, value := range exported {
+		values[key] = value.(string)
+	}
+	return values, int64(fetched)
+}
+
+func TestExportFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metadata.json")
+	client := &mockIMDSClient{
+		document: imds.InstanceIdentityDocument{AccountID: "123456789012", Region: "us-east-1"},
+	}
+	p := newTestProcessor(t, client, "region", "accountId")
+	p.ExportFile = path
+	p.ExportFileMode = "0640"
+	p.MaskTags = []string{"accountId"}
+	require.NoError(t, p.Init())
+
+	p.LookupIMDSTags(newTestMetric())
+
+	values, fetched := readExport(t, path)
+	require.Equal(t, map[string]string{"region": "us-east-1", "accountId": "********9012"}, values)
+	require.InDelta(t, time.Now().Unix(), fetched, 5)
+
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0o640), info.Mode().Perm())
+
+	// The file is rewritten when the cache is refreshed.
+	p.tagCache.Clear()
+	client.document.Region = "eu-west-1"
+	p.LookupIMDSTags(newTestMetric())
+
+	values, _ = readExport(t, path)
+	require.Equal(t, map[string]string{"region": "eu-west-1", "accountId": "********9012"}, values)
+}
+
+func TestExportInterval(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metadata.json")
+	client := &mockIMDSClient{document: imds.InstanceIdentityDocument{Region: "us-east-1"}}
+	p := newTestProcessor(t, client, "region")
+	p.ExportFile = path
+	p.ExportInterval = config.Duration(10 * time.Millisecond)
+	require.NoError(t, p.Init())
+
+	// Values are fetched and exported without any metrics being processed.
+	ctx, cancel := context.WithCancel(context.Background())
+	p.startWorker(ctx, p.exportPeriodically)
+	defer func() {
+		cancel()
+		p.workers.Wait()
+	}()
+
+	require.Eventually(t, func() bool {
+		_, err := os.Stat(path)
+		return err == nil
+	}, time.Second, 10*time.Millisecond)
+	values, _ := readExport(t, path)
+	require.Equal(t, map[string]string{"region": "us-east-1"}, values)
+
+	// The file is rewritten periodically, even if nothing changed.
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		updated, err := os.Stat(path)
+		return err == nil && updated.ModTime().After(info.ModTime())
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestExportIntervalInvalid(t *testing.T) {
+	client := &mockIMDSClient{}
+	p := newTestProcessor(t, client, "region")
+	p.ExportInterval = config.Duration(time.Minute)
+	require.Error(t, p.Init())
+}
+
+func TestExportFileWriteError(t *testing.T) {
+	client := &mockIMDSClient{document: imds.InstanceIdentityDocument{Region: "us-east-1"}}
+	p := newTestProcessor(t, client, "region")
+	p.ExportFile = filepath.Join(t.TempDir(), "missing", "metadata.json")
+	require.NoError(t, p.Init())
+
+	m := p.LookupIMDSTags(newTestMetric())
+	require.Equal(t, map[string]string{"region": "us-east-1"}, m.Tags())
+}
+
+func TestParseFileMode(t *testing.T) {
+	mode, err := parseFileMode("0644")
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0o644), mode)
+
+	for _, invalid := range []string{"", "rw-r--r--", "0999", "1777"} {
+		_, err := parseFileMode(invalid)
+		require.Error(t, err, invalid)
+	}
+}
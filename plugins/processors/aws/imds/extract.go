@@ -0,0 +1,69 @@
+package aws
+
+import (
+	"fmt"
+	"regexp"
+	"sync"
+)
+
+// Extraction adds the named capture groups of a regular expression matched
+// against the value of a metadata tag as tags.
+type Extraction struct {
+	Source  string `toml:"source"`
+	Pattern string `toml:"pattern"`
+}
+
+// extractor is a compiled Extraction. Results are memoized per source value,
+// so extraction runs once per value fetched from IMDS.
+type extractor struct {
+	source  string
+	re      *regexp.Regexp
+	results sync.Map
+}
+
+func (r *AwsIMDSProcessor) initExtractors(tc *tagConfig) error {
+	r.extractors = make([]*extractor, 0, len(r.Extract))
+	for _, e := range r.Extract {
+		if _, ok := tc.imdsTagsMap[e.Source]; !ok {
+			return fmt.Errorf("extract source not in imds_tags: %s", e.Source)
+		}
+		_, pseudonymized := r.pseudonymizeTagsMap[e.Source]
+		_, masked := r.maskTagsMap[e.Source]
+		if pseudonymized || masked {
+			return fmt.Errorf("extract source is pseudonymized or masked: %s", e.Source)
+		}
+		re, err := regexp.Compile(e.Pattern)
+		if err != nil {
+			return fmt.Errorf("invalid extract pattern for %s: %w", e.Source, err)
+		}
+		named := false
+		for _, name := range re.SubexpNames() {
+			named = named || name != ""
+		}
+		if !named {
+			return fmt.Errorf("extract pattern for %s has no named capture groups", e.Source)
+		}
+		r.extractors = append(r.extractors, &extractor{source: e.Source, re: re})
+	}
+	return nil
+}
+
+// extract returns the non-empty named groups of the match against value,
+// or nil if the value doesn't match.
+func (e *extractor) extract(value string) map[string]string {
+	if groups, ok := e.results.Load(value); ok {
+		return groups.(map[string]string)
+	}
+
+	var groups map[string]string
+	if match := e.re.FindStringSubmatch(value); match != nil {
+		groups = make(map[string]string)
+		for i, name := range e.re.SubexpNames() {
+			if name != "" && match[i] != "" {
+				groups[name] = match[i]
+			}
+		}
+	}
+	e.results.Store(value, groups)
+	return groups
+}
@@ -0,0 +1,56 @@
+package aws
+
+import (
+	"testing"
+	"time"
+
+	"github.com/influxdata/telegraf/metric"
+	"github.com/influxdata/telegraf/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExtract(t *testing.T) {
+	p := newAwsIMDSProcessor()
+	p.Log = &testutil.Logger{}
+	p.ImdsTags = []string{"availabilityZone", "instanceType"}
+	p.Extract = []Extraction{
+		{Source: "availabilityZone", Pattern: `^(?P<geo>[a-z]+)-(?P<direction>[a-z]+)-\d+(?P<zone>[a-z])$`},
+		{Source: "instanceType", Pattern: `^(?P<family>[a-z]+)(?P<generation>\d+)(?P<attributes>[a-z]*)\.`},
+	}
+	require.NoError(t, p.Init())
+
+	m := metric.New("m", map[string]string{}, map[string]interface{}{"v": 1}, time.Unix(0, 0))
+	p.addTags(p.loadTags(), m, map[string]string{"availabilityZone": "us-east-1a", "instanceType": "m5.large"})
+	require.Equal(t, map[string]string{
+		"availabilityZone": "us-east-1a",
+		"instanceType":     "m5.large",
+		"geo":              "us",
+		"direction":        "east",
+		"zone":             "a",
+		"family":           "m",
+		"generation":       "5",
+	}, m.Tags())
+
+	// Non-matching values add nothing and are memoized as well.
+	m = metric.New("m", map[string]string{}, map[string]interface{}{"v": 1}, time.Unix(0, 0))
+	p.addTags(p.loadTags(), m, map[string]string{"availabilityZone": "local"})
+	require.Equal(t, map[string]string{"availabilityZone": "local"}, m.Tags())
+	_, ok := p.extractors[0].results.Load("local")
+	require.True(t, ok)
+}
+
+func TestExtractInvalid(t *testing.T) {
+	for name, e := range map[string]Extraction{
+		"invalid regexp": {Source: "region", Pattern: `(?P<a>`},
+		"no named group": {Source: "region", Pattern: `^(us)-`},
+		"unknown source": {Source: "accountId", Pattern: `(?P<a>.*)`},
+	} {
+		t.Run(name, func(t *testing.T) {
+			p := newAwsIMDSProcessor()
+			p.Log = &testutil.Logger{}
+			p.ImdsTags = []string{"region"}
+			p.Extract = []Extraction{e}
+			require.Error(t, p.Init())
+		})
+	}
+}
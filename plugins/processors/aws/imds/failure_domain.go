@@ -0,0 +1,96 @@
+package aws
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+
+	"github.com/aws/aws-sdk-go-v2/feature/ec2/imds"
+)
+
+// failureDomainTag combines the availability zone, placement group and
+// partition into a single topology key.
+const failureDomainTag = "failureDomain"
+
+// failureDomainPaths are the meta-data paths of the placement values other
+// than the availability zone, which the identity document provides.
+var failureDomainPaths = map[string]string{
+	"availabilityZone": "placement/availability-zone",
+	"placementGroup":   "placement/group-name",
+	"partition":        "placement/partition-number",
+}
+
+var placeholderPattern = regexp.MustCompile(`\{([^{}]*)\}`)
+
+// domainFormat is a parsed failure_domain_format. seps[i] is the text
+// preceding fields[i]; text between placeholders only separates values that
+// are present.
+type domainFormat struct {
+	fields []string
+	seps   []string
+	trail  string
+}
+
+func parseDomainFormat(format string) (*domainFormat, error) {
+	f := &domainFormat{}
+	last := 0
+	for _, m := range placeholderPattern.FindAllStringSubmatchIndex(format, -1) {
+		field := format[m[2]:m[3]]
+		if _, ok := failureDomainPaths[field]; !ok {
+			return nil, fmt.Errorf("unknown placeholder {%s}", field)
+		}
+		f.seps = append(f.seps, format[last:m[0]])
+		f.fields = append(f.fields, field)
+		last = m[1]
+	}
+	if len(f.fields) == 0 {
+		return nil, fmt.Errorf("no placeholder in %q", format)
+	}
+	f.trail = format[last:]
+	return f, nil
+}
+
+// render formats the present values. It returns an empty string if none is.
+func (f *domainFormat) render(values map[string]string) string {
+	var out string
+	var written bool
+	for i, field := range f.fields {
+		v := values[field]
+		if v == "" {
+			continue
+		}
+		if written {
+			out += f.seps[i]
+		}
+		out += v
+		written = true
+	}
+	if !written {
+		return ""
+	}
+	return f.seps[0] + out + f.trail
+}
+
+// resolveFailureDomain formats the placement values of the instance with
+// failure_domain_format. Placement values the instance doesn't have, e.g.
+// outside of a placement group, are left out.
+func (r *AwsIMDSProcessor) resolveFailureDomain(
+	ctx context.Context,
+	document *imds.GetInstanceIdentityDocumentOutput,
+) (string, error) {
+	values := make(map[string]string, len(r.failureDomain.fields))
+	for _, field := range r.failureDomain.fields {
+		if field == "availabilityZone" && document != nil && document.AvailabilityZone != "" {
+			values[field] = document.AvailabilityZone
+			continue
+		}
+		v, err := r.getMetadata(ctx, failureDomainPaths[field])
+		if isNotFound(err) {
+			continue
+		} else if err != nil {
+			return "", fmt.Errorf("getting %s: %w", field, err)
+		}
+		values[field] = v
+	}
+	return r.failureDomain.render(values), nil
+}
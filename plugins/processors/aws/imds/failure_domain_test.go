@@ -0,0 +1,73 @@
+package aws
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/feature/ec2/imds"
+	"github.com/influxdata/telegraf/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFailureDomain(t *testing.T) {
+	tests := []struct {
+		name     string
+		format   string
+		metadata map[string]string
+		expected string
+	}{
+		{
+			name: "partition placement group",
+			metadata: map[string]string{
+				"placement/group-name":       "pg-1",
+				"placement/partition-number": "3",
+			},
+			expected: "us-east-1a/pg-1/3",
+		},
+		{
+			name:     "cluster placement group",
+			metadata: map[string]string{"placement/group-name": "pg-1"},
+			expected: "us-east-1a/pg-1",
+		},
+		{
+			name:     "no placement group",
+			expected: "us-east-1a",
+		},
+		{
+			name:     "custom format",
+			format:   "zone={availabilityZone},partition={partition};",
+			metadata: map[string]string{"placement/partition-number": "3"},
+			expected: "zone=us-east-1a,partition=3;",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &mockIMDSClient{
+				document: imds.InstanceIdentityDocument{AvailabilityZone: "us-east-1a"},
+				metadata: tt.metadata,
+			}
+			p := newAwsIMDSProcessor()
+			p.Log = &testutil.Logger{}
+			p.ImdsTags = []string{"failureDomain"}
+			if tt.format != "" {
+				p.FailureDomainFormat = tt.format
+			}
+			require.NoError(t, p.Init())
+			p.tagCache = newTagCache(p.TagCacheSize)
+			p.imdsClient = client
+
+			m := p.LookupIMDSTags(newTestMetric())
+			require.Equal(t, map[string]string{"failureDomain": tt.expected}, m.Tags())
+		})
+	}
+}
+
+func TestFailureDomainFormatInvalid(t *testing.T) {
+	for _, format := range []string{"", "zone", "{az}/{placementGroup}"} {
+		p := newAwsIMDSProcessor()
+		p.Log = &testutil.Logger{}
+		p.ImdsTags = []string{"failureDomain"}
+		p.FailureDomainFormat = format
+		require.Error(t, p.Init(), format)
+	}
+}
@@ -0,0 +1,84 @@
+package aws
+
+import (
+	"encoding/json"
+	"hash/fnv"
+	"strconv"
+)
+
+// configFingerprint returns a hash of the options determining the values
+// cached for tags other than those taken verbatim from the identity
+// document: which paths are fetched and how responses, regions and
+// composite tags are derived. Renames, value maps, extractions and other
+// transformations are applied when adding the values to metrics, so they
+// don't affect the cache.
+func (r *AwsIMDSProcessor) configFingerprint() string {
+	b, err := json.Marshal(struct {
+		MetadataPaths              map[string]string
+		DynamicPaths               map[string]string
+		MetadataPathList           []string
+		PathKeyStrategy            string
+		PathKeySeparator           string
+		JSONQuery                  map[string]string
+		InstanceTagKeySanitization string
+		RawExtraFields             bool
+		BillingProductTags         map[string]string
+		RegionSources              []string
+		RegionNames                map[string]string
+		FailureDomainFormat        string
+	}{
+		r.MetadataPaths,
+		r.DynamicPaths,
+		r.MetadataPathList,
+		r.PathKeyStrategy,
+		r.PathKeySeparator,
+		r.JSONQuery,
+		r.InstanceTagKeySanitization,
+		r.RawExtraFields,
+		r.BillingProductTags,
+		r.RegionSources,
+		r.RegionNames,
+		r.FailureDomainFormat,
+	})
+	if err != nil {
+		// Unreachable for these types; never match an earlier fingerprint.
+		return ""
+	}
+	h := fnv.New64a()
+	h.Write(b)
+	return strconv.FormatUint(h.Sum64(), 16)
+}
+
+// derivedTag reports whether the cached value of the tag depends on the
+// options of configFingerprint rather than being taken verbatim from the
+// identity document.
+func (r *AwsIMDSProcessor) derivedTag(tc *tagConfig, tag string) bool {
+	if tag == documentCacheKey {
+		return false
+	}
+	if _, ok := tc.pathTags[tag]; ok {
+		return true
+	}
+	if _, ok := computedTags[tag]; ok {
+		return true
+	}
+	return isRegionTag(tag) || r.billingProductTag(tag)
+}
+
+// invalidateDerived removes the cached values of derived tags, keeping the
+// values taken from the identity document.
+func (r *AwsIMDSProcessor) invalidateDerived() int {
+	tc := r.loadTags()
+	var keys [][]byte
+	it := r.tagCache.NewIterator()
+	for entry := it.Next(); entry != nil; entry = it.Next() {
+		if r.derivedTag(tc, string(entry.Key)) {
+			keys = append(keys, entry.Key)
+		}
+	}
+	for _, key := range keys {
+		r.tagCache.Del(key)
+		r.cacheIndex.remove(string(key))
+	}
+	return len(keys)
+}
@@ -0,0 +1,50 @@
+package aws
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/feature/ec2/imds"
+	"github.com/influxdata/telegraf/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConfigChangeInvalidatesDerived(t *testing.T) {
+	client := &mockIMDSClient{
+		document: imds.InstanceIdentityDocument{InstanceID: "i-0123456789abcdef0"},
+		metadata: map[string]string{
+			"placement/group-name":       "pg-1",
+			"placement/partition-number": "3",
+		},
+	}
+	p := newAwsIMDSProcessor()
+	p.Log = &testutil.Logger{}
+	p.ImdsTags = []string{"instanceId"}
+	p.MetadataPaths = map[string]string{"placement": "placement/group-name"}
+	p.FlushCacheOnStart = false
+	require.NoError(t, p.Init())
+	p.initCache()
+	p.imdsClient = client
+
+	m := p.LookupIMDSTags(newTestMetric())
+	require.Equal(t, map[string]string{"instanceId": "i-0123456789abcdef0", "placement": "pg-1"}, m.Tags())
+	require.EqualValues(t, 2, client.calls)
+
+	// Renames apply to the cached values right away.
+	p.TagRename = map[string]string{"instanceId": "instance_id"}
+	require.NoError(t, p.Init())
+	p.initCache()
+	m = p.LookupIMDSTags(newTestMetric())
+	require.Equal(t, map[string]string{"instance_id": "i-0123456789abcdef0", "placement": "pg-1"}, m.Tags())
+	require.EqualValues(t, 2, client.calls)
+
+	// Changing the path drops the value fetched from the old one, but keeps
+	// the identity document values.
+	p.MetadataPaths = map[string]string{"placement": "placement/partition-number"}
+	require.NoError(t, p.Init())
+	p.initCache()
+	_, ok := p.getCached("placement")
+	require.False(t, ok)
+	m = p.LookupIMDSTags(newTestMetric())
+	require.Equal(t, map[string]string{"instance_id": "i-0123456789abcdef0", "placement": "3"}, m.Tags())
+	require.EqualValues(t, 3, client.calls)
+}
@@ -0,0 +1,44 @@
+package aws
+
+import "sync"
+
+// flight is a request in progress whose result is shared by all callers.
+type flight struct {
+	wg  sync.WaitGroup
+	val interface{}
+	err error
+}
+
+// flightGroup deduplicates concurrent IMDS requests, e.g. of all parallel
+// workers missing the cache at startup, so they share a single request.
+// The zero value is ready to use.
+type flightGroup struct {
+	mu      sync.Mutex
+	flights map[string]*flight
+}
+
+// do calls fn unless a call for the same key is in progress, in which case
+// it waits for that call and returns its result.
+func (g *flightGroup) do(key string, fn func() (interface{}, error)) (interface{}, error) {
+	g.mu.Lock()
+	if f, ok := g.flights[key]; ok {
+		g.mu.Unlock()
+		f.wg.Wait()
+		return f.val, f.err
+	}
+	if g.flights == nil {
+		g.flights = make(map[string]*flight)
+	}
+	f := &flight{}
+	f.wg.Add(1)
+	g.flights[key] = f
+	g.mu.Unlock()
+
+	f.val, f.err = fn()
+	f.wg.Done()
+
+	g.mu.Lock()
+	delete(g.flights, key)
+	g.mu.Unlock()
+	return f.val, f.err
+}
@@ -0,0 +1,61 @@
+package aws
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/feature/ec2/imds"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConcurrentMissesShareRequest(t *testing.T) {
+	client := &mockIMDSClient{
+		document: imds.InstanceIdentityDocument{Region: "us-east-1"},
+		metadata: map[string]string{"hostname": "ip-10-0-0-1.ec2.internal"},
+		delay:    50 * time.Millisecond,
+	}
+	p := newTestProcessor(t, client, "region")
+
+	const workers = 10
+	start := make(chan struct{})
+	var wg sync.WaitGroup
+	tags := make([]map[string]string, workers)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			<-start
+			tags[i] = p.LookupIMDSTags(newTestMetric()).Tags()
+		}(i)
+	}
+	close(start)
+	wg.Wait()
+
+	for _, tt := range tags {
+		require.Equal(t, map[string]string{"region": "us-east-1"}, tt)
+	}
+	require.EqualValues(t, 1, client.calls)
+
+	// Misses of the same path share a request, too.
+	client.calls = 0
+	values := make([]string, workers)
+	start = make(chan struct{})
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			<-start
+			v, err := p.getMetadata(p.startCtx, "hostname")
+			require.NoError(t, err)
+			values[i] = v
+		}(i)
+	}
+	close(start)
+	wg.Wait()
+
+	for _, v := range values {
+		require.Equal(t, "ip-10-0-0-1.ec2.internal", v)
+	}
+	require.EqualValues(t, 1, client.calls)
+}
@@ -0,0 +1,57 @@
+package aws
+
+import (
+	"fmt"
+	"regexp"
+	"sync"
+)
+
+// gate decides whether a resolved value is added, based on the when_matches
+// and unless_matches patterns of the tag. Decisions are memoized per value.
+type gate struct {
+	when    *regexp.Regexp
+	unless  *regexp.Regexp
+	results sync.Map
+}
+
+func (r *AwsIMDSProcessor) initGates(tc *tagConfig) error {
+	r.gates = make(map[string]*gate)
+	for _, patterns := range []struct {
+		option string
+		tags   map[string]string
+		set    func(g *gate, re *regexp.Regexp)
+	}{
+		{"when_matches", r.WhenMatches, func(g *gate, re *regexp.Regexp) { g.when = re }},
+		{"unless_matches", r.UnlessMatches, func(g *gate, re *regexp.Regexp) { g.unless = re }},
+	} {
+		for tag, pattern := range patterns.tags {
+			if _, ok := tc.imdsTagsMap[tag]; !ok {
+				return fmt.Errorf("%s specified for tag not in imds_tags: %s", patterns.option, tag)
+			}
+			re, err := regexp.Compile(pattern)
+			if err != nil {
+				return fmt.Errorf("invalid %s pattern for %s: %w", patterns.option, tag, err)
+			}
+			g, ok := r.gates[tag]
+			if !ok {
+				g = &gate{}
+				r.gates[tag] = g
+			}
+			patterns.set(g, re)
+		}
+	}
+	return nil
+}
+
+// allows reports whether value matches when_matches, if set, and doesn't
+// match unless_matches, if set.
+func (g *gate) allows(value string) bool {
+	if allowed, ok := g.results.Load(value); ok {
+		return allowed.(bool)
+	}
+
+	allowed := (g.when == nil || g.when.MatchString(value)) &&
+		(g.unless == nil || !g.unless.MatchString(value))
+	g.results.Store(value, allowed)
+	return allowed
+}
@@ -0,0 +1,67 @@
+package aws
+
+import (
+	"testing"
+	"time"
+
+	"github.com/influxdata/telegraf/metric"
+	"github.com/influxdata/telegraf/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWhenUnlessMatches(t *testing.T) {
+	p := newAwsIMDSProcessor()
+	p.Log = &testutil.Logger{}
+	p.ImdsTags = []string{"imageId", "instanceType"}
+	p.WhenMatches = map[string]string{"imageId": `^ami-`, "instanceType": `^[a-z]`}
+	p.UnlessMatches = map[string]string{"instanceType": `\.metal$`}
+	require.NoError(t, p.Init())
+
+	tests := []struct {
+		name     string
+		values   map[string]string
+		expected map[string]string
+	}{
+		{
+			name:     "allowed",
+			values:   map[string]string{"imageId": "ami-0123", "instanceType": "m5.large"},
+			expected: map[string]string{"imageId": "ami-0123", "instanceType": "m5.large"},
+		},
+		{
+			name:     "when_matches fails",
+			values:   map[string]string{"imageId": "aki-0123", "instanceType": "m5.large"},
+			expected: map[string]string{"instanceType": "m5.large"},
+		},
+		{
+			name:     "unless_matches matches",
+			values:   map[string]string{"imageId": "ami-0123", "instanceType": "m5.metal"},
+			expected: map[string]string{"imageId": "ami-0123"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := metric.New("m", map[string]string{}, map[string]interface{}{"v": 1}, time.Unix(0, 0))
+			p.addTags(p.loadTags(), m, tt.values)
+			require.Equal(t, tt.expected, m.Tags())
+		})
+	}
+
+	allowed, ok := p.gates["instanceType"].results.Load("m5.metal")
+	require.True(t, ok)
+	require.Equal(t, false, allowed)
+}
+
+func TestWhenMatchesInvalid(t *testing.T) {
+	p := newAwsIMDSProcessor()
+	p.Log = &testutil.Logger{}
+	p.ImdsTags = []string{"region"}
+	p.WhenMatches = map[string]string{"region": `(`}
+	require.Error(t, p.Init())
+
+	p = newAwsIMDSProcessor()
+	p.Log = &testutil.Logger{}
+	p.ImdsTags = []string{"region"}
+	p.UnlessMatches = map[string]string{"accountId": `^1`}
+	require.Error(t, p.Init())
+}
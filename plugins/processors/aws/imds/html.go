@@ -0,0 +1,39 @@
+package aws
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// errHTMLResponse is the error of lookups answered with an HTML page, as
+// returned by proxies or captive portals intercepting requests to IMDS.
+var errHTMLResponse = errors.New("IMDS returned an HTML page")
+
+// htmlMarkers are prefixes of HTML and XML error bodies. IMDS only returns
+// plain text and JSON.
+var htmlMarkers = []string{"<!doctype", "<html", "<head", "<body", "<?xml"}
+
+// looksLikeHTML reports whether the value is an HTML or XML document rather
+// than a metadata value.
+func looksLikeHTML(value string) bool {
+	v := strings.ToLower(strings.TrimSpace(value))
+	for _, marker := range htmlMarkers {
+		if strings.HasPrefix(v, marker) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkContent fails the lookup of the path if IMDS answered with an HTML
+// page. The first such response is logged.
+func (r *AwsIMDSProcessor) checkContent(path, content string) error {
+	if !looksLikeHTML(content) {
+		return nil
+	}
+	if r.htmlLogged.CompareAndSwap(false, true) {
+		r.Log.Warnf("IMDS returned an HTML page for %q, is a proxy intercepting requests to IMDS?", path)
+	}
+	return fmt.Errorf("%w for %s", errHTMLResponse, path)
+}
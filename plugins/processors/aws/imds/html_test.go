@@ -0,0 +1,55 @@
+package aws
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/feature/ec2/imds"
+	"github.com/influxdata/telegraf/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLooksLikeHTML(t *testing.T) {
+	tests := []struct {
+		value    string
+		expected bool
+	}{
+		{"<!DOCTYPE html><html><body>Access denied</body></html>", true},
+		{"\n  <html>\n<head><title>502 Bad Gateway</title></head>", true},
+		{"<?xml version=\"1.0\"?><Error/>", true},
+		{"<BODY>blocked</BODY>", true},
+		{"i-0123456789abcdef0", false},
+		{"10.0.0.1", false},
+		{"{\"Code\": \"Success\"}", false},
+		{"", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			require.Equal(t, tt.expected, looksLikeHTML(tt.value))
+		})
+	}
+}
+
+func TestHTMLResponse(t *testing.T) {
+	client := &mockIMDSClient{
+		document: imds.InstanceIdentityDocument{Region: "eu-west-1"},
+		metadata: map[string]string{
+			"public-ipv4": "<html><body><h1>Proxy Authentication Required</h1></body></html>",
+		},
+	}
+	p := newAwsIMDSProcessor()
+	p.Log = &testutil.Logger{}
+	p.ImdsTags = []string{"region"}
+	p.MetadataPaths = map[string]string{"publicIpv4": "public-ipv4"}
+	require.NoError(t, p.Init())
+	p.tagCache = newTagCache(p.TagCacheSize)
+	p.imdsClient = client
+
+	m := p.LookupIMDSTags(newTestMetric())
+	require.Equal(t, map[string]string{"region": "eu-west-1"}, m.Tags())
+	require.True(t, p.htmlLogged.Load())
+
+	// The page isn't cached as the value.
+	_, ok := p.getCached("publicIpv4")
+	require.False(t, ok)
+}
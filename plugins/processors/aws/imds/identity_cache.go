@@ -0,0 +1,226 @@
+package aws
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/feature/ec2/imds"
+)
+
+// documentCacheKey is the tag cache key of the identity document. The
+// leading NUL keeps it apart from the keys of tags.
+const documentCacheKey = "\x00document"
+
+// loadIdentityDocument reads an identity document persisted with
+// saveIdentityDocument.
+func loadIdentityDocument(path string) (*imds.GetInstanceIdentityDocumentOutput, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var doc imds.InstanceIdentityDocument
+	if err := json.Unmarshal(b, &doc); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	if doc.InstanceID == "" {
+		return nil, fmt.Errorf("no instance ID in %s", path)
+	}
+	return &imds.GetInstanceIdentityDocumentOutput{InstanceIdentityDocument: doc}, nil
+}
+
+// writeFileAtomic writes data to a temporary file in the directory of path
+// and renames it into place, so readers never see a partially written file.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Chmod(perm); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// saveIdentityDocument persists the identity document to identity_cache_file.
+func (r *AwsIMDSProcessor) saveIdentityDocument(iido *imds.GetInstanceIdentityDocumentOutput) {
+	b, err := json.Marshal(iido.InstanceIdentityDocument)
+	if err == nil {
+		err = writeFileAtomic(r.IdentityCacheFile, b, 0o600)
+	}
+	if err != nil {
+		r.Log.Errorf("Error when writing identity cache file: %v", err)
+	}
+}
+
+// identityDocumentFetched is called with every identity document fetched
+// from IMDS. If the instance ID differs from the known one, e.g. because a
+// persisted document was baked into an AMI, the cache is flushed. The first
+// document fetched after running on a persisted document replaces it.
+func (r *AwsIMDSProcessor) identityDocumentFetched(iido *imds.GetInstanceIdentityDocumentOutput) {
+	r.identityMu.Lock()
+	defer r.identityMu.Unlock()
+
+	changed := r.instanceID != "" && iido.InstanceID != r.instanceID
+	if changed {
+		r.Log.Errorf("Instance ID changed from %s to %s, flushing cache", r.instanceID, iido.InstanceID)
+		r.clearCache()
+		r.resetEmptyBackoffs()
+		r.resetLastKnown()
+	}
+	r.instanceID = iido.InstanceID
+
+	if r.persistedDocument != nil {
+		r.Log.Info("IMDS is reachable again, no longer using the persisted identity document")
+		r.persistedDocument = nil
+		changed = true
+	}
+	if changed && r.IdentityCacheFile != "" {
+		r.saveIdentityDocument(iido)
+	}
+}
+
+// checkInstanceID periodically compares the known instance ID against the
+// one reported by IMDS.
+func (r *AwsIMDSProcessor) checkInstanceID(ctx context.Context) {
+	ticker := time.NewTicker(time.Duration(r.InstanceIDCheckInterval))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			iido, err := r.getInstanceIdentityDocument(ctx)
+			if err != nil {
+				r.logRoutinef("Instance ID check failed: %v", err)
+				continue
+			}
+			r.identityDocumentFetched(iido)
+		}
+	}
+}
+
+// fallbackIdentityDocument returns the persisted identity document loaded at
+// startup, if IMDS has not been reachable since.
+func (r *AwsIMDSProcessor) fallbackIdentityDocument() *imds.GetInstanceIdentityDocumentOutput {
+	r.identityMu.Lock()
+	defer r.identityMu.Unlock()
+	return r.persistedDocument
+}
+
+// fetchDocument returns the identity document for tags computed from it,
+// falling back to the persisted document. It returns nil if neither is
+// available.
+func (r *AwsIMDSProcessor) fetchDocument(ctx context.Context) *imds.GetInstanceIdentityDocumentOutput {
+	iido, _, err := r.identityDocument(ctx, false)
+	if err != nil {
+		r.Log.Debugf("Error when getting identity document: %v", err)
+		return r.fallbackIdentityDocument()
+	}
+	return iido
+}
+
+// identityDocument returns the identity document along with the time it was
+// fetched. The document is cached as a whole, so all tags taken from it are
+// resolved with a single request however they are looked up. Unless noCache
+// is set, the last fetched document is returned while cache_ttl and
+// max_value_age allow.
+func (r *AwsIMDSProcessor) identityDocument(
+	ctx context.Context,
+	noCache bool,
+) (*imds.GetInstanceIdentityDocumentOutput, time.Time, error) {
+	if noCache {
+		return r.fetchIdentityDocument(ctx)
+	}
+	if iido, fetched := r.cachedDocument(); iido != nil {
+		return iido, fetched, nil
+	}
+	return r.refreshIdentityDocument(ctx)
+}
+
+// fetchedDocument is the shared result of refreshIdentityDocument.
+type fetchedDocument struct {
+	iido    *imds.GetInstanceIdentityDocumentOutput
+	fetched time.Time
+}
+
+// refreshIdentityDocument fetches the identity document after a cache miss.
+// Concurrent callers share a single refresh, which checks the cache again
+// first: callers missing the cache while an earlier refresh completes find
+// the document it cached rather than fetching it once more. No lock is held
+// while waiting for IMDS, so reading cached values never blocks on a
+// request.
+func (r *AwsIMDSProcessor) refreshIdentityDocument(ctx context.Context) (*imds.GetInstanceIdentityDocumentOutput, time.Time, error) {
+	v, err := r.flights.do(documentCacheKey, func() (interface{}, error) {
+		if iido, fetched := r.cachedDocument(); iido != nil {
+			return fetchedDocument{iido: iido, fetched: fetched}, nil
+		}
+		iido, fetched, err := r.fetchIdentityDocument(ctx)
+		return fetchedDocument{iido: iido, fetched: fetched}, err
+	})
+	d, _ := v.(fetchedDocument)
+	return d.iido, d.fetched, err
+}
+
+// fetchIdentityDocument fetches the identity document from IMDS and caches
+// it.
+func (r *AwsIMDSProcessor) fetchIdentityDocument(ctx context.Context) (*imds.GetInstanceIdentityDocumentOutput, time.Time, error) {
+	iido, err := r.getInstanceIdentityDocument(ctx)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	r.identityDocumentFetched(iido)
+	fetched := time.Now()
+	r.cacheDocument(iido, fetched)
+	return iido, fetched, nil
+}
+
+// cacheDocument stores the identity document in the tag cache under
+// documentCacheKey, expiring like values cached according to cache_ttl.
+func (r *AwsIMDSProcessor) cacheDocument(iido *imds.GetInstanceIdentityDocumentOutput, fetched time.Time) {
+	b, err := json.Marshal(iido.InstanceIdentityDocument)
+	if err != nil {
+		r.Log.Errorf("Error when encoding identity document: %v", err)
+		return
+	}
+	e := cacheEntry{value: string(b), fetched: fetched}
+	expiration := int(r.jitteredTTL(r.cacheTTL(documentCacheKey)).Seconds())
+	if err := r.setCacheEntry(documentCacheKey, e, expiration); err != nil {
+		r.Log.Errorf("Error when caching identity document: %v", err)
+	}
+}
+
+// cachedDocument returns the cached identity document and the time it was
+// fetched, or nil if it isn't cached or too old. Unlike tag lookups, it
+// doesn't count towards the cache stats.
+func (r *AwsIMDSProcessor) cachedDocument() (*imds.GetInstanceIdentityDocumentOutput, time.Time) {
+	b, err := r.tagCache.Get([]byte(documentCacheKey))
+	if err != nil {
+		return nil, time.Time{}
+	}
+	e, err := decodeCacheEntry(b)
+	if err != nil || r.tooOld(e) ||
+		(r.DisableCache && time.Since(e.fetched) >= time.Duration(r.NoCacheMinInterval)) {
+		return nil, time.Time{}
+	}
+	var doc imds.InstanceIdentityDocument
+	if err := json.Unmarshal([]byte(e.value), &doc); err != nil {
+		return nil, time.Time{}
+	}
+	return &imds.GetInstanceIdentityDocumentOutput{InstanceIdentityDocument: doc}, e.fetched
+}
@@ -0,0 +1,193 @@
+package aws
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/feature/ec2/imds"
+	"github.com/influxdata/telegraf/config"
+	"github.com/influxdata/telegraf/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIdentityCacheFileWrittenOnStart(t *testing.T) {
+	server := newIMDSServer(t, `{"instanceId": "i-0123456789abcdef0", "region": "eu-west-1"}`)
+	path := filepath.Join(t.TempDir(), "identity.json")
+
+	p := newAwsIMDSProcessor()
+	p.Log = &testutil.Logger{}
+	p.ImdsTags = []string{"region"}
+	p.Endpoint = server.URL
+	p.IdentityCacheFile = path
+	require.NoError(t, p.Init())
+	require.NoError(t, p.Start(&testutil.Accumulator{}))
+	p.Stop()
+
+	iido, err := loadIdentityDocument(path)
+	require.NoError(t, err)
+	require.Equal(t, "i-0123456789abcdef0", iido.InstanceID)
+	require.Equal(t, "eu-west-1", iido.Region)
+}
+
+func TestIdentityCacheFileUsedWhenUnreachable(t *testing.T) {
+	server := newIMDSServer(t, "")
+	path := filepath.Join(t.TempDir(), "identity.json")
+	require.NoError(t, os.WriteFile(path, []byte(`{"instanceId": "i-0123456789abcdef0", "region": "eu-west-1"}`), 0o600))
+
+	p := newAwsIMDSProcessor()
+	p.Log = &testutil.Logger{}
+	p.ImdsTags = []string{"region"}
+	p.Endpoint = server.URL
+	p.Strict = true
+	require.NoError(t, p.Init())
+	require.Error(t, p.Start(&testutil.Accumulator{}))
+
+	p.IdentityCacheFile = path
+	require.NoError(t, p.Start(&testutil.Accumulator{}))
+	defer p.Stop()
+	require.Equal(t, "i-0123456789abcdef0", p.instanceID)
+	require.NotNil(t, p.fallbackIdentityDocument())
+}
+
+func TestIdentityCacheFileRecovery(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "identity.json")
+	persisted := &imds.GetInstanceIdentityDocumentOutput{
+		InstanceIdentityDocument: imds.InstanceIdentityDocument{InstanceID: "i-old", Region: "eu-west-1"},
+	}
+
+	client := &mockIMDSClient{err: errors.New("connection refused")}
+	p := newTestProcessor(t, client, "instanceId", "region")
+	p.IdentityCacheFile = path
+	p.persistedDocument = persisted
+	p.instanceID = "i-old"
+
+	// While IMDS is down the persisted document is served, but not cached.
+	m := p.LookupIMDSTags(newTestMetric())
+	require.Equal(t, map[string]string{"instanceId": "i-old", "region": "eu-west-1"}, m.Tags())
+	_, ok := p.getCached("instanceId")
+	require.False(t, ok)
+
+	// Once IMDS recovers with a different instance, its document wins.
+	client.err = nil
+	client.document = imds.InstanceIdentityDocument{InstanceID: "i-new", Region: "eu-west-1"}
+	m = p.LookupIMDSTags(newTestMetric())
+	require.Equal(t, map[string]string{"instanceId": "i-new", "region": "eu-west-1"}, m.Tags())
+	require.Equal(t, "i-new", p.instanceID)
+	require.Nil(t, p.fallbackIdentityDocument())
+
+	iido, err := loadIdentityDocument(path)
+	require.NoError(t, err)
+	require.Equal(t, "i-new", iido.InstanceID)
+}
+
+func TestInstanceIDCheck(t *testing.T) {
+	client := &mockIMDSClient{
+		document: imds.InstanceIdentityDocument{InstanceID: "i-new"},
+	}
+	p := newTestProcessor(t, client, "instanceId")
+	p.InstanceIDCheckInterval = config.Duration(10 * time.Millisecond)
+	p.instanceID = "i-old"
+	p.setCached("instanceId", "i-old", time.Now())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	p.startWorker(ctx, p.checkInstanceID)
+	defer func() {
+		cancel()
+		p.workers.Wait()
+	}()
+
+	require.Eventually(t, func() bool {
+		p.identityMu.Lock()
+		defer p.identityMu.Unlock()
+		return p.instanceID == "i-new"
+	}, time.Second, 10*time.Millisecond)
+
+	m := p.LookupIMDSTags(newTestMetric())
+	require.Equal(t, map[string]string{"instanceId": "i-new"}, m.Tags())
+}
+
+func TestIdentityDocumentCachedOnce(t *testing.T) {
+	client := &mockIMDSClient{
+		document: imds.InstanceIdentityDocument{
+			AccountID:        "123456789012",
+			AvailabilityZone: "us-east-1a",
+			InstanceID:       "i-0123456789abcdef0",
+			InstanceType:     "m5.large",
+			Region:           "us-east-1",
+		},
+	}
+	p := newTestProcessor(t, client, "accountId", "availabilityZone", "instanceId", "instanceType", "region")
+
+	// The tags are resolved one by one, all from the same document.
+	for _, tag := range []string{"accountId", "availabilityZone", "instanceId", "instanceType", "region"} {
+		values, failed := p.resolveTags(context.Background(), p.loadTags(), map[string]struct{}{tag: {}}, false)
+		require.Empty(t, failed)
+		require.NotEmpty(t, values[tag].value)
+	}
+	require.EqualValues(t, 1, client.calls)
+
+	m := p.LookupIMDSTags(newTestMetric())
+	require.Len(t, m.Tags(), 5)
+	require.EqualValues(t, 1, client.calls)
+
+	// Bypassing the cache fetches the document again.
+	_, failed := p.resolveTags(context.Background(), p.loadTags(), map[string]struct{}{"region": {}}, true)
+	require.Empty(t, failed)
+	require.EqualValues(t, 2, client.calls)
+}
+
+func TestIdentityDocumentRefreshRechecksCache(t *testing.T) {
+	client := &mockIMDSClient{
+		document: imds.InstanceIdentityDocument{InstanceID: "i-0123456789abcdef0"},
+	}
+	p := newTestProcessor(t, client, "instanceId")
+
+	// A caller missing the cache just before another refresh completed
+	// finds the document it cached.
+	p.cacheDocument(&imds.GetInstanceIdentityDocumentOutput{InstanceIdentityDocument: client.document}, time.Now())
+	iido, _, err := p.refreshIdentityDocument(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, "i-0123456789abcdef0", iido.InstanceID)
+	require.EqualValues(t, 0, client.calls)
+}
+
+func TestIdentityDocumentSlowClient(t *testing.T) {
+	const delay = 200 * time.Millisecond
+	client := &mockIMDSClient{
+		document: imds.InstanceIdentityDocument{AccountID: "123456789012", Region: "us-east-1"},
+		delay:    delay,
+	}
+	p := newTestProcessor(t, client, "accountId", "region")
+	p.setCached("region", "us-east-1", time.Now())
+
+	// Workers missing the cache share a single request.
+	var wg sync.WaitGroup
+	var failures int32
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, failed := p.resolveTags(context.Background(), p.loadTags(), map[string]struct{}{"accountId": {}}, false); len(failed) > 0 {
+				atomic.AddInt32(&failures, 1)
+			}
+		}()
+	}
+
+	// Cached values are read without waiting for the request.
+	time.Sleep(delay / 4)
+	start := time.Now()
+	values, failed := p.resolveTags(context.Background(), p.loadTags(), map[string]struct{}{"region": {}}, false)
+	require.Less(t, time.Since(start), delay/2)
+	require.Empty(t, failed)
+	require.Equal(t, "us-east-1", values["region"].value)
+
+	wg.Wait()
+	require.Zero(t, failures)
+	require.EqualValues(t, 1, client.calls)
+}
@@ -0,0 +1,251 @@
+package aws
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/influxdata/telegraf/filter"
+)
+
+// instanceTagsPath is the meta-data path listing the instance's tags if
+// access to tags in instance metadata is enabled.
+const instanceTagsPath = "tags/instance"
+
+// initInstanceTags adds a path tag for each key in instance_tags. If the
+// list contains "*", the keys are instead listed in Start and filtered by
+// instance_tags_include and instance_tags_exclude.
+func (r *AwsIMDSProcessor) initInstanceTags(tc *tagConfig) error {
+	if len(r.InstanceTags) == 0 {
+		if len(r.InstanceTagsInclude) > 0 || len(r.InstanceTagsExclude) > 0 {
+			return errors.New(`instance_tags_include and instance_tags_exclude require instance_tags = ["*"]`)
+		}
+		if r.InstanceTagsRescanInterval != 0 {
+			return errors.New(`instance_tags_rescan_interval requires instance_tags = ["*"]`)
+		}
+		return nil
+	}
+
+	if r.InstanceTagsTTL < 0 {
+		return fmt.Errorf("invalid instance_tags_ttl: %s", time.Duration(r.InstanceTagsTTL))
+	}
+
+	switch r.ConflictPolicy {
+	case "identity_wins", "instance_tag_wins", "suffix_instance_tag":
+	default:
+		return fmt.Errorf("invalid conflict_policy: %s", r.ConflictPolicy)
+	}
+	tc.shadowed = make(map[string]string)
+	tc.conflicts = make(map[string]string)
+
+	switch r.InstanceTagKeySanitization {
+	case "underscore":
+		r.sanitizeInstanceTagKey = underscoreKey
+	case "percent":
+		r.sanitizeInstanceTagKey = percentEncodeKey
+	default:
+		return fmt.Errorf("invalid instance_tag_key_sanitization: %s", r.InstanceTagKeySanitization)
+	}
+
+	for _, key := range r.InstanceTags {
+		if key == "*" {
+			r.collectAllInstanceTags = true
+		} else if key == "" || strings.Contains(key, "/") {
+			return fmt.Errorf("invalid key in instance_tags: %q", key)
+		}
+	}
+
+	if r.InstanceTagsRescanInterval < 0 {
+		return fmt.Errorf("invalid instance_tags_rescan_interval: %s", time.Duration(r.InstanceTagsRescanInterval))
+	}
+	if !r.collectAllInstanceTags {
+		if len(r.InstanceTagsInclude) > 0 || len(r.InstanceTagsExclude) > 0 {
+			return errors.New(`instance_tags_include and instance_tags_exclude require instance_tags = ["*"]`)
+		}
+		if r.InstanceTagsRescanInterval != 0 {
+			return errors.New(`instance_tags_rescan_interval requires instance_tags = ["*"]`)
+		}
+		r.addInstanceTags(tc, r.InstanceTags)
+		return nil
+	}
+
+	f, err := filter.NewIncludeExcludeFilter(r.InstanceTagsInclude, r.InstanceTagsExclude)
+	if err != nil {
+		return fmt.Errorf("invalid instance tag filter: %w", err)
+	}
+	r.instanceTagFilter = f
+
+	var collisions []string
+	for tag := range tc.imdsTagsMap {
+		if _, ok := tc.pathTags[tag]; !ok && f.Match(tag) {
+			collisions = append(collisions, tag)
+		}
+	}
+	if len(collisions) > 0 {
+		sort.Strings(collisions)
+		r.Log.Warnf("Instance tags may collide with %s, resolving with conflict_policy %q",
+			strings.Join(collisions, ", "), r.ConflictPolicy)
+	}
+	return nil
+}
+
+// addInstanceTags adds a path tag for each instance tag key and returns the
+// names of the tags added. Tags are named after the sanitized key, made
+// unique against all other tags in sorted key order. Keys colliding with
+// identity document or meta-data tags are resolved by conflict_policy.
+func (r *AwsIMDSProcessor) addInstanceTags(tc *tagConfig, keys []string) []string {
+	used := make(map[string]bool, len(allowedImdsTags)+len(tc.pathTags))
+	for tag := range allowedImdsTags {
+		used[tag] = true
+	}
+	for tag := range tc.pathTags {
+		used[tag] = true
+	}
+	reserved := make(map[string]bool, len(used))
+	for tag := range used {
+		reserved[tag] = true
+	}
+
+	keys = append([]string(nil), keys...)
+	sort.Strings(keys)
+	var added, collisions []string
+	for i, key := range keys {
+		if i > 0 && key == keys[i-1] {
+			continue
+		}
+		name := r.sanitizeInstanceTagKey(key)
+		tag := uniqueKey(name, used)
+		if reserved[name] {
+			switch r.ConflictPolicy {
+			case "suffix_instance_tag":
+				tag = uniqueKey(name+"_tag", used)
+			case "identity_wins":
+				tc.conflicts[tag] = name
+				tc.shadowed[tag] = name
+			case "instance_tag_wins":
+				tc.conflicts[tag] = name
+				tc.shadowed[name] = tag
+			}
+			if _, ok := tc.imdsTagsMap[name]; ok {
+				collisions = append(collisions, key)
+			}
+		}
+		used[tag] = true
+		tc.pathTags[tag] = metadataTag{path: instanceTagsPath + "/" + key, instanceTag: true}
+		tc.imdsTagsMap[tag] = struct{}{}
+		added = append(added, tag)
+	}
+
+	if len(collisions) > 0 {
+		r.Log.Warnf("Instance tags %s collide with other tags, resolving with conflict_policy %q",
+			strings.Join(collisions, ", "), r.ConflictPolicy)
+	}
+	return added
+}
+
+// discoverInstanceTags lists the instance's tags and adds those passing the
+// filter and not known yet. Tags excluded by the filter are never looked up.
+// Tags added to the instance later are picked up by the next rescan, if
+// instance_tags_rescan_interval is set, or on restart. Discovered tags are
+// optional, so tags removed from the instance are no longer added once their
+// cached values expire, rather than failing. It returns the keys added.
+//
+// The tags are added to a copy of the tag configuration, published once
+// complete, so metrics being enriched keep the configuration they started
+// with. Discovery runs at startup and then from the rescan worker only, so
+// copies aren't published concurrently.
+func (r *AwsIMDSProcessor) discoverInstanceTags(ctx context.Context) []string {
+	content, err := r.getMetadata(ctx, instanceTagsPath)
+	if err != nil {
+		r.Log.Errorf("Error when listing instance tags: %v", err)
+		return nil
+	}
+
+	tc := r.loadTags().clone()
+	known := make(map[string]bool, len(tc.pathTags))
+	for _, mt := range tc.pathTags {
+		if mt.instanceTag {
+			known[strings.TrimPrefix(mt.path, instanceTagsPath+"/")] = true
+		}
+	}
+	var keys []string
+	for _, key := range strings.Split(content, "\n") {
+		key = strings.TrimSpace(key)
+		if key != "" && !strings.Contains(key, "/") && !known[key] && r.instanceTagFilter.Match(key) {
+			keys = append(keys, key)
+		}
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+
+	for _, tag := range r.addInstanceTags(tc, keys) {
+		mt := tc.pathTags[tag]
+		mt.optional = true
+		tc.pathTags[tag] = mt
+		tc.defaultTags[tag] = struct{}{}
+		tc.lookupTags[tag] = struct{}{}
+	}
+	if err := r.buildTagKeys(tc); err != nil {
+		r.Log.Errorf("Error when adding instance tags: %v", err)
+		return nil
+	}
+	r.tags.Store(tc)
+	return keys
+}
+
+// rescanInstanceTags periodically discovers instance tags added since
+// startup.
+func (r *AwsIMDSProcessor) rescanInstanceTags(ctx context.Context) {
+	ticker := time.NewTicker(time.Duration(r.InstanceTagsRescanInterval))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if keys := r.discoverInstanceTags(ctx); len(keys) > 0 {
+				r.Log.Infof("Discovered instance tags %s", strings.Join(keys, ", "))
+			}
+		}
+	}
+}
+
+func isSafeKeyChar(c byte) bool {
+	return c == '_' || c == '-' || c == '.' ||
+		(c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')
+}
+
+// underscoreKey replaces every character other than ASCII letters, digits,
+// '_', '-' and '.' by an underscore, e.g. "aws:autoscaling:groupName"
+// becomes "aws_autoscaling_groupName".
+func underscoreKey(key string) string {
+	var b strings.Builder
+	for _, c := range key {
+		if c < 0x80 && isSafeKeyChar(byte(c)) {
+			b.WriteRune(c)
+		} else {
+			b.WriteByte('_')
+		}
+	}
+	return b.String()
+}
+
+// percentEncodeKey percent-encodes every byte other than ASCII letters,
+// digits, '_', '-' and '.', e.g. "Cost Center" becomes "Cost%20Center".
+// Unlike underscoreKey it keeps distinct keys distinct.
+func percentEncodeKey(key string) string {
+	var b strings.Builder
+	for i := 0; i < len(key); i++ {
+		if c := key[i]; isSafeKeyChar(c) {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,387 @@
+package aws
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/feature/ec2/imds"
+	"github.com/influxdata/telegraf/config"
+	"github.com/influxdata/telegraf/plugins/common/parallel"
+	"github.com/influxdata/telegraf/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSanitizeInstanceTagKeys(t *testing.T) {
+	tests := []struct {
+		key        string
+		underscore string
+		percent    string
+	}{
+		{"aws:autoscaling:groupName", "aws_autoscaling_groupName", "aws%3Aautoscaling%3AgroupName"},
+		{"Cost Center", "Cost_Center", "Cost%20Center"},
+		{"Kostenstelle-ä", "Kostenstelle-_", "Kostenstelle-%C3%A4"},
+		{"team.name_1", "team.name_1", "team.name_1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.key, func(t *testing.T) {
+			require.Equal(t, tt.underscore, underscoreKey(tt.key))
+			require.Equal(t, tt.percent, percentEncodeKey(tt.key))
+		})
+	}
+}
+
+func TestInstanceTags(t *testing.T) {
+	client := &mockIMDSClient{
+		metadata: map[string]string{
+			"tags/instance/Cost Center": "1234",
+			"tags/instance/Cost:Center": "5678",
+			"tags/instance/region":      "emea",
+		},
+	}
+	p := newAwsIMDSProcessor()
+	p.Log = &testutil.Logger{}
+	p.InstanceTags = []string{"Cost:Center", "region", "Cost Center"}
+	require.NoError(t, p.Init())
+	p.tagCache = newTagCache(p.TagCacheSize)
+	p.imdsClient = client
+
+	// Collisions are resolved in sorted key order, and with built-in tags
+	// according to conflict_policy.
+	m := p.LookupIMDSTags(newTestMetric())
+	require.Equal(t, map[string]string{
+		"Cost_Center":   "1234",
+		"Cost_Center_2": "5678",
+		"region_tag":    "emea",
+	}, m.Tags())
+
+	p = newAwsIMDSProcessor()
+	p.Log = &testutil.Logger{}
+	p.InstanceTags = []string{"Cost:Center", "Cost Center"}
+	p.InstanceTagKeySanitization = "percent"
+	require.NoError(t, p.Init())
+	require.Contains(t, p.loadTags().imdsTagsMap, "Cost%3ACenter")
+	require.Contains(t, p.loadTags().imdsTagsMap, "Cost%20Center")
+}
+
+func TestInstanceTagsConflictPolicy(t *testing.T) {
+	client := &mockIMDSClient{
+		document: imds.InstanceIdentityDocument{Region: "us-east-1", InstanceType: "m5.large"},
+		metadata: map[string]string{"tags/instance/region": "emea"},
+	}
+
+	tests := []struct {
+		policy   string
+		expected map[string]string
+	}{
+		{"identity_wins", map[string]string{"region": "us-east-1", "instanceType": "m5.large"}},
+		{"instance_tag_wins", map[string]string{"region": "emea", "instanceType": "m5.large"}},
+		{"suffix_instance_tag", map[string]string{"region": "us-east-1", "region_tag": "emea", "instanceType": "m5.large"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.policy, func(t *testing.T) {
+			// The policy doesn't depend on merge_strategy.
+			for _, strategy := range []string{"first", "last", "error"} {
+				p := newAwsIMDSProcessor()
+				p.Log = &testutil.Logger{}
+				p.ImdsTags = []string{"region", "instanceType"}
+				p.InstanceTags = []string{"region"}
+				p.ConflictPolicy = tt.policy
+				p.MergeStrategy = strategy
+				require.NoError(t, p.Init())
+				p.tagCache = newTagCache(p.TagCacheSize)
+				p.imdsClient = client
+
+				m := p.LookupIMDSTags(newTestMetric())
+				require.Equal(t, tt.expected, m.Tags(), strategy)
+			}
+		})
+	}
+
+	// The winner's key is only taken over if it has a value.
+	p := newAwsIMDSProcessor()
+	p.Log = &testutil.Logger{}
+	p.ImdsTags = []string{"region"}
+	p.InstanceTags = []string{"region"}
+	p.ConflictPolicy = "identity_wins"
+	require.NoError(t, p.Init())
+	p.tagCache = newTagCache(p.TagCacheSize)
+	p.imdsClient = &mockIMDSClient{metadata: map[string]string{"tags/instance/region": "emea"}}
+	m := p.LookupIMDSTags(newTestMetric())
+	require.Equal(t, map[string]string{"region": "emea"}, m.Tags())
+}
+
+func TestInstanceTagsInvalid(t *testing.T) {
+	p := newAwsIMDSProcessor()
+	p.Log = &testutil.Logger{}
+	p.InstanceTags = []string{"Name"}
+	p.InstanceTagKeySanitization = "unknown"
+	require.Error(t, p.Init())
+
+	p = newAwsIMDSProcessor()
+	p.Log = &testutil.Logger{}
+	p.InstanceTags = []string{"team/name"}
+	require.Error(t, p.Init())
+
+	p = newAwsIMDSProcessor()
+	p.Log = &testutil.Logger{}
+	p.InstanceTags = []string{"Name"}
+	p.ConflictPolicy = "merge"
+	require.Error(t, p.Init())
+
+	p = newAwsIMDSProcessor()
+	p.Log = &testutil.Logger{}
+	p.InstanceTags = []string{"Name"}
+	p.InstanceTagsTTL = config.Duration(-time.Minute)
+	require.Error(t, p.Init())
+}
+
+func TestInstanceTagsWildcard(t *testing.T) {
+	client := &mockIMDSClient{
+		metadata: map[string]string{
+			"tags/instance":             "Name\nenv\nteam\ncost:center\ncost:owner",
+			"tags/instance/env":         "prod",
+			"tags/instance/team":        "payments",
+			"tags/instance/cost:center": "1234",
+		},
+	}
+	p := newAwsIMDSProcessor()
+	p.Log = &testutil.Logger{}
+	p.InstanceTags = []string{"*"}
+	p.InstanceTagsInclude = []string{"env", "team", "cost:*"}
+	p.InstanceTagsExclude = []string{"cost:owner"}
+	require.NoError(t, p.Init())
+	p.tagCache = newTagCache(p.TagCacheSize)
+	p.imdsClient = client
+
+	p.discoverInstanceTags(context.Background())
+	m := p.LookupIMDSTags(newTestMetric())
+	require.Equal(t, map[string]string{"env": "prod", "team": "payments", "cost_center": "1234"}, m.Tags())
+
+	// Excluded tags are never looked up: one listing plus three tags.
+	require.EqualValues(t, 4, client.calls)
+}
+
+func TestInstanceTagsFilterRequiresWildcard(t *testing.T) {
+	p := newAwsIMDSProcessor()
+	p.Log = &testutil.Logger{}
+	p.InstanceTags = []string{"env"}
+	p.InstanceTagsInclude = []string{"cost:*"}
+	require.Error(t, p.Init())
+}
+
+func TestInstanceTagsTTL(t *testing.T) {
+	client := &mockIMDSClient{
+		document: imds.InstanceIdentityDocument{Region: "eu-west-1"},
+		metadata: map[string]string{"tags/instance/Name": "web-1"},
+	}
+	p := newAwsIMDSProcessor()
+	p.Log = &testutil.Logger{}
+	p.ImdsTags = []string{"region"}
+	p.InstanceTags = []string{"Name"}
+	p.CacheTTL = config.Duration(24 * time.Hour)
+	p.InstanceTagsTTL = config.Duration(10 * time.Minute)
+	require.NoError(t, p.Init())
+	p.tagCache = newTagCache(p.TagCacheSize)
+	p.imdsClient = client
+
+	m := p.LookupIMDSTags(newTestMetric())
+	require.Equal(t, map[string]string{"region": "eu-west-1", "Name": "web-1"}, m.Tags())
+	require.EqualValues(t, 2, client.calls)
+
+	ttl, err := p.tagCache.TTL([]byte("region"))
+	require.NoError(t, err)
+	require.InDelta(t, (24 * time.Hour).Seconds(), float64(ttl), 1)
+	ttl, err = p.tagCache.TTL([]byte("Name"))
+	require.NoError(t, err)
+	require.InDelta(t, (10 * time.Minute).Seconds(), float64(ttl), 1)
+
+	// The instance tag expiring only fetches the instance tag again.
+	client.metadata["tags/instance/Name"] = "web-2"
+	p.tagCache.Del([]byte("Name"))
+	m = p.LookupIMDSTags(newTestMetric())
+	require.Equal(t, map[string]string{"region": "eu-west-1", "Name": "web-2"}, m.Tags())
+	require.EqualValues(t, 3, client.calls)
+}
+
+func TestInstanceTagsRescan(t *testing.T) {
+	client := &mockIMDSClient{
+		metadata: map[string]string{
+			"tags/instance":     "env",
+			"tags/instance/env": "prod",
+		},
+	}
+	p := newAwsIMDSProcessor()
+	p.Log = &testutil.Logger{}
+	p.InstanceTags = []string{"*"}
+	p.InstanceTagsInclude = []string{"env", "team"}
+	p.InstanceTagsRescanInterval = config.Duration(time.Minute)
+	p.NegativeCacheTTL = 0
+	require.NoError(t, p.Init())
+	p.tagCache = newTagCache(p.TagCacheSize)
+	p.imdsClient = client
+
+	require.Equal(t, []string{"env"}, p.discoverInstanceTags(context.Background()))
+	m := p.LookupIMDSTags(newTestMetric())
+	require.Equal(t, map[string]string{"env": "prod"}, m.Tags())
+
+	// Tags added later are picked up, known ones aren't added again.
+	client.metadata["tags/instance"] = "env\nteam\nother"
+	client.metadata["tags/instance/team"] = "payments"
+	require.Equal(t, []string{"team"}, p.discoverInstanceTags(context.Background()))
+	require.NotContains(t, p.loadTags().imdsTagsMap, "env_2")
+	m = p.LookupIMDSTags(newTestMetric())
+	require.Equal(t, map[string]string{"env": "prod", "team": "payments"}, m.Tags())
+
+	// Removed tags are no longer added once their values expire.
+	client.metadata["tags/instance"] = "team"
+	delete(client.metadata, "tags/instance/env")
+	require.Empty(t, p.discoverInstanceTags(context.Background()))
+	p.tagCache.Del([]byte("env"))
+	m = p.LookupIMDSTags(newTestMetric())
+	require.Equal(t, map[string]string{"team": "payments"}, m.Tags())
+}
+
+func TestInstanceTagsRescanKeepsKeys(t *testing.T) {
+	client := &mockIMDSClient{
+		metadata: map[string]string{
+			"tags/instance":     "a.b",
+			"tags/instance/a.b": "1",
+		},
+	}
+	p := newAwsIMDSProcessor()
+	p.Log = &testutil.Logger{}
+	p.InstanceTags = []string{"*"}
+	p.InstanceTagsRescanInterval = config.Duration(time.Minute)
+	p.SanitizeLabelNames = true
+	require.NoError(t, p.Init())
+	p.tagCache = newTagCache(p.TagCacheSize)
+	p.imdsClient = client
+
+	require.Equal(t, []string{"a.b"}, p.discoverInstanceTags(context.Background()))
+	require.Equal(t, "a_b", p.loadTags().tagKey("a.b"))
+
+	// A new tag sorting first doesn't take the key of the known one.
+	client.metadata["tags/instance"] = "a-b\na.b"
+	client.metadata["tags/instance/a-b"] = "2"
+	require.Equal(t, []string{"a-b"}, p.discoverInstanceTags(context.Background()))
+	require.Equal(t, "a_b", p.loadTags().tagKey("a.b"))
+	require.Equal(t, "a_b_2", p.loadTags().tagKey("a-b"))
+	m := p.LookupIMDSTags(newTestMetric())
+	require.Equal(t, map[string]string{"a_b": "1", "a_b_2": "2"}, m.Tags())
+}
+
+func TestInstanceTagsRescanRequiresWildcard(t *testing.T) {
+	p := newAwsIMDSProcessor()
+	p.Log = &testutil.Logger{}
+	p.InstanceTags = []string{"env"}
+	p.InstanceTagsRescanInterval = config.Duration(time.Minute)
+	require.Error(t, p.Init())
+}
+
+// growingTagsClient lists one more instance tag on every listing.
+type growingTagsClient struct {
+	*mockIMDSClient
+	listed int32
+}
+
+func (c *growingTagsClient) GetMetadata(
+	ctx context.Context,
+	in *imds.GetMetadataInput,
+	opts ...func(*imds.Options),
+) (*imds.GetMetadataOutput, error) {
+	if in.Path != instanceTagsPath {
+		return c.mockIMDSClient.GetMetadata(ctx, in, opts...)
+	}
+	n := int(atomic.AddInt32(&c.listed, 1))
+	keys := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		keys = append(keys, fmt.Sprintf("tag%d", i))
+	}
+	return &imds.GetMetadataOutput{Content: io.NopCloser(strings.NewReader(strings.Join(keys, "\n")))}, nil
+}
+
+func TestInstanceTagsRescanConcurrentAdd(t *testing.T) {
+	const scans = 50
+	metadata := make(map[string]string, scans)
+	for i := 0; i < scans; i++ {
+		metadata[fmt.Sprintf("tags/instance/tag%d", i)] = "value"
+	}
+	client := &growingTagsClient{mockIMDSClient: &mockIMDSClient{metadata: metadata}}
+	p := newAwsIMDSProcessor()
+	p.Log = &testutil.Logger{}
+	p.InstanceTags = []string{"*"}
+	p.InstanceTagsRescanInterval = config.Duration(time.Minute)
+	p.SkipIfComplete = true
+	require.NoError(t, p.Init())
+	p.tagCache = newTagCache(p.TagCacheSize)
+	p.imdsClient = client
+
+	acc := &testutil.Accumulator{}
+	p.parallel = parallel.NewUnordered(acc, p.asyncAdd, 4)
+
+	// Metrics are enriched while the rescan publishes new tags.
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < scans; i++ {
+			p.discoverInstanceTags(context.Background())
+		}
+	}()
+	for i := 0; i < 200; i++ {
+		require.NoError(t, p.Add(newTestMetric(), acc))
+		p.LookupIMDSTags(newTestMetric())
+	}
+	wg.Wait()
+	p.Stop()
+
+	require.Len(t, acc.GetTelegrafMetrics(), 200)
+	require.Len(t, p.loadTags().imdsTagsMap, scans)
+	m := p.LookupIMDSTags(newTestMetric())
+	require.Len(t, m.Tags(), scans)
+}
+
+func TestInstanceTagsRescanSkipIfComplete(t *testing.T) {
+	client := &mockIMDSClient{
+		metadata: map[string]string{
+			"tags/instance":      "env",
+			"tags/instance/env":  "prod",
+			"tags/instance/team": "payments",
+		},
+	}
+	p := newAwsIMDSProcessor()
+	p.Log = &testutil.Logger{}
+	p.InstanceTags = []string{"*"}
+	p.InstanceTagsRescanInterval = config.Duration(time.Minute)
+	p.SkipIfComplete = true
+	require.NoError(t, p.Init())
+	p.tagCache = newTagCache(p.TagCacheSize)
+	p.imdsClient = client
+	require.Equal(t, []string{"env"}, p.discoverInstanceTags(context.Background()))
+
+	acc := &testutil.Accumulator{}
+	p.parallel = parallel.NewUnordered(acc, p.asyncAdd, 1)
+	m := newTestMetric()
+	m.AddTag("env", "dev")
+	require.NoError(t, p.Add(m, acc))
+
+	// Once published, discovered tags make metrics lacking them incomplete.
+	client.metadata["tags/instance"] = "env\nteam"
+	require.Equal(t, []string{"team"}, p.discoverInstanceTags(context.Background()))
+	m = newTestMetric()
+	m.AddTag("env", "dev")
+	require.NoError(t, p.Add(m, acc))
+	p.parallel.Stop()
+
+	metrics := acc.GetTelegrafMetrics()
+	require.Len(t, metrics, 2)
+	require.Equal(t, map[string]string{"env": "dev"}, metrics[0].Tags())
+	require.Equal(t, map[string]string{"env": "prod", "team": "payments"}, metrics[1].Tags())
+}
@@ -0,0 +1,114 @@
+package aws
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// jsonQuery is a GJSON-style path selecting a single value of a JSON
+// document, e.g. "InstanceProfileArn" or "0.Code". Elements are separated by
+// dots, which can be escaped with a backslash. Numeric elements index arrays
+// and a final "#" returns the length of an array.
+type jsonQuery []string
+
+func parseJSONQuery(query string) (jsonQuery, error) {
+	var q jsonQuery
+	var b strings.Builder
+	for i := 0; i < len(query); i++ {
+		switch c := query[i]; c {
+		case '\\':
+			i++
+			if i == len(query) {
+				return nil, errors.New("trailing backslash")
+			}
+			b.WriteByte(query[i])
+		case '.':
+			q = append(q, b.String())
+			b.Reset()
+		default:
+			b.WriteByte(c)
+		}
+	}
+	q = append(q, b.String())
+
+	for i, element := range q {
+		if element == "" {
+			return nil, errors.New("empty path element")
+		}
+		if element == "#" && i != len(q)-1 {
+			return nil, errors.New(`"#" must be the last path element`)
+		}
+	}
+	return q, nil
+}
+
+// apply returns the selected value: strings as-is, other scalars and
+// documents as JSON. It returns an empty string if nothing matches.
+func (q jsonQuery) apply(content string) (string, error) {
+	d := json.NewDecoder(strings.NewReader(content))
+	d.UseNumber()
+	var v interface{}
+	if err := d.Decode(&v); err != nil {
+		return "", fmt.Errorf("parsing JSON response: %w", err)
+	}
+
+	for _, element := range q {
+		switch node := v.(type) {
+		case map[string]interface{}:
+			v = node[element]
+		case []interface{}:
+			if element == "#" {
+				return strconv.Itoa(len(node)), nil
+			}
+			i, err := strconv.Atoi(element)
+			if err != nil || i < 0 || i >= len(node) {
+				return "", nil
+			}
+			v = node[i]
+		default:
+			return "", nil
+		}
+	}
+
+	switch v := v.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return v, nil
+	case json.Number:
+		return v.String(), nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	}
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(buf.String(), "\n"), nil
+}
+
+// initJSONQueries sets up the json_query of path tags. Tags queried from
+// JSON responses cache empty results, so queries matching nothing aren't
+// repeated until cache_ttl expires.
+func (r *AwsIMDSProcessor) initJSONQueries(tc *tagConfig) error {
+	for tag, query := range r.JSONQuery {
+		mt, ok := tc.pathTags[tag]
+		if !ok || mt.parse != nil {
+			return fmt.Errorf("json_query specified for tag not resolved from a configured path: %s", tag)
+		}
+		q, err := parseJSONQuery(query)
+		if err != nil {
+			return fmt.Errorf("invalid json_query for tag %s: %w", tag, err)
+		}
+		mt.parse = q.apply
+		mt.cacheEmpty = true
+		tc.pathTags[tag] = mt
+	}
+	return nil
+}
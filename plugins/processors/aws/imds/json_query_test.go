@@ -0,0 +1,94 @@
+package aws
+
+import (
+	"testing"
+
+	"github.com/influxdata/telegraf/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestJSONQuery(t *testing.T) {
+	const document = `{
+		"Code": "Success",
+		"InstanceProfileArn": "arn:aws:iam::123456789012:instance-profile/web",
+		"Count": 3,
+		"Enabled": true,
+		"Events": [{"Code": "system-reboot"}, {"Code": "instance-stop"}],
+		"dotted.key": "x",
+		"Nested": {"A": ["b"]}
+	}`
+
+	tests := []struct {
+		query    string
+		expected string
+	}{
+		{"InstanceProfileArn", "arn:aws:iam::123456789012:instance-profile/web"},
+		{"Count", "3"},
+		{"Enabled", "true"},
+		{"Events.1.Code", "instance-stop"},
+		{"Events.#", "2"},
+		{`dotted\.key`, "x"},
+		{"Nested", `{"A":["b"]}`},
+		{"Missing", ""},
+		{"Events.5.Code", ""},
+		{"Code.Deeper", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			q, err := parseJSONQuery(tt.query)
+			require.NoError(t, err)
+			v, err := q.apply(document)
+			require.NoError(t, err)
+			require.Equal(t, tt.expected, v)
+		})
+	}
+
+	q, err := parseJSONQuery("Code")
+	require.NoError(t, err)
+	_, err = q.apply("not json")
+	require.Error(t, err)
+}
+
+func TestJSONQueryInvalid(t *testing.T) {
+	for _, query := range []string{"", "a..b", "a.", `a\`, "#.Code"} {
+		_, err := parseJSONQuery(query)
+		require.Error(t, err, query)
+	}
+
+	p := newAwsIMDSProcessor()
+	p.Log = &testutil.Logger{}
+	p.MetadataPaths = map[string]string{"instanceProfile": "iam/info"}
+	p.JSONQuery = map[string]string{"instanceProfile": "a..b"}
+	require.Error(t, p.Init())
+
+	// Queries are only supported for configured paths.
+	p.JSONQuery = map[string]string{"region": "Region"}
+	require.Error(t, p.Init())
+	p.JSONQuery = map[string]string{"scheduledMaintenance": "0.Code"}
+	require.Error(t, p.Init())
+}
+
+func TestJSONQueryTags(t *testing.T) {
+	client := &mockIMDSClient{metadata: map[string]string{
+		"iam/info": `{"Code": "Success", "InstanceProfileArn": "arn:aws:iam::123456789012:instance-profile/web"}`,
+	}}
+	p := newAwsIMDSProcessor()
+	p.Log = &testutil.Logger{}
+	p.MetadataPaths = map[string]string{"instanceProfile": "iam/info", "instanceProfileId": "iam/info"}
+	p.JSONQuery = map[string]string{
+		"instanceProfile":   "InstanceProfileArn",
+		"instanceProfileId": "InstanceProfileId",
+	}
+	require.NoError(t, p.Init())
+	p.tagCache = newTagCache(p.TagCacheSize)
+	p.imdsClient = client
+
+	m := p.LookupIMDSTags(newTestMetric())
+	require.Equal(t, map[string]string{"instanceProfile": "arn:aws:iam::123456789012:instance-profile/web"}, m.Tags())
+
+	// Queries matching nothing are negative-cached.
+	calls := client.calls
+	m = p.LookupIMDSTags(newTestMetric())
+	require.Equal(t, map[string]string{"instanceProfile": "arn:aws:iam::123456789012:instance-profile/web"}, m.Tags())
+	require.Equal(t, calls, client.calls)
+}
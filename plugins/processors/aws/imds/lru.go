@@ -0,0 +1,102 @@
+package aws
+
+import (
+	"container/list"
+	"sync"
+)
+
+// lruIndex tracks the recency of the tag cache entries to bound their number
+// to max_cache_entries. Entries of pinned tags aren't tracked and never
+// evicted.
+type lruIndex struct {
+	mu       sync.Mutex
+	max      int
+	order    *list.List
+	elements map[string]*list.Element
+}
+
+func newLRUIndex(max int) *lruIndex {
+	return &lruIndex{
+		max:      max,
+		order:    list.New(),
+		elements: make(map[string]*list.Element),
+	}
+}
+
+// touch marks the key as most recently used.
+func (l *lruIndex) touch(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if e, ok := l.elements[key]; ok {
+		l.order.MoveToFront(e)
+	}
+}
+
+// add marks the key as most recently used, adding it if new, and returns the
+// least recently used keys exceeding the limit.
+func (l *lruIndex) add(key string) []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if e, ok := l.elements[key]; ok {
+		l.order.MoveToFront(e)
+		return nil
+	}
+	l.elements[key] = l.order.PushFront(key)
+
+	var evicted []string
+	for l.order.Len() > l.max {
+		e := l.order.Back()
+		k := l.order.Remove(e).(string)
+		delete(l.elements, k)
+		evicted = append(evicted, k)
+	}
+	return evicted
+}
+
+// remove stops tracking the key, e.g. once its entry expired.
+func (l *lruIndex) remove(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if e, ok := l.elements[key]; ok {
+		l.order.Remove(e)
+		delete(l.elements, key)
+	}
+}
+
+// clear stops tracking all keys.
+func (l *lruIndex) clear() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.order.Init()
+	l.elements = make(map[string]*list.Element)
+}
+
+// pinnedTag reports whether the cache entries of the tag are never evicted.
+// These are the identity document, its fields and the tags derived from them,
+// a small fixed set every lookup needs.
+func pinnedTag(tag string) bool {
+	_, ok := allowedImdsTags[tag]
+	return ok || tag == documentCacheKey
+}
+
+// setCacheEntry stores the encoded entry of the tag and evicts the least
+// recently used entries beyond max_cache_entries.
+func (r *AwsIMDSProcessor) setCacheEntry(tag string, e cacheEntry, expiration int) error {
+	if err := r.tagCache.Set([]byte(tag), e.encode(), expiration); err != nil {
+		return err
+	}
+	if pinnedTag(tag) {
+		return nil
+	}
+	for _, key := range r.cacheIndex.add(tag) {
+		r.tagCache.Del([]byte(key))
+		r.cacheEvictions.Incr(1)
+	}
+	return nil
+}
+
+// clearCache removes all cache entries.
+func (r *AwsIMDSProcessor) clearCache() {
+	r.tagCache.Clear()
+	r.cacheIndex.clear()
+}
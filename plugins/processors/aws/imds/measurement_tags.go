@@ -0,0 +1,88 @@
+package aws
+
+import (
+	"fmt"
+
+	"github.com/influxdata/telegraf"
+)
+
+// initTagsByMeasurement validates tags_by_measurement and sets up the tags
+// looked up for the listed measurements. Listed tags not in imds_tags, e.g.
+// of metadata_paths, are only added to the measurements listing them.
+func (r *AwsIMDSProcessor) initTagsByMeasurement(tc *tagConfig) error {
+	tc.defaultTags = tc.imdsTagsMap
+	if len(r.TagsByMeasurement) == 0 {
+		return nil
+	}
+
+	imdsTags := make(map[string]struct{}, len(r.ImdsTags))
+	for _, tag := range r.ImdsTags {
+		imdsTags[tag] = struct{}{}
+	}
+
+	r.measurementTags = make(map[string]map[string]struct{}, len(r.TagsByMeasurement))
+	listed := make(map[string]struct{})
+	for name, tags := range r.TagsByMeasurement {
+		if len(tags) == 0 {
+			return fmt.Errorf("no tags specified in tags_by_measurement for measurement %s", name)
+		}
+		set := make(map[string]struct{}, len(tags))
+		for _, tag := range tags {
+			if _, ok := tc.imdsTagsMap[tag]; !ok && !isIMDSTagAllowed(tag) {
+				return fmt.Errorf("not allowed metadata tag specified in tags_by_measurement for measurement %s: %s", name, tag)
+			}
+			set[tag] = struct{}{}
+			listed[tag] = struct{}{}
+		}
+		r.measurementTags[name] = set
+	}
+
+	tc.defaultTags = make(map[string]struct{}, len(tc.imdsTagsMap))
+	for tag := range tc.imdsTagsMap {
+		_, isListed := listed[tag]
+		_, isIMDSTag := imdsTags[tag]
+		if !isListed || isIMDSTag {
+			tc.defaultTags[tag] = struct{}{}
+		}
+	}
+	// All tags which may be added need keys and validate options like
+	// tag_rename, so they are configured tags from here on.
+	for tag := range listed {
+		tc.imdsTagsMap[tag] = struct{}{}
+	}
+	return nil
+}
+
+// initMeasurementLookups adds set_host_tag_from to the tags looked up for
+// the measurements in tags_by_measurement.
+func (r *AwsIMDSProcessor) initMeasurementLookups() {
+	r.measurementLookups = make(map[string]map[string]struct{}, len(r.measurementTags))
+	for name, tags := range r.measurementTags {
+		lookup := tags
+		if r.SetHostTagFrom != "" {
+			lookup = make(map[string]struct{}, len(tags)+1)
+			for tag := range tags {
+				lookup[tag] = struct{}{}
+			}
+			lookup[r.SetHostTagFrom] = struct{}{}
+		}
+		r.measurementLookups[name] = lookup
+	}
+}
+
+// configuredTags returns the tags configured for the metric's measurement.
+func (r *AwsIMDSProcessor) configuredTags(tc *tagConfig, metric telegraf.Metric) map[string]struct{} {
+	if tags, ok := r.measurementTags[metric.Name()]; ok {
+		return tags
+	}
+	return tc.defaultTags
+}
+
+// tagsToLookup returns the tags to look up for the metric's measurement,
+// including set_host_tag_from.
+func (r *AwsIMDSProcessor) tagsToLookup(tc *tagConfig, metric telegraf.Metric) map[string]struct{} {
+	if tags, ok := r.measurementLookups[metric.Name()]; ok {
+		return tags
+	}
+	return tc.lookupTags
+}
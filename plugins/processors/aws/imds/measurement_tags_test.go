@@ -0,0 +1,69 @@
+package aws
+
+import (
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/feature/ec2/imds"
+	"github.com/influxdata/telegraf/metric"
+	"github.com/influxdata/telegraf/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTagsByMeasurement(t *testing.T) {
+	p := newAwsIMDSProcessor()
+	p.Log = &testutil.Logger{}
+	p.ImdsTags = []string{"region", "instanceId"}
+	p.MetadataPaths = map[string]string{
+		"blockDevices": "block-device-mapping",
+		"vpcId":        "network/interfaces/macs/0e:12/vpc-id",
+	}
+	p.TagsByMeasurement = map[string][]string{
+		"diskio": {"region", "blockDevices"},
+		"net":    {"vpcId", "availabilityZone"},
+	}
+	require.NoError(t, p.Init())
+	p.tagCache = newTagCache(p.TagCacheSize)
+	p.imdsClient = &mockIMDSClient{
+		document: imds.InstanceIdentityDocument{
+			Region:           "us-east-1",
+			InstanceID:       "i-0123456789abcdef0",
+			AvailabilityZone: "us-east-1a",
+		},
+		metadata: map[string]string{
+			"block-device-mapping":                 "ami\nroot",
+			"network/interfaces/macs/0e:12/vpc-id": "vpc-1234",
+		},
+	}
+
+	for _, tt := range []struct {
+		name     string
+		expected map[string]string
+	}{
+		{"diskio", map[string]string{"region": "us-east-1", "blockDevices": "ami\nroot"}},
+		{"net", map[string]string{"vpcId": "vpc-1234", "availabilityZone": "us-east-1a"}},
+		// Unlisted measurements get imds_tags, but not the path tags listed
+		// for other measurements.
+		{"cpu", map[string]string{"region": "us-east-1", "instanceId": "i-0123456789abcdef0"}},
+	} {
+		m := metric.New(tt.name, map[string]string{}, map[string]interface{}{"v": 1}, time.Unix(0, 0))
+		m = p.LookupIMDSTags(m)
+		require.Equal(t, tt.expected, m.Tags(), tt.name)
+	}
+
+	// Only the measurement's tags make a metric complete.
+	m := metric.New("net", map[string]string{"vpcId": "vpc-1", "availabilityZone": "a"}, map[string]interface{}{"v": 1}, time.Unix(0, 0))
+	require.True(t, p.complete(p.loadTags(), m))
+	m = metric.New("cpu", map[string]string{"vpcId": "vpc-1", "availabilityZone": "a"}, map[string]interface{}{"v": 1}, time.Unix(0, 0))
+	require.False(t, p.complete(p.loadTags(), m))
+}
+
+func TestTagsByMeasurementInvalid(t *testing.T) {
+	for _, tags := range [][]string{{"vpcId"}, {}, {"region", ""}} {
+		p := newAwsIMDSProcessor()
+		p.Log = &testutil.Logger{}
+		p.ImdsTags = []string{"region"}
+		p.TagsByMeasurement = map[string][]string{"net": tags}
+		require.Error(t, p.Init(), tags)
+	}
+}
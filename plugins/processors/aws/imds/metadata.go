@@ -0,0 +1,300 @@
+package aws
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/feature/ec2/imds"
+)
+
+// maintenanceCacheTTL bounds how long scheduled maintenance events are cached
+// since they can be announced at any time.
+const maintenanceCacheTTL = 5 * time.Minute
+
+// metadataTag is a tag resolved from a single meta-data path, or dynamic data
+// path if dynamic is set, rather than from the instance identity document.
+type metadataTag struct {
+	path    string
+	dynamic bool
+	// parse converts the raw response into the tag value; nil uses it as-is.
+	parse func(string) (string, error)
+	// ttl caps the cache TTL for values that change during the lifetime of
+	// the instance; zero uses cache_ttl.
+	ttl time.Duration
+	// cacheEmpty caches empty values, e.g. of JSON queries matching nothing.
+	cacheEmpty bool
+	// instanceTag marks instance tags, cached according to instance_tags_ttl
+	// rather than cache_ttl.
+	instanceTag bool
+	// optional paths only exist in some states; a missing path is an empty
+	// value rather than a failure.
+	optional bool
+}
+
+// identityDocumentPath is the dynamic data path of the identity document.
+const identityDocumentPath = "instance-identity/document"
+
+var metadataTags = map[string]metadataTag{
+	// The raw identity document, added as a field unless
+	// identity_document_as_tag is set.
+	"identity_document": {
+		path:    identityDocumentPath,
+		dynamic: true,
+	},
+	"scheduledMaintenance": {
+		path:  "events/maintenance/scheduled",
+		parse: parseHasScheduledMaintenance,
+		ttl:   maintenanceCacheTTL,
+	},
+	"scheduledMaintenanceCode": {
+		path:  "events/maintenance/scheduled",
+		parse: parseScheduledMaintenanceCode,
+		ttl:   maintenanceCacheTTL,
+	},
+	// Shared by instances launched together, e.g. "r-0123456789abcdef0".
+	"reservationId": {
+		path: "reservation-id",
+	},
+	// "enabled" or "disabled"; missing on some instances.
+	"detailedMonitoring": {
+		path:       "fws/instance-monitoring",
+		dynamic:    true,
+		cacheEmpty: true,
+		optional:   true,
+	},
+	"spotInstanceAction": {
+		path:       "spot/instance-action",
+		parse:      parseSpotInstanceAction,
+		ttl:        terminationCacheTTL,
+		cacheEmpty: true,
+		optional:   true,
+	},
+	"targetLifecycleState": {
+		path:       "autoscaling/target-lifecycle-state",
+		ttl:        terminationCacheTTL,
+		cacheEmpty: true,
+		optional:   true,
+	},
+}
+
+// pathPattern matches relative IMDS paths such as "placement/group-name" or
+// "network/interfaces/macs/0e:12:34:56:78:9a/subnet-id".
+var pathPattern = regexp.MustCompile(`^[A-Za-z0-9_-]+(/[A-Za-z0-9_.:-]+)*/?$`)
+
+// initPathTags collects the built-in path tags and the tags configured in
+// metadata_paths and dynamic_paths. Configured tags are added to the tags
+// to look up.
+func (r *AwsIMDSProcessor) initPathTags(tc *tagConfig) error {
+	tc.pathTags = make(map[string]metadataTag, len(metadataTags)+len(r.MetadataPaths)+len(r.DynamicPaths))
+	for tag, mt := range metadataTags {
+		tc.pathTags[tag] = mt
+	}
+
+	for _, option := range []struct {
+		name    string
+		paths   map[string]string
+		dynamic bool
+	}{
+		{"metadata_paths", r.MetadataPaths, false},
+		{"dynamic_paths", r.DynamicPaths, true},
+	} {
+		for tag, path := range option.paths {
+			if tag == "" || isIMDSTagAllowed(tag) {
+				return fmt.Errorf("invalid tag name in %s: %q", option.name, tag)
+			}
+			if _, ok := tc.pathTags[tag]; ok {
+				return fmt.Errorf("tag %s configured in both metadata_paths and dynamic_paths", tag)
+			}
+			if !pathPattern.MatchString(path) || strings.Contains(path, "..") {
+				return fmt.Errorf("invalid path for %s in %s: %q", tag, option.name, path)
+			}
+			tc.pathTags[tag] = metadataTag{path: path, dynamic: option.dynamic}
+			tc.imdsTagsMap[tag] = struct{}{}
+		}
+	}
+	return r.initPathList(tc)
+}
+
+// keySeparatorPattern matches separators producing valid tag keys.
+var keySeparatorPattern = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+
+// initPathList adds a path tag for each path in metadata_path_list, named
+// according to path_key_strategy.
+func (r *AwsIMDSProcessor) initPathList(tc *tagConfig) error {
+	switch r.PathKeyStrategy {
+	case "configured_name":
+		if len(r.MetadataPathList) > 0 {
+			return errors.New(`metadata_path_list requires path_key_strategy "basename" or "full_path_flattened"`)
+		}
+		return nil
+	case "basename", "full_path_flattened":
+	default:
+		return fmt.Errorf("invalid path_key_strategy: %s", r.PathKeyStrategy)
+	}
+	if !keySeparatorPattern.MatchString(r.PathKeySeparator) {
+		return fmt.Errorf("invalid path_key_separator: %q", r.PathKeySeparator)
+	}
+
+	for _, path := range r.MetadataPathList {
+		if !pathPattern.MatchString(path) || strings.Contains(path, "..") {
+			return fmt.Errorf("invalid path in metadata_path_list: %q", path)
+		}
+		tag := r.pathKey(path)
+		if isIMDSTagAllowed(tag) {
+			return fmt.Errorf("key %s of path %s collides with a built-in tag", tag, path)
+		}
+		if existing, ok := tc.pathTags[tag]; ok {
+			return fmt.Errorf("key %s of path %s collides with path %s", tag, path, existing.path)
+		}
+		tc.pathTags[tag] = metadataTag{path: path}
+		tc.imdsTagsMap[tag] = struct{}{}
+	}
+	return nil
+}
+
+// pathKey forms the tag name of a path in metadata_path_list, e.g. for
+// "network/interfaces/macs/0e:12/subnet-id" either "subnet-id" or, flattened
+// with "_", "network_interfaces_macs_0e_12_subnet-id". Characters not valid
+// in tag keys, such as the colons of MAC addresses, become underscores.
+func (r *AwsIMDSProcessor) pathKey(path string) string {
+	path = strings.TrimSuffix(path, "/")
+	if r.PathKeyStrategy == "basename" {
+		path = path[strings.LastIndexByte(path, '/')+1:]
+	}
+	parts := strings.Split(path, "/")
+	for i, part := range parts {
+		parts[i] = underscoreKey(part)
+	}
+	return strings.Join(parts, r.PathKeySeparator)
+}
+
+// lookupMetadataTag fetches and parses the value of a path tag.
+func (r *AwsIMDSProcessor) lookupMetadataTag(ctx context.Context, mt metadataTag) (string, error) {
+	v, err := r.getPath(ctx, mt.dynamic, mt.path, mt.optional)
+	if mt.optional && isNotFound(err) {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+	if mt.parse == nil {
+		return v, nil
+	}
+	return mt.parse(v)
+}
+
+// getMetadata fetches a meta-data path. Concurrent callers share a single
+// request.
+func (r *AwsIMDSProcessor) getMetadata(ctx context.Context, path string) (string, error) {
+	return r.getPath(ctx, false, path, false)
+}
+
+// getDynamicData fetches a dynamic data path. Concurrent callers share a
+// single request.
+func (r *AwsIMDSProcessor) getDynamicData(ctx context.Context, path string) (string, error) {
+	return r.getPath(ctx, true, path, false)
+}
+
+// getPath fetches a meta-data or, if dynamic, a dynamic data path.
+// Concurrent callers share a single request. Paths not found are retried like
+// other failures, unless optional: such paths only exist in some states, so
+// a retry won't find them.
+func (r *AwsIMDSProcessor) getPath(ctx context.Context, dynamic bool, path string, optional bool) (string, error) {
+	key, fetch := "meta-data/"+path, r.fetchMetadata
+	if dynamic {
+		key, fetch = "dynamic/"+path, r.fetchDynamicData
+	}
+	if optional {
+		key += "#optional"
+	}
+	v, err := r.flights.do(key, func() (interface{}, error) {
+		return fetch(ctx, path, optional)
+	})
+	content, _ := v.(string)
+	return content, err
+}
+
+func (r *AwsIMDSProcessor) fetchMetadata(ctx context.Context, path string, optional bool) (string, error) {
+	var content string
+	err := r.withRetries(ctx, func(ctx context.Context) error {
+		out, err := r.imdsClient.GetMetadata(ctx, &imds.GetMetadataInput{Path: path})
+		if optional && isNotFound(err) {
+			return permanent(err)
+		} else if err != nil {
+			return err
+		}
+		defer out.Content.Close()
+
+		b, err := io.ReadAll(out.Content)
+		if err != nil {
+			return fmt.Errorf("reading %s: %w", path, err)
+		}
+		content = string(b)
+		return r.checkContent(path, content)
+	})
+	return content, err
+}
+
+func (r *AwsIMDSProcessor) fetchDynamicData(ctx context.Context, path string, optional bool) (string, error) {
+	var content string
+	err := r.withRetries(ctx, func(ctx context.Context) error {
+		out, err := r.imdsClient.GetDynamicData(ctx, &imds.GetDynamicDataInput{Path: path})
+		if optional && isNotFound(err) {
+			return permanent(err)
+		} else if err != nil {
+			return err
+		}
+		defer out.Content.Close()
+
+		b, err := io.ReadAll(out.Content)
+		if err != nil {
+			return fmt.Errorf("reading %s: %w", path, err)
+		}
+		content = string(b)
+		return r.checkContent(path, content)
+	})
+	return content, err
+}
+
+// maintenanceEvent is an entry of the events/maintenance/scheduled document.
+type maintenanceEvent struct {
+	Code        string `json:"Code"`
+	Description string `json:"Description"`
+	State       string `json:"State"`
+	EventID     string `json:"EventId"`
+	NotBefore   string `json:"NotBefore"`
+	NotAfter    string `json:"NotAfter"`
+}
+
+func parseMaintenanceEvents(s string) ([]maintenanceEvent, error) {
+	var events []maintenanceEvent
+	if s == "" {
+		return events, nil
+	}
+	if err := json.Unmarshal([]byte(s), &events); err != nil {
+		return nil, fmt.Errorf("parsing scheduled maintenance events: %w", err)
+	}
+	return events, nil
+}
+
+func parseHasScheduledMaintenance(s string) (string, error) {
+	events, err := parseMaintenanceEvents(s)
+	if err != nil {
+		return "", err
+	}
+	return strconv.FormatBool(len(events) > 0), nil
+}
+
+func parseScheduledMaintenanceCode(s string) (string, error) {
+	events, err := parseMaintenanceEvents(s)
+	if err != nil || len(events) == 0 {
+		return "", err
+	}
+	return events[0].Code, nil
+}
@@ -0,0 +1,65 @@
+package aws
+
+import (
+	"context"
+	"time"
+
+	"github.com/influxdata/telegraf"
+)
+
+// emitMetadataMetrics periodically adds a metric carrying the resolved values
+// of the configured tags as string fields, starting right away.
+func (r *AwsIMDSProcessor) emitMetadataMetrics(ctx context.Context, acc telegraf.Accumulator) {
+	ticker := time.NewTicker(time.Duration(r.MetadataMetricInterval))
+	defer ticker.Stop()
+
+	for {
+		r.emitMetadataMetric(ctx, acc)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (r *AwsIMDSProcessor) emitMetadataMetric(ctx context.Context, acc telegraf.Accumulator) {
+	tc := r.loadTags()
+	resolved, _ := r.resolveTags(ctx, tc, tc.imdsTagsMap, false)
+
+	values := make(map[string]string, len(resolved))
+	for tag, e := range resolved {
+		values[tag] = e.value
+	}
+
+	fields := make(map[string]interface{}, len(values))
+	for key, v := range r.keyedValues(tc, values) {
+		fields[key] = v
+	}
+	if r.IncludeIdentityDocument {
+		if doc := r.identityDocumentJSON(ctx); doc != "" {
+			fields["identity_document"] = doc
+		}
+	}
+	if len(fields) == 0 {
+		return
+	}
+
+	acc.AddFields(r.MetadataMetricName, fields, nil, time.Now())
+}
+
+// identityDocumentJSON returns the identity document as served by IMDS. The
+// raw bytes are kept, rather than re-encoding the parsed document, so the
+// document can still be verified against its signature. The last document
+// fetched is returned if IMDS can't be reached.
+func (r *AwsIMDSProcessor) identityDocumentJSON(ctx context.Context) string {
+	doc, err := r.getDynamicData(ctx, identityDocumentPath)
+	if err != nil {
+		r.Log.Errorf("Error when fetching identity document: %v", err)
+		return r.rawDocument
+	}
+
+	r.rawDocument = doc
+	return doc
+}
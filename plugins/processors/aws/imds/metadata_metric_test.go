@@ -0,0 +1,81 @@
+package aws
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/feature/ec2/imds"
+	"github.com/influxdata/telegraf/config"
+	"github.com/influxdata/telegraf/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEmitMetadataMetric(t *testing.T) {
+	client := &mockIMDSClient{
+		document: imds.InstanceIdentityDocument{
+			AccountID:    "123456789012",
+			InstanceType: "m5.large",
+			Region:       "us-east-1",
+		},
+	}
+	p := newTestProcessor(t, client, "region", "instanceType")
+	p.EmitMetadataMetric = true
+	p.MetadataMetricInterval = config.Duration(10 * time.Millisecond)
+
+	acc := &testutil.Accumulator{}
+	ctx, cancel := context.WithCancel(context.Background())
+	p.startWorker(ctx, func(ctx context.Context) {
+		p.emitMetadataMetrics(ctx, acc)
+	})
+
+	acc.Wait(2)
+	cancel()
+	p.workers.Wait()
+
+	first := acc.GetTelegrafMetrics()[0]
+	require.Equal(t, "aws_imds_host", first.Name())
+	require.Empty(t, first.Tags())
+	require.Equal(t, map[string]interface{}{"region": "us-east-1", "instanceType": "m5.large"}, first.Fields())
+
+	// Cache refreshes are reflected in subsequent metrics.
+	acc.ClearMetrics()
+	p.tagCache.Clear()
+	client.document.InstanceType = "m5.xlarge"
+	p.emitMetadataMetric(context.Background(), acc)
+	require.Equal(t, "m5.xlarge", acc.GetTelegrafMetrics()[0].Fields()["instanceType"])
+}
+
+func TestMetadataMetricIdentityDocument(t *testing.T) {
+	// Keep the exact bytes served, including whitespace and key order.
+	raw := "{\n  \"region\" : \"us-east-1\",\n  \"accountId\" : \"123456789012\"\n}"
+	client := &mockIMDSClient{
+		document: imds.InstanceIdentityDocument{Region: "us-east-1", AccountID: "123456789012"},
+		dynamic:  map[string]string{"instance-identity/document": raw},
+	}
+	p := newTestProcessor(t, client, "region")
+	p.EmitMetadataMetric = true
+	p.IncludeIdentityDocument = true
+	require.NoError(t, p.Init())
+
+	acc := &testutil.Accumulator{}
+	p.emitMetadataMetric(context.Background(), acc)
+	m := acc.GetTelegrafMetrics()[0]
+	require.Equal(t, map[string]interface{}{"region": "us-east-1", "identity_document": raw}, m.Fields())
+	require.Empty(t, m.Tags())
+
+	// The last document is kept if IMDS can't be reached.
+	acc.ClearMetrics()
+	client.err = errors.New("connection refused")
+	p.emitMetadataMetric(context.Background(), acc)
+	require.Equal(t, raw, acc.GetTelegrafMetrics()[0].Fields()["identity_document"])
+}
+
+func TestIncludeIdentityDocumentRequiresMetadataMetric(t *testing.T) {
+	p := newAwsIMDSProcessor()
+	p.Log = &testutil.Logger{}
+	p.ImdsTags = []string{"region"}
+	p.IncludeIdentityDocument = true
+	require.Error(t, p.Init())
+}
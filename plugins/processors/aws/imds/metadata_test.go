@@ -0,0 +1,242 @@
+package aws
+
+import (
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/feature/ec2/imds"
+	"github.com/influxdata/telegraf/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestScheduledMaintenance(t *testing.T) {
+	tests := []struct {
+		name     string
+		response string
+		expected map[string]string
+	}{
+		{
+			name:     "no events",
+			response: "[]",
+			expected: map[string]string{"scheduledMaintenance": "false"},
+		},
+		{
+			name: "scheduled event",
+			response: `[{
+				"NotBefore": "21 Jan 2019 09:00:43 GMT",
+				"Code": "system-reboot",
+				"Description": "scheduled reboot",
+				"EventId": "instance-event-0d59937288b749b32",
+				"NotAfter": "21 Jan 2019 09:17:23 GMT",
+				"State": "active"
+			}]`,
+			expected: map[string]string{
+				"scheduledMaintenance":     "true",
+				"scheduledMaintenanceCode": "system-reboot",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &mockIMDSClient{
+				metadata: map[string]string{"events/maintenance/scheduled": tt.response},
+			}
+			p := newTestProcessor(t, client, "scheduledMaintenance", "scheduledMaintenanceCode")
+
+			m := p.LookupIMDSTags(newTestMetric())
+			require.Equal(t, tt.expected, m.Tags())
+		})
+	}
+}
+
+func TestScheduledMaintenanceInvalidResponse(t *testing.T) {
+	client := &mockIMDSClient{
+		metadata: map[string]string{"events/maintenance/scheduled": "<html>"},
+	}
+	p := newTestProcessor(t, client, "scheduledMaintenance")
+
+	m := p.LookupIMDSTags(newTestMetric())
+	require.Empty(t, m.Tags())
+}
+
+func TestScheduledMaintenanceCacheTTL(t *testing.T) {
+	p := newTestProcessor(t, &mockIMDSClient{}, "region", "scheduledMaintenance")
+	require.Equal(t, time.Duration(p.CacheTTL), p.cacheTTL("region"))
+	require.Equal(t, maintenanceCacheTTL, p.cacheTTL("scheduledMaintenance"))
+}
+
+func TestReservationID(t *testing.T) {
+	client := &mockIMDSClient{metadata: map[string]string{"reservation-id": "r-0123456789abcdef0"}}
+	p := newTestProcessor(t, client, "reservationId")
+	require.Equal(t, time.Duration(p.CacheTTL), p.cacheTTL("reservationId"))
+
+	for i := 0; i < 2; i++ {
+		m := p.LookupIMDSTags(newTestMetric())
+		require.Equal(t, map[string]string{"reservationId": "r-0123456789abcdef0"}, m.Tags())
+	}
+	require.EqualValues(t, 1, client.calls)
+}
+
+func TestDetailedMonitoring(t *testing.T) {
+	client := &mockIMDSClient{dynamic: map[string]string{"fws/instance-monitoring": "disabled"}}
+	p := newTestProcessor(t, client, "detailedMonitoring")
+	require.Equal(t, time.Duration(p.CacheTTL), p.cacheTTL("detailedMonitoring"))
+	m := p.LookupIMDSTags(newTestMetric())
+	require.Equal(t, map[string]string{"detailedMonitoring": "disabled"}, m.Tags())
+
+	// Instances not reporting the state get no tag and aren't asked again.
+	client = &mockIMDSClient{}
+	p = newTestProcessor(t, client, "detailedMonitoring")
+	for i := 0; i < 3; i++ {
+		m := p.LookupIMDSTags(newTestMetric())
+		require.Empty(t, m.Tags())
+	}
+	require.EqualValues(t, 1, client.calls)
+}
+
+func TestMetadataAndDynamicPaths(t *testing.T) {
+	client := &mockIMDSClient{
+		document: imds.InstanceIdentityDocument{Region: "us-east-1"},
+		metadata: map[string]string{"placement/group-name": "cluster-a"},
+		dynamic:  map[string]string{"fws/instance-monitoring": "enabled"},
+	}
+	p := newAwsIMDSProcessor()
+	p.Log = &testutil.Logger{}
+	p.ImdsTags = []string{"region"}
+	p.MetadataPaths = map[string]string{"placementGroup": "placement/group-name"}
+	p.DynamicPaths = map[string]string{"monitoring": "fws/instance-monitoring"}
+	require.NoError(t, p.Init())
+	p.tagCache = newTagCache(p.TagCacheSize)
+	p.imdsClient = client
+
+	m := p.LookupIMDSTags(newTestMetric())
+	require.Equal(t, map[string]string{
+		"region":         "us-east-1",
+		"placementGroup": "cluster-a",
+		"monitoring":     "enabled",
+	}, m.Tags())
+
+	// Values are cached.
+	calls := client.calls
+	p.LookupIMDSTags(newTestMetric())
+	require.Equal(t, calls, client.calls)
+}
+
+func TestPathsInvalid(t *testing.T) {
+	for name, paths := range map[string]map[string]string{
+		"absolute path":  {"group": "/latest/meta-data/placement/group-name"},
+		"parent path":    {"group": "placement/../group-name"},
+		"empty path":     {"group": ""},
+		"spaces":         {"group": "placement/group name"},
+		"built-in tag":   {"region": "placement/region"},
+		"empty tag name": {"": "placement/region"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			p := newAwsIMDSProcessor()
+			p.Log = &testutil.Logger{}
+			p.MetadataPaths = paths
+			require.Error(t, p.Init())
+		})
+	}
+
+	p := newAwsIMDSProcessor()
+	p.Log = &testutil.Logger{}
+	p.MetadataPaths = map[string]string{"group": "placement/group-name"}
+	p.DynamicPaths = map[string]string{"group": "fws/instance-monitoring"}
+	require.Error(t, p.Init())
+}
+
+func TestIdentityDocumentField(t *testing.T) {
+	raw := `{"region" : "us-east-1", "instanceId" : "i-0123456789abcdef0"}`
+	client := &mockIMDSClient{
+		document: imds.InstanceIdentityDocument{Region: "us-east-1"},
+		dynamic:  map[string]string{"instance-identity/document": raw},
+	}
+
+	p := newTestProcessor(t, client, "region", "identity_document")
+	p.maxValueLength = 16
+	m := p.LookupIMDSTags(newTestMetric())
+	require.Equal(t, map[string]string{"region": "us-east-1"}, m.Tags())
+	v, ok := m.GetField("identity_document")
+	require.True(t, ok)
+	require.Equal(t, raw, v)
+
+	p = newTestProcessor(t, client, "identity_document")
+	p.IdentityDocumentAsTag = true
+	require.NoError(t, p.Init())
+	m = p.LookupIMDSTags(newTestMetric())
+	require.Equal(t, map[string]string{"identity_document": raw}, m.Tags())
+}
+
+func TestMetadataPathList(t *testing.T) {
+	const deep = "network/interfaces/macs/0e:12:34:56:78:9a/subnet-id"
+	tests := []struct {
+		strategy  string
+		separator string
+		expected  string
+	}{
+		{"basename", "_", "subnet-id"},
+		{"full_path_flattened", "_", "network_interfaces_macs_0e_12_34_56_78_9a_subnet-id"},
+		{"full_path_flattened", ".", "network.interfaces.macs.0e_12_34_56_78_9a.subnet-id"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.strategy+tt.separator, func(t *testing.T) {
+			client := &mockIMDSClient{metadata: map[string]string{deep: "subnet-0123"}}
+			p := newAwsIMDSProcessor()
+			p.Log = &testutil.Logger{}
+			p.MetadataPathList = []string{deep}
+			p.PathKeyStrategy = tt.strategy
+			p.PathKeySeparator = tt.separator
+			require.NoError(t, p.Init())
+			p.tagCache = newTagCache(p.TagCacheSize)
+			p.imdsClient = client
+
+			m := p.LookupIMDSTags(newTestMetric())
+			require.Equal(t, map[string]string{tt.expected: "subnet-0123"}, m.Tags())
+		})
+	}
+}
+
+func TestMetadataPathListInvalid(t *testing.T) {
+	for name, p := range map[string]*AwsIMDSProcessor{
+		"configured name": {MetadataPathList: []string{"placement/group-name"}},
+		"unknown strategy": {
+			MetadataPathList: []string{"placement/group-name"},
+			PathKeyStrategy:  "hash",
+		},
+		"invalid separator": {
+			MetadataPathList: []string{"placement/group-name"},
+			PathKeyStrategy:  "full_path_flattened",
+			PathKeySeparator: "/",
+		},
+		"invalid path": {
+			MetadataPathList: []string{"../user-data"},
+			PathKeyStrategy:  "basename",
+		},
+		"built-in tag": {
+			MetadataPathList: []string{"placement/region"},
+			PathKeyStrategy:  "basename",
+		},
+		"basename collision": {
+			MetadataPathList: []string{
+				"network/interfaces/macs/0e:12:34:56:78:9a/subnet-id",
+				"network/interfaces/macs/0e:12:34:56:78:9b/subnet-id",
+			},
+			PathKeyStrategy: "basename",
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			defaults := newAwsIMDSProcessor()
+			defaults.Log = &testutil.Logger{}
+			defaults.MetadataPathList = p.MetadataPathList
+			if p.PathKeyStrategy != "" {
+				defaults.PathKeyStrategy = p.PathKeyStrategy
+			}
+			if p.PathKeySeparator != "" {
+				defaults.PathKeySeparator = p.PathKeySeparator
+			}
+			require.Error(t, defaults.Init())
+		})
+	}
+}
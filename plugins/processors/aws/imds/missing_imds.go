@@ -0,0 +1,84 @@
+package aws
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/feature/ec2/imds"
+	"github.com/influxdata/telegraf"
+)
+
+// initStaticTags validates static_tags.
+func (r *AwsIMDSProcessor) initStaticTags(tc *tagConfig) error {
+	if len(r.StaticTags) > 0 && r.Strict {
+		return errors.New("static_tags requires strict = false")
+	}
+	for tag := range r.StaticTags {
+		if _, ok := tc.imdsTagsMap[tag]; !ok {
+			return fmt.Errorf("static_tags specified for tag not in imds_tags: %s", tag)
+		}
+	}
+	return nil
+}
+
+// usePersistedDocument falls back to the identity document persisted in
+// identity_cache_file if IMDS was unreachable at startup.
+func (r *AwsIMDSProcessor) usePersistedDocument(err error) (*imds.GetInstanceIdentityDocumentOutput, error) {
+	if r.IdentityCacheFile == "" {
+		return nil, fmt.Errorf("failed getting instance identity document: %w", err)
+	}
+	persisted, lerr := loadIdentityDocument(r.IdentityCacheFile)
+	if lerr != nil {
+		return nil, fmt.Errorf("failed getting instance identity document: %w (loading identity cache file failed: %v)", err, lerr)
+	}
+	r.Log.Warnf("Failed getting instance identity document, using %s until IMDS is reachable: %v", r.IdentityCacheFile, err)
+	r.persistedDocument = persisted
+	return persisted, nil
+}
+
+// addStaticTags adds static_tags to metrics while running without IMDS,
+// keyed and transformed like metadata values.
+func (r *AwsIMDSProcessor) addStaticTags(tc *tagConfig, metric telegraf.Metric) {
+	r.addTags(tc, metric, r.StaticTags)
+	if r.nodeName != "" {
+		metric.AddTag(r.NodeNameTag, r.nodeName)
+	}
+}
+
+// awaitIMDS retries the identity document while running without IMDS, with
+// the interval doubling up to MaxMissingRetryInterval. Once IMDS answers, the
+// lookups are prepared as at startup and metrics are enriched again.
+func (r *AwsIMDSProcessor) awaitIMDS(ctx context.Context, acc telegraf.Accumulator) {
+	interval := r.missingRetryInterval
+	timer := time.NewTimer(interval)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		}
+
+		iido, _, err := r.identityDocument(ctx, false)
+		if err != nil {
+			if interval *= 2; interval > MaxMissingRetryInterval {
+				interval = MaxMissingRetryInterval
+			}
+			r.logRoutinef("IMDS still unreachable, retrying in %s: %v", interval, err)
+			timer.Reset(interval)
+			continue
+		}
+
+		r.Log.Info("IMDS is reachable, enriching metrics")
+		if r.IdentityCacheFile != "" {
+			r.saveIdentityDocument(iido)
+		}
+		r.startIMDS(ctx, iido)
+		r.imdsMissing.Store(false)
+		r.startIMDSWorkers(ctx, acc)
+		return
+	}
+}
@@ -0,0 +1,101 @@
+package aws
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/influxdata/telegraf/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStrict(t *testing.T) {
+	server := newIMDSServer(t, "")
+
+	p := newAwsIMDSProcessor()
+	p.Log = &testutil.Logger{}
+	p.ImdsTags = []string{"region", "instanceId"}
+	p.NamingConvention = "otel"
+	p.Endpoint = server.URL
+	p.Strict = true
+	require.NoError(t, p.Init())
+	require.Error(t, p.Start(&testutil.Accumulator{}))
+
+	p.Strict = false
+	p.StaticTags = map[string]string{"region": "us-east-1"}
+	require.NoError(t, p.Init())
+	require.NoError(t, p.Start(&testutil.Accumulator{}))
+	defer p.Stop()
+
+	// Static values are keyed like metadata values.
+	out := p.asyncAdd(newTestMetric())
+	require.Len(t, out, 1)
+	require.Equal(t, map[string]string{"cloud.region": "us-east-1"}, out[0].Tags())
+}
+
+func TestStaticTagsOnlyWithoutIMDS(t *testing.T) {
+	client := &mockIMDSClient{}
+	client.document.Region = "eu-west-1"
+	p := newTestProcessor(t, client, "region")
+	p.StaticTags = map[string]string{"region": "us-east-1"}
+	require.NoError(t, p.Init())
+
+	out := p.asyncAdd(newTestMetric())
+	require.Len(t, out, 1)
+	require.Equal(t, map[string]string{"region": "eu-west-1"}, out[0].Tags())
+}
+
+func TestStaticTagsInvalid(t *testing.T) {
+	p := newAwsIMDSProcessor()
+	p.Log = &testutil.Logger{}
+	p.ImdsTags = []string{"region"}
+	p.StaticTags = map[string]string{"accountId": "123456789012"}
+	require.Error(t, p.Init())
+
+	p.Strict = true
+	p.StaticTags = map[string]string{"region": "us-east-1"}
+	require.Error(t, p.Init())
+}
+
+func TestMissingIMDSRecovers(t *testing.T) {
+	var reachable atomic.Bool
+	mux := http.NewServeMux()
+	mux.HandleFunc("/latest/api/token", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Aws-Ec2-Metadata-Token-Ttl-Seconds", "21600")
+		_, _ = w.Write([]byte("token"))
+	})
+	mux.HandleFunc("/latest/dynamic/instance-identity/document", func(w http.ResponseWriter, r *http.Request) {
+		if !reachable.Load() {
+			http.NotFound(w, r)
+			return
+		}
+		_, _ = w.Write([]byte(`{"instanceId": "i-0123456789abcdef0", "region": "eu-west-1"}`))
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	p := newAwsIMDSProcessor()
+	p.Log = &testutil.Logger{}
+	p.ImdsTags = []string{"region"}
+	p.Endpoint = server.URL
+	p.missingRetryInterval = 10 * time.Millisecond
+	require.NoError(t, p.Init())
+	require.NoError(t, p.Start(&testutil.Accumulator{}))
+	defer p.Stop()
+
+	// Metrics pass through untagged while IMDS is unreachable.
+	out := p.asyncAdd(newTestMetric())
+	require.Len(t, out, 1)
+	require.Empty(t, out[0].Tags())
+
+	reachable.Store(true)
+	require.Eventually(t, func() bool {
+		return !p.imdsMissing.Load()
+	}, 5*time.Second, 10*time.Millisecond)
+
+	out = p.asyncAdd(newTestMetric())
+	require.Len(t, out, 1)
+	require.Equal(t, map[string]string{"region": "eu-west-1"}, out[0].Tags())
+}
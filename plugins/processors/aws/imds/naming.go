@@ -0,0 +1,243 @@
+package aws
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// otelTagNames maps metadata tags onto OpenTelemetry resource semantic
+// convention attribute names. Tags without an equivalent keep their name.
+var otelTagNames = map[string]string{
+	"accountId":        "cloud.account.id",
+	"availabilityZone": "cloud.availability_zone",
+	"imageId":          "host.image.id",
+	"instanceId":       "host.id",
+	"instanceType":     "host.type",
+	"region":           "cloud.region",
+}
+
+// datadogTagNames maps metadata tags onto the host tag names used by the
+// Datadog AWS integration.
+var datadogTagNames = map[string]string{
+	"accountId":        "aws_account",
+	"availabilityZone": "availability-zone",
+	"imageId":          "image",
+	"instanceId":       "instance-id",
+	"instanceType":     "instance-type",
+	"kernelId":         "kernel",
+	"region":           "region",
+}
+
+// cloudwatchTagNames maps metadata tags onto the dimension names used by the
+// CloudWatch agent.
+var cloudwatchTagNames = map[string]string{
+	"imageId":      "ImageId",
+	"instanceId":   "InstanceId",
+	"instanceType": "InstanceType",
+}
+
+// cloudwatchMaxValueLength is the maximum length of CloudWatch dimension
+// values, enforced for the cloudwatch naming convention.
+const cloudwatchMaxValueLength = 1024
+
+// namingConventions holds the tag name mappings for each supported
+// naming_convention. The native convention uses the metadata tag names as-is.
+var namingConventions = map[string]map[string]string{
+	"":           nil,
+	"native":     nil,
+	"otel":       otelTagNames,
+	"datadog":    datadogTagNames,
+	"cloudwatch": cloudwatchTagNames,
+}
+
+// mergeStrategies lists the supported merge_strategy values.
+var mergeStrategies = map[string]bool{"first": true, "last": true, "error": true}
+
+// buildTagKeys computes the metric tag key for each configured metadata tag
+// without one. Tags keep the keys already assigned, so tags added later,
+// e.g. by a rescan of instance tags, can't take over the key of a known tag
+// when made unique.
+func (r *AwsIMDSProcessor) buildTagKeys(tc *tagConfig) error {
+	names, ok := namingConventions[r.NamingConvention]
+	if !ok {
+		return fmt.Errorf("invalid naming_convention: %s", r.NamingConvention)
+	}
+	switch r.NormalizeKeys {
+	case "", "none", "snake_case", "lower":
+	default:
+		return fmt.Errorf("invalid normalize_keys: %s", r.NormalizeKeys)
+	}
+
+	for tag, key := range r.TagRename {
+		if _, ok := tc.imdsTagsMap[tag]; !ok {
+			return fmt.Errorf("tag_rename specified for tag not in imds_tags: %s", tag)
+		}
+		if key == "" {
+			return fmt.Errorf("empty tag_rename for tag %s", tag)
+		}
+	}
+
+	tags := make([]string, 0, len(tc.imdsTagsMap))
+	for tag := range tc.imdsTagsMap {
+		tags = append(tags, tag)
+	}
+	sort.Strings(tags)
+
+	keys := make(map[string]string, len(tags))
+	used := make(map[string]bool, len(tags))
+	for tag, key := range tc.tagKeys {
+		keys[tag] = key
+		used[key] = true
+	}
+	for _, tag := range tags {
+		if _, ok := keys[tag]; ok {
+			continue
+		}
+		// Conflicting instance tags share the key of the tag they collide
+		// with, one of them being shadowed in keyedValues.
+		key, conflicting := tc.conflicts[tag]
+		if !conflicting {
+			key = tag
+		}
+		if name, ok := names[key]; ok {
+			key = name
+		}
+		switch r.NormalizeKeys {
+		case "snake_case":
+			key = toSnakeCase(key)
+		case "lower":
+			key = strings.ToLower(key)
+		}
+		// Explicit renames win over the naming convention and normalization.
+		if name, ok := r.TagRename[tag]; ok {
+			key = name
+		}
+		if r.SanitizeLabelNames {
+			key = sanitizeLabelName(key)
+			if !conflicting {
+				key = uniqueKey(key, used)
+			}
+		}
+		used[key] = true
+		keys[tag] = key
+	}
+	tc.tagKeys = keys
+	return r.orderTags(tc)
+}
+
+// orderTags sorts the configured tags by source precedence, i.e. identity
+// document tags before derived tags before meta-data tags, and by name within
+// a source. When several tags map onto the same key, merge_strategy decides
+// whether the first or last tag in this order with a value wins.
+func (r *AwsIMDSProcessor) orderTags(tc *tagConfig) error {
+	if !mergeStrategies[r.MergeStrategy] {
+		return fmt.Errorf("invalid merge_strategy: %s", r.MergeStrategy)
+	}
+
+	tc.tagOrder = make([]string, 0, len(tc.tagKeys))
+	for tag := range tc.tagKeys {
+		tc.tagOrder = append(tc.tagOrder, tag)
+	}
+	sort.Slice(tc.tagOrder, func(i, j int) bool {
+		a, b := tc.tagOrder[i], tc.tagOrder[j]
+		if r.tagSource(tc, a) != r.tagSource(tc, b) {
+			return r.tagSource(tc, a) < r.tagSource(tc, b)
+		}
+		return a < b
+	})
+
+	owners := make(map[string]string, len(tc.tagOrder))
+	for _, tag := range tc.tagOrder {
+		key := tc.tagKeys[tag]
+		if owner, ok := owners[key]; ok && r.MergeStrategy == "error" && tc.shadowed[owner] != tag && tc.shadowed[tag] != owner {
+			return fmt.Errorf("tags %s and %s both map to key %q", owner, tag, key)
+		}
+		owners[key] = tag
+	}
+	return nil
+}
+
+// derivedTags are computed from identity document fields.
+var derivedTags = map[string]struct{}{
+	"cpuArch":        {},
+	"failureDomain":  {},
+	"graviton":       {},
+	"regionName":     {},
+	"rootDeviceType": {},
+}
+
+// tagSource ranks a metadata tag by the source of its value.
+func (r *AwsIMDSProcessor) tagSource(tc *tagConfig, tag string) int {
+	if _, ok := tc.pathTags[tag]; ok {
+		return 2
+	}
+	if _, ok := derivedTags[tag]; ok || r.billingProductTag(tag) {
+		return 1
+	}
+	return 0
+}
+
+// toSnakeCase converts camelCase keys such as "availabilityZone" into
+// "availability_zone". Runs of capitals are treated as one word, so
+// "instanceID" becomes "instance_id".
+func toSnakeCase(key string) string {
+	runes := []rune(key)
+	var b strings.Builder
+	for i, c := range runes {
+		if unicode.IsUpper(c) && i > 0 {
+			prev := runes[i-1]
+			nextLower := i+1 < len(runes) && unicode.IsLower(runes[i+1])
+			if unicode.IsLower(prev) || unicode.IsDigit(prev) || (unicode.IsUpper(prev) && nextLower) {
+				b.WriteByte('_')
+			}
+		}
+		b.WriteRune(unicode.ToLower(c))
+	}
+	return b.String()
+}
+
+// sanitizeLabelName rewrites key into a valid Prometheus label name matching
+// [a-zA-Z_][a-zA-Z0-9_]*. Runs of invalid characters collapse into a single
+// underscore and a leading digit is prefixed with an underscore.
+func sanitizeLabelName(key string) string {
+	var b strings.Builder
+	lastInvalid := false
+	for _, c := range key {
+		switch {
+		case c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z'):
+		case c >= '0' && c <= '9':
+			if b.Len() == 0 {
+				b.WriteByte('_')
+			}
+		default:
+			if !lastInvalid {
+				b.WriteByte('_')
+			}
+			lastInvalid = true
+			continue
+		}
+		b.WriteRune(c)
+		lastInvalid = false
+	}
+	if b.Len() == 0 {
+		return "_"
+	}
+	return b.String()
+}
+
+// uniqueKey returns key, or key with the lowest numeric suffix starting at
+// 2 that is not yet used. Callers must visit keys in a deterministic order.
+func uniqueKey(key string, used map[string]bool) string {
+	if !used[key] {
+		return key
+	}
+	for i := 2; ; i++ {
+		candidate := key + "_" + strconv.Itoa(i)
+		if !used[candidate] {
+			return candidate
+		}
+	}
+}
@@ -0,0 +1,289 @@
+package aws
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/influxdata/telegraf/metric"
+	"github.com/influxdata/telegraf/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOtelNamingConvention(t *testing.T) {
+	p := newAwsIMDSProcessor()
+	p.Log = &testutil.Logger{}
+	p.ImdsTags = []string{
+		"accountId",
+		"architecture",
+		"availabilityZone",
+		"imageId",
+		"instanceId",
+		"instanceType",
+		"region",
+	}
+	p.NamingConvention = "otel"
+	require.NoError(t, p.Init())
+
+	expected := map[string]string{
+		"accountId":        "cloud.account.id",
+		"architecture":     "architecture",
+		"availabilityZone": "cloud.availability_zone",
+		"imageId":          "host.image.id",
+		"instanceId":       "host.id",
+		"instanceType":     "host.type",
+		"region":           "cloud.region",
+	}
+	for tag, key := range expected {
+		require.Equal(t, key, p.loadTags().tagKey(tag), tag)
+	}
+
+	p.tagCache = newTagCache(p.TagCacheSize)
+	p.setCached("region", "us-east-1", time.Now())
+	p.setCached("architecture", "arm64", time.Now())
+	tc := p.loadTags()
+	tc.imdsTagsMap = map[string]struct{}{"region": {}, "architecture": {}}
+	tc.lookupTags = tc.imdsTagsMap
+
+	m := metric.New("m", map[string]string{}, map[string]interface{}{"v": 1}, time.Unix(0, 0))
+	m = p.LookupIMDSTags(m)
+	require.Equal(t, map[string]string{"cloud.region": "us-east-1", "architecture": "arm64"}, m.Tags())
+}
+
+func TestInvalidNamingConvention(t *testing.T) {
+	p := newAwsIMDSProcessor()
+	p.Log = &testutil.Logger{}
+	p.ImdsTags = []string{"region"}
+	p.NamingConvention = "unknown"
+	require.Error(t, p.Init())
+}
+
+func TestSanitizeLabelName(t *testing.T) {
+	tests := []struct {
+		key      string
+		expected string
+	}{
+		{"region", "region"},
+		{"aws:autoscaling:groupName", "aws_autoscaling_groupName"},
+		{"cloud.account.id", "cloud_account_id"},
+		{"instance-type", "instance_type"},
+		{"a::b", "a_b"},
+		{"a.-b", "a_b"},
+		{"9lives", "_9lives"},
+		{"a9", "a9"},
+		{"", "_"},
+		{":", "_"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.key, func(t *testing.T) {
+			require.Equal(t, tt.expected, sanitizeLabelName(tt.key))
+		})
+	}
+}
+
+func TestSanitizeLabelNamesCollisions(t *testing.T) {
+	used := map[string]bool{}
+	var keys []string
+	for _, key := range []string{"a.b", "a-b", "a:b", "a_b_2"} {
+		k := uniqueKey(sanitizeLabelName(key), used)
+		used[k] = true
+		keys = append(keys, k)
+	}
+	require.Equal(t, []string{"a_b", "a_b_2", "a_b_3", "a_b_2_2"}, keys)
+
+	p := newAwsIMDSProcessor()
+	p.Log = &testutil.Logger{}
+	p.ImdsTags = []string{"region", "availabilityZone", "instanceId"}
+	p.NamingConvention = "otel"
+	p.SanitizeLabelNames = true
+	require.NoError(t, p.Init())
+	require.Equal(t, "cloud_region", p.loadTags().tagKey("region"))
+	require.Equal(t, "cloud_availability_zone", p.loadTags().tagKey("availabilityZone"))
+	require.Equal(t, "host_id", p.loadTags().tagKey("instanceId"))
+}
+
+func TestNormalizeKeys(t *testing.T) {
+	tests := []struct {
+		tag       string
+		snakeCase string
+		lower     string
+	}{
+		{"accountId", "account_id", "accountid"},
+		{"architecture", "architecture", "architecture"},
+		{"availabilityZone", "availability_zone", "availabilityzone"},
+		{"billingProducts", "billing_products", "billingproducts"},
+		{"imageId", "image_id", "imageid"},
+		{"instanceId", "instance_id", "instanceid"},
+		{"instanceType", "instance_type", "instancetype"},
+		{"kernelId", "kernel_id", "kernelid"},
+		{"pendingTime", "pending_time", "pendingtime"},
+		{"privateIp", "private_ip", "privateip"},
+		{"ramdiskId", "ramdisk_id", "ramdiskid"},
+		{"region", "region", "region"},
+		{"regionName", "region_name", "regionname"},
+		{"version", "version", "version"},
+		{"scheduledMaintenance", "scheduled_maintenance", "scheduledmaintenance"},
+		{"scheduledMaintenanceCode", "scheduled_maintenance_code", "scheduledmaintenancecode"},
+	}
+
+	tags := make([]string, 0, len(tests))
+	for _, tt := range tests {
+		tags = append(tags, tt.tag)
+	}
+
+	for _, mode := range []string{"none", "snake_case", "lower"} {
+		t.Run(mode, func(t *testing.T) {
+			p := newAwsIMDSProcessor()
+			p.Log = &testutil.Logger{}
+			p.ImdsTags = tags
+			p.NormalizeKeys = mode
+			require.NoError(t, p.Init())
+
+			for _, tt := range tests {
+				expected := tt.tag
+				switch mode {
+				case "snake_case":
+					expected = tt.snakeCase
+				case "lower":
+					expected = tt.lower
+				}
+				require.Equal(t, expected, p.loadTags().tagKey(tt.tag))
+			}
+		})
+	}
+}
+
+func TestToSnakeCase(t *testing.T) {
+	require.Equal(t, "instance_id", toSnakeCase("instanceID"))
+	require.Equal(t, "http_server_name", toSnakeCase("HTTPServerName"))
+	require.Equal(t, "ipv4_address", toSnakeCase("ipv4Address"))
+	require.Equal(t, "cloud.region", toSnakeCase("cloud.region"))
+}
+
+func TestNormalizeKeysAfterNamingConvention(t *testing.T) {
+	p := newAwsIMDSProcessor()
+	p.Log = &testutil.Logger{}
+	p.ImdsTags = []string{"region", "kernelId"}
+	p.NamingConvention = "otel"
+	p.NormalizeKeys = "snake_case"
+	require.NoError(t, p.Init())
+	require.Equal(t, "cloud.region", p.loadTags().tagKey("region"))
+	require.Equal(t, "kernel_id", p.loadTags().tagKey("kernelId"))
+}
+
+func TestMergeStrategy(t *testing.T) {
+	values := map[string]string{
+		"region":               "us-east-1",
+		"regionName":           "US East (N. Virginia)",
+		"scheduledMaintenance": "false",
+	}
+
+	tests := []struct {
+		strategy string
+		expected string
+	}{
+		{"first", "us-east-1"},
+		{"last", "false"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.strategy, func(t *testing.T) {
+			p := newAwsIMDSProcessor()
+			p.Log = &testutil.Logger{}
+			p.ImdsTags = []string{"scheduledMaintenance", "regionName", "region"}
+			p.MergeStrategy = tt.strategy
+			require.NoError(t, p.Init())
+
+			// None of the built-in names collide, so map all tags onto one key.
+			tc := p.loadTags()
+			for tag := range tc.tagKeys {
+				tc.tagKeys[tag] = "location"
+			}
+			require.NoError(t, p.orderTags(tc))
+			require.Equal(t, []string{"region", "regionName", "scheduledMaintenance"}, tc.tagOrder)
+
+			m := metric.New("m", map[string]string{}, map[string]interface{}{"v": 1}, time.Unix(0, 0))
+			p.addTags(tc, m, values)
+			require.Equal(t, map[string]string{"location": tt.expected}, m.Tags())
+
+			// Tags without a value don't take part in the merge.
+			m = metric.New("m", map[string]string{}, map[string]interface{}{"v": 1}, time.Unix(0, 0))
+			p.addTags(tc, m, map[string]string{"regionName": "US East (N. Virginia)"})
+			require.Equal(t, map[string]string{"location": "US East (N. Virginia)"}, m.Tags())
+		})
+	}
+}
+
+func TestMergeStrategyError(t *testing.T) {
+	p := newAwsIMDSProcessor()
+	p.Log = &testutil.Logger{}
+	p.ImdsTags = []string{"region", "regionName"}
+	p.MergeStrategy = "error"
+	require.NoError(t, p.Init())
+
+	tc := p.loadTags()
+	tc.tagKeys["regionName"] = "region"
+	require.ErrorContains(t, p.orderTags(tc), `tags region and regionName both map to key "region"`)
+
+	p.MergeStrategy = "unknown"
+	require.Error(t, p.Init())
+}
+
+func TestDatadogNamingConventionWithRename(t *testing.T) {
+	p := newAwsIMDSProcessor()
+	p.Log = &testutil.Logger{}
+	p.ImdsTags = []string{"accountId", "availabilityZone", "instanceType", "region", "architecture"}
+	p.NamingConvention = "datadog"
+	p.NormalizeKeys = "snake_case"
+	p.TagRename = map[string]string{"instanceType": "InstanceType", "architecture": "arch"}
+	require.NoError(t, p.Init())
+
+	expected := map[string]string{
+		"accountId":        "aws_account",
+		"availabilityZone": "availability-zone",
+		"instanceType":     "InstanceType",
+		"region":           "region",
+		"architecture":     "arch",
+	}
+	for tag, key := range expected {
+		require.Equal(t, key, p.loadTags().tagKey(tag), tag)
+	}
+}
+
+func TestTagRenameUnknownTag(t *testing.T) {
+	p := newAwsIMDSProcessor()
+	p.Log = &testutil.Logger{}
+	p.ImdsTags = []string{"region"}
+	p.TagRename = map[string]string{"accountId": "account"}
+	require.Error(t, p.Init())
+}
+
+func TestCloudWatchNamingConvention(t *testing.T) {
+	p := newAwsIMDSProcessor()
+	p.Log = &testutil.Logger{}
+	p.ImdsTags = []string{"imageId", "instanceId", "instanceType", "region"}
+	p.NamingConvention = "cloudwatch"
+	require.NoError(t, p.Init())
+	require.Zero(t, p.MaxValueLength)
+
+	require.Equal(t, "ImageId", p.loadTags().tagKey("imageId"))
+	require.Equal(t, "InstanceId", p.loadTags().tagKey("instanceId"))
+	require.Equal(t, "InstanceType", p.loadTags().tagKey("instanceType"))
+	require.Equal(t, "region", p.loadTags().tagKey("region"))
+
+	m := metric.New("m", map[string]string{}, map[string]interface{}{"v": 1}, time.Unix(0, 0))
+	p.addTags(p.loadTags(), m, map[string]string{"instanceId": strings.Repeat("i", 2000)})
+	v, ok := m.GetTag("InstanceId")
+	require.True(t, ok)
+	require.Len(t, v, cloudwatchMaxValueLength)
+
+	// Lower limits are kept.
+	p = newAwsIMDSProcessor()
+	p.Log = &testutil.Logger{}
+	p.ImdsTags = []string{"instanceId"}
+	p.NamingConvention = "cloudwatch"
+	p.MaxValueLength = 64
+	require.NoError(t, p.Init())
+	require.Equal(t, 64, p.maxValueLength)
+}
@@ -0,0 +1,199 @@
+package aws
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/influxdata/telegraf"
+)
+
+// predicate is a parsed enrich_when expression. It is a disjunction of
+// conjunctions, i.e. "a > 1 && b < 2 || c == 3" is stored as
+// [[a > 1, b < 2], [c == 3]]. && binds tighter than ||.
+type predicate [][]comparison
+
+type comparison struct {
+	field string
+	op    string
+	value interface{}
+}
+
+var comparisonOperators = []string{"==", "!=", ">=", "<=", ">", "<"}
+
+// parsePredicate parses a small comparison grammar of the form
+//
+//	expr       = conjunction { "||" conjunction }
+//	conjunction = comparison { "&&" comparison }
+//	comparison = field op literal
+//	op         = "==" | "!=" | ">" | ">=" | "<" | "<="
+//	literal    = number | "quoted string" | true | false
+func parsePredicate(expr string) (predicate, error) {
+	if strings.TrimSpace(expr) == "" {
+		return nil, errors.New("empty expression")
+	}
+
+	var p predicate
+	for _, or := range splitUnquoted(expr, "||") {
+		var conjunction []comparison
+		for _, and := range splitUnquoted(or, "&&") {
+			c, err := parseComparison(strings.TrimSpace(and))
+			if err != nil {
+				return nil, err
+			}
+			conjunction = append(conjunction, c)
+		}
+		p = append(p, conjunction)
+	}
+	return p, nil
+}
+
+// splitUnquoted splits s around each instance of sep outside of quoted string
+// literals.
+func splitUnquoted(s, sep string) []string {
+	var parts []string
+	var quoted, escaped bool
+	start := 0
+	for i := 0; i < len(s); i++ {
+		switch {
+		case escaped:
+			escaped = false
+		case quoted && s[i] == '\\':
+			escaped = true
+		case s[i] == '"':
+			quoted = !quoted
+		case !quoted && strings.HasPrefix(s[i:], sep):
+			parts = append(parts, s[start:i])
+			start = i + len(sep)
+			i += len(sep) - 1
+		}
+	}
+	return append(parts, s[start:])
+}
+
+func parseComparison(s string) (comparison, error) {
+	end := strings.IndexFunc(s, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '_' && r != '.' && r != '-'
+	})
+	if end <= 0 {
+		return comparison{}, fmt.Errorf("expected field name in %q", s)
+	}
+	field := s[:end]
+	rest := strings.TrimSpace(s[end:])
+
+	var op string
+	for _, candidate := range comparisonOperators {
+		if strings.HasPrefix(rest, candidate) {
+			op = candidate
+			break
+		}
+	}
+	if op == "" {
+		return comparison{}, fmt.Errorf("expected comparison operator in %q", s)
+	}
+
+	literal := strings.TrimSpace(rest[len(op):])
+	value, err := parseLiteral(literal)
+	if err != nil {
+		return comparison{}, err
+	}
+
+	switch value.(type) {
+	case string, bool:
+		if op != "==" && op != "!=" {
+			return comparison{}, fmt.Errorf("operator %q not supported for %q", op, literal)
+		}
+	}
+
+	return comparison{field: field, op: op, value: value}, nil
+}
+
+func parseLiteral(s string) (interface{}, error) {
+	switch {
+	case s == "":
+		return nil, errors.New("expected value after operator")
+	case s == "true" || s == "false":
+		return s == "true", nil
+	case strings.HasPrefix(s, `"`):
+		v, err := strconv.Unquote(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid string literal %s", s)
+		}
+		return v, nil
+	}
+
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid value %q", s)
+	}
+	return v, nil
+}
+
+// match reports whether the metric's fields satisfy the predicate. Comparisons
+// against missing fields or fields of a different type are false.
+func (p predicate) match(metric telegraf.Metric) bool {
+	for _, conjunction := range p {
+		matched := true
+		for _, c := range conjunction {
+			if !c.match(metric) {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return true
+		}
+	}
+	return false
+}
+
+func (c comparison) match(metric telegraf.Metric) bool {
+	fv, ok := metric.GetField(c.field)
+	if !ok {
+		return false
+	}
+
+	switch want := c.value.(type) {
+	case float64:
+		got, ok := toFloat(fv)
+		if !ok {
+			return false
+		}
+		switch c.op {
+		case "==":
+			return got == want
+		case "!=":
+			return got != want
+		case ">":
+			return got > want
+		case ">=":
+			return got >= want
+		case "<":
+			return got < want
+		case "<=":
+			return got <= want
+		}
+	case string:
+		got, ok := fv.(string)
+		return ok && (got == want) == (c.op == "==")
+	case bool:
+		got, ok := fv.(bool)
+		return ok && (got == want) == (c.op == "==")
+	}
+	return false
+}
+
+func toFloat(v interface{}) (float64, bool) {
+	switch v := v.(type) {
+	case float64:
+		return v, true
+	case int64:
+		return float64(v), true
+	case uint64:
+		return float64(v), true
+	default:
+		return 0, false
+	}
+}
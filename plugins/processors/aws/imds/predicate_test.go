@@ -0,0 +1,83 @@
+package aws
+
+import (
+	"testing"
+	"time"
+
+	"github.com/influxdata/telegraf/metric"
+	"github.com/influxdata/telegraf/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPredicateMatch(t *testing.T) {
+	m := metric.New("cpu",
+		map[string]string{},
+		map[string]interface{}{
+			"usage_user": 85.5,
+			"count":      int64(3),
+			"state":      "running",
+			"command":    "a && b || c",
+			"healthy":    true,
+		},
+		time.Unix(0, 0),
+	)
+
+	tests := []struct {
+		expr     string
+		expected bool
+	}{
+		{`usage_user > 80`, true},
+		{`usage_user <= 80`, false},
+		{`count == 3`, true},
+		{`count != 3`, false},
+		{`state == "running"`, true},
+		{`state != "running"`, false},
+		{`healthy == true`, true},
+		{`missing > 1`, false},
+		{`state > 1`, false},
+		{`usage_user > 90 && count == 3`, false},
+		{`usage_user > 90 || count == 3`, true},
+		{`usage_user > 80 && count >= 3 || missing == 1`, true},
+		{`command == "a && b || c"`, true},
+		{`command != "a && b || c" || state == "\"||\""`, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			p, err := parsePredicate(tt.expr)
+			require.NoError(t, err)
+			require.Equal(t, tt.expected, p.match(m))
+		})
+	}
+}
+
+func TestPredicateInvalid(t *testing.T) {
+	for _, expr := range []string{
+		``,
+		`> 80`,
+		`cpu 80`,
+		`cpu >`,
+		`cpu > abc`,
+		`state > "running"`,
+		`cpu > 80 &&`,
+		`state == "running && count > 1`,
+	} {
+		t.Run(expr, func(t *testing.T) {
+			_, err := parsePredicate(expr)
+			require.Error(t, err)
+		})
+	}
+}
+
+func TestEnrichWhenPassesThroughNonMatching(t *testing.T) {
+	p := newAwsIMDSProcessor()
+	p.Log = &testutil.Logger{}
+	p.ImdsTags = []string{"region"}
+	p.EnrichWhen = "usage_user > 80"
+	require.NoError(t, p.Init())
+
+	m := metric.New("cpu", map[string]string{}, map[string]interface{}{"usage_user": 10.0}, time.Unix(0, 0))
+	out := p.asyncAdd(m)
+	require.Len(t, out, 1)
+	require.Empty(t, out[0].TagList())
+}
@@ -0,0 +1,90 @@
+package aws
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// prewarmGroups splits the configured tags into the groups resolved
+// together when warming the cache: all tags not read from a path of their
+// own, which mostly share the identity document, and each path tag.
+func (r *AwsIMDSProcessor) prewarmGroups(tc *tagConfig) []map[string]struct{} {
+	base := make(map[string]struct{})
+	var paths []string
+	for _, tags := range []map[string]struct{}{tc.imdsTagsMap, tc.lookupTags} {
+		for tag := range tags {
+			if _, ok := tc.pathTags[tag]; ok {
+				paths = append(paths, tag)
+			} else {
+				base[tag] = struct{}{}
+			}
+		}
+	}
+	sort.Strings(paths)
+
+	var groups []map[string]struct{}
+	if len(base) > 0 {
+		groups = append(groups, base)
+	}
+	for i, tag := range paths {
+		if i > 0 && paths[i-1] == tag {
+			continue
+		}
+		groups = append(groups, map[string]struct{}{tag: {}})
+	}
+	return groups
+}
+
+// prewarm resolves all configured tags, including metadata paths and
+// instance tags, to fill the cache before the first metrics arrive. The
+// groups of prewarmGroups are resolved concurrently, at most
+// max_parallel_calls at a time. Tags failing to resolve are logged and
+// looked up again on use; failed required tags are logged as errors.
+func (r *AwsIMDSProcessor) prewarm(ctx context.Context) {
+	tc := r.loadTags()
+	groups := r.prewarmGroups(tc)
+	if len(groups) == 0 {
+		return
+	}
+
+	limit := r.MaxParallelCalls
+	if limit < 1 {
+		limit = 1
+	}
+	sem := make(chan struct{}, limit)
+	var mu sync.Mutex
+	var failed []string
+	var total int
+	var wg sync.WaitGroup
+	for _, tags := range groups {
+		total += len(tags)
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(tags map[string]struct{}) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			_, f := r.resolveTags(ctx, tc, tags, false)
+			if len(f) > 0 {
+				mu.Lock()
+				failed = append(failed, f...)
+				mu.Unlock()
+			}
+		}(tags)
+	}
+	wg.Wait()
+
+	if len(failed) == 0 {
+		r.logRoutinef("Warmed the cache with all %d tags", total)
+		return
+	}
+	sort.Strings(failed)
+	if r.requiredFailed(failed) {
+		r.Log.Errorf("Warmed the cache with %d of %d tags, failed: %s",
+			total-len(failed), total, strings.Join(failed, ", "))
+		return
+	}
+	r.Log.Warnf("Warmed the cache with %d of %d tags, failed: %s",
+		total-len(failed), total, strings.Join(failed, ", "))
+}
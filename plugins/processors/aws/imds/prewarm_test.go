@@ -0,0 +1,60 @@
+package aws
+
+import (
+	"context"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/feature/ec2/imds"
+	"github.com/influxdata/telegraf/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPrewarm(t *testing.T) {
+	client := &mockIMDSClient{
+		document: imds.InstanceIdentityDocument{Region: "us-east-1", InstanceType: "m5.large"},
+		metadata: map[string]string{
+			"iam/info":           `{"Code": "Success"}`,
+			"mac":                "0e:12:34:56:78:9a",
+			"tags/instance/Name": "web-1",
+		},
+		dynamic: map[string]string{"fws/instance-monitoring": "disabled"},
+	}
+	p := newAwsIMDSProcessor()
+	p.Log = &testutil.Logger{}
+	p.ImdsTags = []string{"region", "instanceType"}
+	p.InstanceTags = []string{"Name"}
+	p.MetadataPaths = map[string]string{
+		"iamInfo": "iam/info",
+		"mac":     "mac",
+		"missing": "does/not/exist",
+	}
+	p.DynamicPaths = map[string]string{"monitoring": "fws/instance-monitoring"}
+	p.NegativeCacheTTL = 0
+	p.MaxParallelCalls = 2
+	require.NoError(t, p.Init())
+	p.tagCache = newTagCache(p.TagCacheSize)
+	p.imdsClient = client
+
+	// The failing path doesn't fail warming the cache.
+	p.prewarm(context.Background())
+	for tag, expected := range map[string]string{
+		"region":       "us-east-1",
+		"instanceType": "m5.large",
+		"iamInfo":      `{"Code": "Success"}`,
+		"mac":          "0e:12:34:56:78:9a",
+		"monitoring":   "disabled",
+	} {
+		e, ok := p.getCached(tag)
+		require.True(t, ok, tag)
+		require.Equal(t, expected, e.value)
+	}
+	_, ok := p.getCached("missing")
+	require.False(t, ok)
+
+	// The first metric needs no further request.
+	calls := client.calls
+	m := p.LookupIMDSTags(newTestMetric())
+	require.Equal(t, "us-east-1", m.Tags()["region"])
+	require.Equal(t, "web-1", m.Tags()["Name"])
+	require.Equal(t, calls+1, client.calls, "only the missing path is looked up again")
+}
@@ -0,0 +1,40 @@
+package aws
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// rawFieldPattern matches the keys of identity document fields, e.g.
+// "marketplaceProductCodes".
+var rawFieldPattern = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9]*$`)
+
+// isRawExtraField reports whether the tag names an identity document field
+// unknown to the SDK, which raw_extra_fields reads from the raw document.
+func (r *AwsIMDSProcessor) isRawExtraField(tag string) bool {
+	return r.RawExtraFields && !isIMDSTagAllowed(tag) && rawFieldPattern.MatchString(tag)
+}
+
+// initRawExtraFields adds a path tag for each field of imds_tags unknown to
+// the SDK, selecting the field of the same name from the raw identity
+// document. Known fields are still taken from the document parsed by the
+// SDK, so the raw document only fills in what the SDK lacks, e.g. fields
+// added by a new document version. A field missing from the document is an
+// empty value.
+func (r *AwsIMDSProcessor) initRawExtraFields(tc *tagConfig) error {
+	for _, tag := range r.ImdsTags {
+		if !r.isRawExtraField(tag) {
+			continue
+		}
+		if _, ok := tc.pathTags[tag]; ok {
+			return fmt.Errorf("raw identity document field %s also configured as a path tag", tag)
+		}
+		tc.pathTags[tag] = metadataTag{
+			path:       identityDocumentPath,
+			dynamic:    true,
+			parse:      jsonQuery{tag}.apply,
+			cacheEmpty: true,
+		}
+	}
+	return nil
+}
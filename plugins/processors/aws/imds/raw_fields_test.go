@@ -0,0 +1,45 @@
+package aws
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/feature/ec2/imds"
+	"github.com/influxdata/telegraf/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRawExtraFields(t *testing.T) {
+	client := &mockIMDSClient{
+		document: imds.InstanceIdentityDocument{Region: "eu-west-1"},
+		dynamic: map[string]string{
+			"instance-identity/document": `{"region": "raw", "capacityType": "on-demand", "coreCount": 4, "extra": {"a": 1}}`,
+		},
+	}
+	p := newAwsIMDSProcessor()
+	p.Log = &testutil.Logger{}
+	p.ImdsTags = []string{"region", "capacityType", "coreCount", "extra", "missingField"}
+	p.RawExtraFields = true
+	require.NoError(t, p.Init())
+	p.tagCache = newTagCache(p.TagCacheSize)
+	p.imdsClient = client
+
+	// Known fields come from the SDK, unknown ones from the raw document.
+	m := p.LookupIMDSTags(newTestMetric())
+	require.Equal(t, map[string]string{
+		"region":       "eu-west-1",
+		"capacityType": "on-demand",
+		"coreCount":    "4",
+		"extra":        `{"a":1}`,
+	}, m.Tags())
+}
+
+func TestRawExtraFieldsDisabled(t *testing.T) {
+	p := newAwsIMDSProcessor()
+	p.Log = &testutil.Logger{}
+	p.ImdsTags = []string{"region", "capacityType"}
+	require.Error(t, p.Init())
+
+	p.RawExtraFields = true
+	p.ImdsTags = []string{"region", "capacity/type"}
+	require.Error(t, p.Init())
+}
@@ -0,0 +1,106 @@
+package aws
+
+import (
+	"context"
+	"time"
+)
+
+// refreshRetry tracks a tag whose refresh failed.
+type refreshRetry struct {
+	streak int
+	next   time.Time
+}
+
+// refreshCheckInterval returns how often to look for entries to refresh: a
+// fraction of refresh_ahead, so entries are refreshed well before expiring.
+func refreshCheckInterval(ahead time.Duration) time.Duration {
+	interval := ahead / 4
+	if interval < time.Second {
+		return time.Second
+	}
+	if interval > time.Minute {
+		return time.Minute
+	}
+	return interval
+}
+
+// refreshPeriodically fetches cached values again once they expire within
+// refresh_ahead, so metrics don't wait for IMDS when the values expire.
+func (r *AwsIMDSProcessor) refreshPeriodically(ctx context.Context) {
+	interval := refreshCheckInterval(time.Duration(r.RefreshAhead))
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	retries := make(map[string]*refreshRetry)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			r.refreshExpiring(ctx, retries, interval)
+		}
+	}
+}
+
+// refreshExpiring refreshes the configured tags expiring within
+// refresh_ahead. If a refresh fails, the old value is kept for another
+// retry interval, which starts at interval and doubles with every further
+// failure up to refresh_ahead.
+func (r *AwsIMDSProcessor) refreshExpiring(ctx context.Context, retries map[string]*refreshRetry, interval time.Duration) {
+	tc := r.loadTags()
+	now := time.Now()
+	ahead := time.Duration(r.RefreshAhead)
+	due := make(map[string]struct{})
+	old := make(map[string]cacheEntry)
+	it := r.tagCache.NewIterator()
+	for entry := it.Next(); entry != nil; entry = it.Next() {
+		tag := string(entry.Key)
+		if _, ok := tc.imdsTagsMap[tag]; !ok {
+			continue
+		}
+		if retry, ok := retries[tag]; ok && now.Before(retry.next) {
+			continue
+		}
+		ttl, err := r.tagCache.TTL(entry.Key)
+		if err != nil || ttl == 0 || time.Duration(ttl)*time.Second > ahead {
+			continue
+		}
+		e, err := decodeCacheEntry(entry.Value)
+		if err != nil {
+			continue
+		}
+		due[tag] = struct{}{}
+		old[tag] = e
+	}
+	if len(due) == 0 {
+		return
+	}
+
+	_, failed := r.resolveTags(ctx, tc, due, true)
+	for _, tag := range failed {
+		retry, ok := retries[tag]
+		if !ok {
+			retry = &refreshRetry{}
+			retries[tag] = retry
+		}
+		backoff := interval
+		for i := 0; i < retry.streak && backoff < ahead; i++ {
+			backoff *= 2
+		}
+		if backoff > ahead {
+			backoff = ahead
+		}
+		retry.streak++
+		retry.next = now.Add(backoff)
+
+		// Keep serving the old value until the next retry.
+		expiration := int((backoff + interval).Seconds())
+		if err := r.setCacheEntry(tag, old[tag], expiration); err != nil {
+			r.Log.Errorf("Error when extending IMDS tag cache value: %v", err)
+		}
+		delete(due, tag)
+	}
+	for tag := range due {
+		delete(retries, tag)
+	}
+}
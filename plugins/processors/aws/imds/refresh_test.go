@@ -0,0 +1,69 @@
+package aws
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/feature/ec2/imds"
+	"github.com/influxdata/telegraf/config"
+	"github.com/influxdata/telegraf/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRefreshExpiring(t *testing.T) {
+	client := &mockIMDSClient{document: imds.InstanceIdentityDocument{Region: "us-west-2", InstanceType: "m5.large"}}
+	p := newAwsIMDSProcessor()
+	p.Log = &testutil.Logger{}
+	p.ImdsTags = []string{"region", "instanceType"}
+	p.CacheTTL = config.Duration(time.Hour)
+	p.CacheTTLOverrides = map[string]config.Duration{"region": config.Duration(30 * time.Second)}
+	p.RefreshAhead = config.Duration(time.Minute)
+	require.NoError(t, p.Init())
+	p.tagCache = newTagCache(p.TagCacheSize)
+	p.imdsClient = client
+
+	p.setCached("region", "us-east-1", time.Now())
+	p.setCached("instanceType", "m5.large", time.Now())
+	retries := make(map[string]*refreshRetry)
+
+	// Only region expires within refresh_ahead and is refreshed.
+	p.refreshExpiring(context.Background(), retries, time.Second)
+	require.EqualValues(t, 1, client.calls)
+	e, ok := p.getCached("region")
+	require.True(t, ok)
+	require.Equal(t, "us-west-2", e.value)
+	require.Empty(t, retries)
+
+	// A failed refresh keeps the old value until the retry.
+	client.err = errors.New("connection refused")
+	p.refreshExpiring(context.Background(), retries, time.Second)
+	e, ok = p.getCached("region")
+	require.True(t, ok)
+	require.Equal(t, "us-west-2", e.value)
+	require.Contains(t, retries, "region")
+	ttl, err := p.tagCache.TTL([]byte("region"))
+	require.NoError(t, err)
+	require.LessOrEqual(t, ttl, uint32(2))
+
+	// No retry before the backoff passed.
+	calls := client.calls
+	p.refreshExpiring(context.Background(), retries, time.Second)
+	require.Equal(t, calls, client.calls)
+
+	// The retry succeeds once IMDS recovers.
+	client.err = nil
+	retries["region"].next = time.Now()
+	p.refreshExpiring(context.Background(), retries, time.Second)
+	require.Empty(t, retries)
+}
+
+func TestRefreshAheadInvalid(t *testing.T) {
+	p := newAwsIMDSProcessor()
+	p.Log = &testutil.Logger{}
+	p.ImdsTags = []string{"region"}
+	p.RefreshAhead = config.Duration(time.Minute)
+	p.DisableCache = true
+	require.Error(t, p.Init())
+}
@@ -0,0 +1,93 @@
+package aws
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/aws/aws-sdk-go-v2/feature/ec2/imds"
+)
+
+// regionPlacementPath is the meta-data path of the instance's region.
+const regionPlacementPath = "placement/region"
+
+var regionSources = map[string]struct{}{
+	"identity_document": {},
+	"placement":         {},
+	"aws_config":        {},
+	"env":               {},
+}
+
+// initRegionSources validates region_sources. The region tags are only
+// resolved separately from the identity document if other sources are
+// configured.
+func (r *AwsIMDSProcessor) initRegionSources() error {
+	if len(r.RegionSources) == 0 {
+		return errors.New("region_sources must not be empty")
+	}
+	seen := make(map[string]struct{}, len(r.RegionSources))
+	for _, source := range r.RegionSources {
+		if _, ok := regionSources[source]; !ok {
+			return fmt.Errorf("invalid region source: %s", source)
+		}
+		if _, ok := seen[source]; ok {
+			return fmt.Errorf("duplicate region source: %s", source)
+		}
+		seen[source] = struct{}{}
+	}
+	r.regionFallback = len(r.RegionSources) > 1 || r.RegionSources[0] != "identity_document"
+	return nil
+}
+
+// isRegionTag reports whether the tag is derived from the region.
+func isRegionTag(tag string) bool {
+	return tag == "region" || tag == "regionName"
+}
+
+// resolveRegion returns the region reported by the first of region_sources
+// providing one, and whether IMDS reported it. document is the identity
+// document if already fetched; it is fetched if nil and fetchDocument is set.
+// The regions of aws_config, env and the persisted identity document are
+// fallbacks which shouldn't be cached in place of the one reported by IMDS.
+func (r *AwsIMDSProcessor) resolveRegion(
+	ctx context.Context,
+	document *imds.GetInstanceIdentityDocumentOutput,
+	fetchDocument bool,
+) (string, bool) {
+	for _, source := range r.RegionSources {
+		var region string
+		var fromIMDS bool
+		switch source {
+		case "identity_document":
+			if document == nil && fetchDocument {
+				iido, _, err := r.identityDocument(ctx, false)
+				if err == nil {
+					document = iido
+				} else {
+					r.Log.Debugf("Error when getting region from identity document: %v", err)
+					document = r.fallbackIdentityDocument()
+				}
+			}
+			if document != nil {
+				region = document.Region
+				fromIMDS = document != r.fallbackIdentityDocument()
+			}
+		case "placement":
+			v, err := r.getMetadata(ctx, regionPlacementPath)
+			if err != nil {
+				r.Log.Debugf("Error when getting region from %s: %v", regionPlacementPath, err)
+			}
+			region = v
+			fromIMDS = true
+		case "aws_config":
+			region = r.configRegion
+		case "env":
+			region = os.Getenv("AWS_REGION")
+		}
+		if region != "" {
+			return region, fromIMDS
+		}
+	}
+	return "", false
+}
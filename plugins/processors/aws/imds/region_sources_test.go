@@ -0,0 +1,121 @@
+package aws
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/feature/ec2/imds"
+	"github.com/influxdata/telegraf/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRegionSources(t *testing.T) {
+	t.Setenv("AWS_REGION", "eu-west-1")
+
+	tests := []struct {
+		name     string
+		client   *mockIMDSClient
+		sources  []string
+		config   string
+		expected string
+	}{
+		{
+			name: "identity document",
+			client: &mockIMDSClient{
+				document: imds.InstanceIdentityDocument{Region: "us-east-1"},
+				metadata: map[string]string{"placement/region": "us-west-2"},
+			},
+			sources:  []string{"identity_document", "placement", "aws_config", "env"},
+			expected: "us-east-1",
+		},
+		{
+			name: "placement",
+			client: &mockIMDSClient{
+				metadata: map[string]string{"placement/region": "us-west-2"},
+			},
+			sources:  []string{"identity_document", "placement", "aws_config", "env"},
+			expected: "us-west-2",
+		},
+		{
+			name:     "aws config",
+			client:   &mockIMDSClient{err: errors.New("connection refused")},
+			sources:  []string{"identity_document", "placement", "aws_config", "env"},
+			config:   "ap-south-1",
+			expected: "ap-south-1",
+		},
+		{
+			name:     "env",
+			client:   &mockIMDSClient{err: errors.New("connection refused")},
+			sources:  []string{"identity_document", "placement", "aws_config", "env"},
+			expected: "eu-west-1",
+		},
+		{
+			name: "priority",
+			client: &mockIMDSClient{
+				document: imds.InstanceIdentityDocument{Region: "us-east-1"},
+			},
+			sources:  []string{"env", "identity_document"},
+			expected: "eu-west-1",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newTestProcessor(t, tt.client, "region", "regionName")
+			p.RegionSources = tt.sources
+			require.NoError(t, p.Init())
+			p.configRegion = tt.config
+
+			m := p.LookupIMDSTags(newTestMetric())
+			require.Equal(t, map[string]string{
+				"region":     tt.expected,
+				"regionName": p.regionName(tt.expected),
+			}, m.Tags())
+		})
+	}
+}
+
+func TestRegionSourcesUnresolved(t *testing.T) {
+	client := &mockIMDSClient{err: errors.New("connection refused")}
+	p := newTestProcessor(t, client, "region")
+	p.RegionSources = []string{"identity_document", "aws_config"}
+	require.NoError(t, p.Init())
+
+	failed := p.enrich(p.loadTags(), newTestMetric(), false)
+	require.Equal(t, []string{"region"}, failed)
+}
+
+func TestRegionSourcesFallbackNotCached(t *testing.T) {
+	t.Setenv("AWS_REGION", "eu-west-1")
+	client := &mockIMDSClient{err: errors.New("connection refused")}
+	p := newTestProcessor(t, client, "region")
+	p.RegionSources = []string{"identity_document", "env"}
+	p.CacheTTL = 0
+	require.NoError(t, p.Init())
+
+	m := p.LookupIMDSTags(newTestMetric())
+	require.Equal(t, map[string]string{"region": "eu-west-1"}, m.Tags())
+	_, ok := p.getCached("region")
+	require.False(t, ok)
+
+	// Once IMDS recovers, its region replaces the fallback.
+	p.imdsClient = &mockIMDSClient{document: imds.InstanceIdentityDocument{Region: "us-east-1"}}
+	m = p.LookupIMDSTags(newTestMetric())
+	require.Equal(t, map[string]string{"region": "us-east-1"}, m.Tags())
+	e, ok := p.getCached("region")
+	require.True(t, ok)
+	require.Equal(t, "us-east-1", e.value)
+}
+
+func TestInvalidRegionSources(t *testing.T) {
+	for _, sources := range [][]string{
+		{},
+		{"instance_profile"},
+		{"env", "env"},
+	} {
+		p := newAwsIMDSProcessor()
+		p.Log = &testutil.Logger{}
+		p.ImdsTags = []string{"region"}
+		p.RegionSources = sources
+		require.Error(t, p.Init(), "sources %v", sources)
+	}
+}
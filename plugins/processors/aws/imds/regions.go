@@ -0,0 +1,62 @@
+package aws
+
+// regionNames maps region codes to the display names used for the
+// regionName tag. Additional or different names can be configured with the
+// region_names option.
+var regionNames = map[string]string{
+	"af-south-1":     "Cape Town",
+	"ap-east-1":      "Hong Kong",
+	"ap-northeast-1": "Tokyo",
+	"ap-northeast-2": "Seoul",
+	"ap-northeast-3": "Osaka",
+	"ap-south-1":     "Mumbai",
+	"ap-south-2":     "Hyderabad",
+	"ap-southeast-1": "Singapore",
+	"ap-southeast-2": "Sydney",
+	"ap-southeast-3": "Jakarta",
+	"ap-southeast-4": "Melbourne",
+	"ca-central-1":   "Canada Central",
+	"cn-north-1":     "Beijing",
+	"cn-northwest-1": "Ningxia",
+	"eu-central-1":   "Frankfurt",
+	"eu-central-2":   "Zurich",
+	"eu-north-1":     "Stockholm",
+	"eu-south-1":     "Milan",
+	"eu-south-2":     "Spain",
+	"eu-west-1":      "Ireland",
+	"eu-west-2":      "London",
+	"eu-west-3":      "Paris",
+	"il-central-1":   "Tel Aviv",
+	"me-central-1":   "UAE",
+	"me-south-1":     "Bahrain",
+	"sa-east-1":      "São Paulo",
+	"us-east-1":      "N. Virginia",
+	"us-east-2":      "Ohio",
+	"us-gov-east-1":  "GovCloud (US-East)",
+	"us-gov-west-1":  "GovCloud (US-West)",
+	"us-west-1":      "N. California",
+	"us-west-2":      "Oregon",
+}
+
+// regionName returns the display name of the given region, falling back to
+// the region code for unknown regions.
+func (r *AwsIMDSProcessor) regionName(region string) string {
+	if name, ok := r.RegionNames[region]; ok {
+		return name
+	}
+	if name, ok := regionNames[region]; ok {
+		return name
+	}
+	return region
+}
+
+// mapRegion translates the region tag's value according to region_map, e.g.
+// into internal region names. It applies to the region as resolved from any
+// of region_sources. The regionName tag is still derived from the region
+// code.
+func (r *AwsIMDSProcessor) mapRegion(region string) string {
+	if v, ok := r.RegionMap[region]; ok {
+		return v
+	}
+	return region
+}
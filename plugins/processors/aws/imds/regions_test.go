@@ -0,0 +1,101 @@
+package aws
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/feature/ec2/imds"
+	"github.com/influxdata/telegraf/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRegionName(t *testing.T) {
+	tests := []struct {
+		region   string
+		expected string
+	}{
+		{"us-east-1", "N. Virginia"},
+		{"eu-central-1", "Frankfurt"},
+		{"xx-new-1", "xx-new-1"},
+		{"xx-new-2", "Newland"},
+		{"us-west-2", "Portland"},
+	}
+
+	p := newTestProcessor(t, &mockIMDSClient{}, "regionName")
+	p.RegionNames = map[string]string{
+		"xx-new-2":  "Newland",
+		"us-west-2": "Portland",
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.region, func(t *testing.T) {
+			require.Equal(t, tt.expected, p.regionName(tt.region))
+		})
+	}
+}
+
+func TestRegionNameTag(t *testing.T) {
+	client := &mockIMDSClient{
+		document: imds.InstanceIdentityDocument{Region: "eu-central-1"},
+	}
+	p := newTestProcessor(t, client, "region", "regionName")
+
+	m := p.LookupIMDSTags(newTestMetric())
+	require.Equal(t, map[string]string{"region": "eu-central-1", "regionName": "Frankfurt"}, m.Tags())
+}
+
+func TestRegionMap(t *testing.T) {
+	tests := []struct {
+		name     string
+		region   string
+		expected map[string]string
+	}{
+		{
+			name:     "mapped",
+			region:   "us-east-1",
+			expected: map[string]string{"region": "use1-prod", "regionName": "N. Virginia"},
+		},
+		{
+			name:     "unmapped",
+			region:   "eu-central-1",
+			expected: map[string]string{"region": "eu-central-1", "regionName": "Frankfurt"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &mockIMDSClient{
+				document: imds.InstanceIdentityDocument{Region: tt.region},
+			}
+			p := newTestProcessor(t, client, "region", "regionName")
+			p.RegionMap = map[string]string{"us-east-1": "use1-prod"}
+
+			m := p.LookupIMDSTags(newTestMetric())
+			require.Equal(t, tt.expected, m.Tags())
+		})
+	}
+}
+
+func TestRegionMapFallback(t *testing.T) {
+	t.Setenv("AWS_REGION", "us-east-1")
+
+	p := newAwsIMDSProcessor()
+	p.Log = &testutil.Logger{}
+	p.ImdsTags = []string{"region"}
+	p.RegionSources = []string{"identity_document", "env"}
+	p.RegionMap = map[string]string{"us-east-1": "use1-prod"}
+	require.NoError(t, p.Init())
+	p.tagCache = newTagCache(p.TagCacheSize)
+	p.imdsClient = &mockIMDSClient{err: errors.New("connection refused")}
+
+	m := p.LookupIMDSTags(newTestMetric())
+	require.Equal(t, map[string]string{"region": "use1-prod"}, m.Tags())
+}
+
+func TestRegionMapWithoutRegion(t *testing.T) {
+	p := newAwsIMDSProcessor()
+	p.Log = &testutil.Logger{}
+	p.ImdsTags = []string{"regionName"}
+	p.RegionMap = map[string]string{"us-east-1": "use1-prod"}
+	require.Error(t, p.Init())
+}
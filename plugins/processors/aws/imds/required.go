@@ -0,0 +1,103 @@
+package aws
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/influxdata/telegraf"
+)
+
+// initRequiredTags validates required_tags and on_required_failure.
+func (r *AwsIMDSProcessor) initRequiredTags(tc *tagConfig) error {
+	switch r.OnRequiredFailure {
+	case "drop", "hold":
+	default:
+		return fmt.Errorf("invalid on_required_failure: %s", r.OnRequiredFailure)
+	}
+	if r.HoldInterval <= 0 {
+		return fmt.Errorf("invalid hold_interval: %s", time.Duration(r.HoldInterval))
+	}
+	if r.MaxHold <= 0 {
+		return fmt.Errorf("invalid max_hold: %s", time.Duration(r.MaxHold))
+	}
+
+	r.requiredTags = make(map[string]struct{}, len(r.RequiredTags))
+	for _, tag := range r.RequiredTags {
+		if _, ok := tc.imdsTagsMap[tag]; !ok {
+			return fmt.Errorf("required tag %s is not configured to be added", tag)
+		}
+		r.requiredTags[tag] = struct{}{}
+	}
+	r.lastKnown = make(map[string]cacheEntry, len(r.requiredTags))
+	return nil
+}
+
+// requiredFailed reports whether any of the failed tags is required.
+func (r *AwsIMDSProcessor) requiredFailed(failed []string) bool {
+	for _, tag := range failed {
+		if _, ok := r.requiredTags[tag]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// rememberValue records a fetched value of a required tag, or of any tag with
+// stale_grace_period, so it can still be used after its cache entry expired.
+func (r *AwsIMDSProcessor) rememberValue(tag string, e cacheEntry) {
+	if !r.keepsLastKnown(tag) || e.value == "" {
+		return
+	}
+	r.lastKnownMu.Lock()
+	defer r.lastKnownMu.Unlock()
+	r.lastKnown[tag] = e
+}
+
+// useLastKnown resolves failed required tags from their last known values,
+// however stale within max_value_age, and returns the tags still failed.
+func (r *AwsIMDSProcessor) useLastKnown(values map[string]cacheEntry, failed []string) []string {
+	r.lastKnownMu.Lock()
+	defer r.lastKnownMu.Unlock()
+
+	remaining := failed[:0]
+	for _, tag := range failed {
+		if e, ok := r.lastKnown[tag]; ok && !r.tooOld(e) {
+			values[tag] = e
+			continue
+		}
+		remaining = append(remaining, tag)
+	}
+	return remaining
+}
+
+// resetLastKnown forgets the last known values, e.g. when the instance ID
+// changed.
+func (r *AwsIMDSProcessor) resetLastKnown() {
+	r.lastKnownMu.Lock()
+	defer r.lastKnownMu.Unlock()
+	r.lastKnown = make(map[string]cacheEntry, len(r.requiredTags))
+}
+
+// holdMetric enriches the metric again every hold_interval until all
+// required tags are resolved, max_hold elapsed or lookups are canceled on
+// shutdown. It returns the tags failed in the last attempt, so a metric
+// still missing required tags is dropped. No lock is held while waiting.
+func (r *AwsIMDSProcessor) holdMetric(tc *tagConfig, metric telegraf.Metric, noCache bool, failed []string) []string {
+	ticker := time.NewTicker(time.Duration(r.HoldInterval))
+	defer ticker.Stop()
+	timeout := time.NewTimer(time.Duration(r.MaxHold))
+	defer timeout.Stop()
+
+	for r.requiredFailed(failed) {
+		select {
+		case <-r.lookupCtx.Done():
+			return failed
+		case <-timeout.C:
+			r.Log.Warnf("Dropping metric held for %s without resolving required tags", time.Duration(r.MaxHold))
+			return failed
+		case <-ticker.C:
+		}
+		failed = r.enrich(tc, metric, noCache)
+	}
+	return failed
+}
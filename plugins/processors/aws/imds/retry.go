@@ -0,0 +1,164 @@
+package aws
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/feature/ec2/imds"
+	"golang.org/x/time/rate"
+)
+
+// newLimiter returns the limiter of max_imds_rps, allowing bursts of up to
+// a second's worth of requests, or nil if unlimited.
+func newLimiter(rps float64) *rate.Limiter {
+	if rps <= 0 {
+		return nil
+	}
+	return rate.NewLimiter(rate.Limit(rps), int(math.Max(1, math.Ceil(rps))))
+}
+
+// ErrTimeout matches errors of IMDS requests which didn't complete within
+// timeout or total_timeout, and of requests not sent while suspended after
+// such a timeout according to timeout_backoff.
+var ErrTimeout = errors.New("IMDS request timed out")
+
+// errSuspended is the error of requests not sent during timeout_backoff.
+var errSuspended = errors.New("IMDS requests suspended after a timeout")
+
+// timeoutError wraps the error of a timed out request, so it matches both
+// ErrTimeout and the original error.
+type timeoutError struct {
+	err error
+}
+
+func (e *timeoutError) Error() string {
+	return e.err.Error()
+}
+
+func (e *timeoutError) Unwrap() error {
+	return e.err
+}
+
+func (e *timeoutError) Is(target error) bool {
+	return target == ErrTimeout
+}
+
+// permanentError wraps the error of an attempt which a retry wouldn't
+// change.
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string {
+	return e.err.Error()
+}
+
+func (e *permanentError) Unwrap() error {
+	return e.err
+}
+
+// permanent marks err so withRetries returns it without retrying.
+func permanent(err error) error {
+	return &permanentError{err: err}
+}
+
+// isTimeout reports whether the request failed as it took too long, as
+// opposed to e.g. being canceled on shutdown.
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout())
+}
+
+// suspended reports whether requests are suspended after a timeout.
+func (r *AwsIMDSProcessor) suspended() bool {
+	return r.TimeoutBackoff > 0 && time.Now().UnixNano() < atomic.LoadInt64(&r.suspendedUntil)
+}
+
+// suspendAfterTimeout suspends requests for timeout_backoff, as timeouts
+// usually mean IMDS is slow for a while and further requests would only pile
+// up.
+func (r *AwsIMDSProcessor) suspendAfterTimeout() {
+	until := time.Now().Add(time.Duration(r.TimeoutBackoff)).UnixNano()
+	if previous := atomic.SwapInt64(&r.suspendedUntil, until); previous < time.Now().UnixNano() {
+		r.Log.Warnf("IMDS request timed out, suspending requests for %s", time.Duration(r.TimeoutBackoff))
+	}
+}
+
+// withRetries calls fn until it succeeds or max_retries retries failed,
+// waiting retry_backoff before the first retry and doubling the wait for each
+// further retry. Every attempt is bounded by timeout. If total_timeout is set
+// it bounds the whole sequence including backoff, so later attempts only get
+// what remains of the budget. With max_imds_rps, attempts wait for the
+// limiter first, unless that would exceed the deadline. Errors of timed out
+// attempts match ErrTimeout; with timeout_backoff they aren't retried and
+// suspend further requests.
+func (r *AwsIMDSProcessor) withRetries(ctx context.Context, fn func(context.Context) error) error {
+	if r.TotalTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(r.TotalTimeout))
+		defer cancel()
+	}
+
+	backoff := time.Duration(r.RetryBackoff)
+	for attempt := 0; ; attempt++ {
+		if r.suspended() {
+			return &timeoutError{err: errSuspended}
+		}
+		if r.limiter != nil {
+			if err := r.limiter.Wait(ctx); err != nil {
+				return fmt.Errorf("waiting for max_imds_rps: %w", err)
+			}
+		}
+		attemptCtx, cancel := context.WithTimeout(ctx, time.Duration(r.Timeout))
+		r.imdsRequests.Incr(1)
+		err := fn(attemptCtx)
+		cancel()
+		if err != nil && isTimeout(err) {
+			err = &timeoutError{err: err}
+			if r.TimeoutBackoff > 0 {
+				r.suspendAfterTimeout()
+				return err
+			}
+		}
+		var perm *permanentError
+		if errors.As(err, &perm) {
+			return perm.err
+		}
+		if err == nil || attempt >= r.MaxRetries {
+			return err
+		}
+
+		timer := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			if isTimeout(ctx.Err()) {
+				return &timeoutError{err: err}
+			}
+			return err
+		case <-timer.C:
+		}
+		backoff *= 2
+	}
+}
+
+// getInstanceIdentityDocument fetches the identity document. Concurrent
+// callers share a single request.
+func (r *AwsIMDSProcessor) getInstanceIdentityDocument(ctx context.Context) (*imds.GetInstanceIdentityDocumentOutput, error) {
+	v, err := r.flights.do("document", func() (interface{}, error) {
+		var iido *imds.GetInstanceIdentityDocumentOutput
+		err := r.withRetries(ctx, func(ctx context.Context) error {
+			var err error
+			iido, err = r.imdsClient.GetInstanceIdentityDocument(ctx, &imds.GetInstanceIdentityDocumentInput{})
+			return err
+		})
+		return iido, err
+	})
+	iido, _ := v.(*imds.GetInstanceIdentityDocumentOutput)
+	return iido, err
+}
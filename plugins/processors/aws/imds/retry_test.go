@@ -0,0 +1,192 @@
+package aws
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/feature/ec2/imds"
+	"github.com/influxdata/telegraf/config"
+	"github.com/influxdata/telegraf/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRetriesSucceed(t *testing.T) {
+	p := newTestProcessor(t, &mockIMDSClient{}, "region")
+	p.MaxRetries = 3
+	p.RetryBackoff = config.Duration(time.Millisecond)
+
+	var attempts int
+	err := p.withRetries(context.Background(), func(context.Context) error {
+		attempts++
+		if attempts < 3 {
+			return errors.New("unavailable")
+		}
+		return nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, 3, attempts)
+}
+
+func TestRetriesExhausted(t *testing.T) {
+	client := &mockIMDSClient{err: errors.New("unavailable")}
+	p := newTestProcessor(t, client, "region")
+	p.MaxRetries = 2
+	p.RetryBackoff = config.Duration(time.Millisecond)
+
+	_, err := p.getInstanceIdentityDocument(context.Background())
+	require.Error(t, err)
+	require.EqualValues(t, 3, client.calls)
+}
+
+func TestRetriesNotFound(t *testing.T) {
+	client := &mockIMDSClient{}
+	p := newTestProcessor(t, client, "region")
+	p.MaxRetries = 2
+	p.RetryBackoff = config.Duration(time.Millisecond)
+
+	// Paths not found are retried, unless they only exist in some states.
+	_, err := p.getMetadata(context.Background(), "placement/group-name")
+	require.True(t, isNotFound(err))
+	require.EqualValues(t, 3, client.calls)
+
+	client.calls = 0
+	v, err := p.lookupMetadataTag(context.Background(), metadataTags["spotInstanceAction"])
+	require.NoError(t, err)
+	require.Empty(t, v)
+	require.EqualValues(t, 1, client.calls)
+}
+
+func TestTotalTimeoutBoundsRetries(t *testing.T) {
+	client := &mockIMDSClient{delay: time.Second}
+	p := newTestProcessor(t, client, "region")
+	p.Timeout = config.Duration(50 * time.Millisecond)
+	p.MaxRetries = 10
+	p.RetryBackoff = config.Duration(10 * time.Millisecond)
+	p.TotalTimeout = config.Duration(200 * time.Millisecond)
+
+	start := time.Now()
+	_, err := p.getInstanceIdentityDocument(context.Background())
+	elapsed := time.Since(start)
+
+	require.Error(t, err)
+	require.Less(t, elapsed, 300*time.Millisecond)
+	require.Greater(t, client.calls, int32(1))
+	require.Less(t, client.calls, int32(11))
+}
+
+func TestAwsRetryMode(t *testing.T) {
+	server := newIMDSServer(t, `{"instanceId": "i-0123456789abcdef0", "region": "eu-west-1"}`)
+
+	for _, mode := range []string{"standard", "adaptive"} {
+		t.Run(mode, func(t *testing.T) {
+			p := newAwsIMDSProcessor()
+			p.Log = &testutil.Logger{}
+			p.ImdsTags = []string{"region"}
+			p.Endpoint = server.URL
+			p.AwsRetryMode = mode
+			require.NoError(t, p.Init())
+
+			acc := &testutil.Accumulator{}
+			require.NoError(t, p.Start(acc))
+			require.NoError(t, p.Add(newTestMetric(), acc))
+			p.Stop()
+			require.Equal(t, map[string]string{"region": "eu-west-1"}, acc.GetTelegrafMetrics()[0].Tags())
+		})
+	}
+
+	p := newAwsIMDSProcessor()
+	p.Log = &testutil.Logger{}
+	p.ImdsTags = []string{"region"}
+	p.AwsRetryMode = "legacy"
+	require.Error(t, p.Init())
+}
+
+func TestTimeoutError(t *testing.T) {
+	client := &mockIMDSClient{delay: time.Second}
+	p := newTestProcessor(t, client, "region")
+	p.Timeout = config.Duration(20 * time.Millisecond)
+	p.MaxRetries = 2
+	p.RetryBackoff = config.Duration(time.Millisecond)
+
+	// Timed out requests are retried like other failures.
+	_, err := p.getInstanceIdentityDocument(context.Background())
+	require.ErrorIs(t, err, ErrTimeout)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	require.Equal(t, "timeout", errorCategory(err))
+	require.EqualValues(t, 3, client.calls)
+
+	// Other errors don't match.
+	client.delay = 0
+	client.err = errors.New("unavailable")
+	_, err = p.getInstanceIdentityDocument(context.Background())
+	require.NotErrorIs(t, err, ErrTimeout)
+}
+
+func TestTimeoutBackoff(t *testing.T) {
+	client := &mockIMDSClient{
+		document: imds.InstanceIdentityDocument{Region: "eu-west-1"},
+		delay:    time.Second,
+	}
+	p := newTestProcessor(t, client, "region")
+	p.Timeout = config.Duration(20 * time.Millisecond)
+	p.MaxRetries = 2
+	p.RetryBackoff = config.Duration(time.Millisecond)
+	p.TimeoutBackoff = config.Duration(time.Minute)
+
+	// A timeout isn't retried and suspends further requests.
+	_, err := p.getInstanceIdentityDocument(context.Background())
+	require.ErrorIs(t, err, ErrTimeout)
+	require.EqualValues(t, 1, client.calls)
+
+	client.delay = 0
+	start := time.Now()
+	m := p.LookupIMDSTags(newTestMetric())
+	require.Empty(t, m.Tags())
+	require.Less(t, time.Since(start), 20*time.Millisecond)
+	require.EqualValues(t, 1, client.calls)
+
+	// Requests resume once the backoff passed.
+	atomic.StoreInt64(&p.suspendedUntil, time.Now().UnixNano())
+	m = p.LookupIMDSTags(newTestMetric())
+	require.Equal(t, map[string]string{"region": "eu-west-1"}, m.Tags())
+	require.EqualValues(t, 2, client.calls)
+}
+
+func TestMaxIMDSRPS(t *testing.T) {
+	p := newTestProcessor(t, &mockIMDSClient{}, "region")
+	p.MaxIMDSRPS = 100
+	require.NoError(t, p.Init())
+
+	// A second's worth of requests passes right away, the rest is spread.
+	start := time.Now()
+	for i := 0; i < 150; i++ {
+		require.NoError(t, p.withRetries(context.Background(), func(context.Context) error { return nil }))
+	}
+	require.GreaterOrEqual(t, time.Since(start), 400*time.Millisecond)
+
+	// Waiting beyond the deadline fails right away.
+	p.MaxIMDSRPS = 1
+	p.TotalTimeout = config.Duration(100 * time.Millisecond)
+	require.NoError(t, p.Init())
+	require.NoError(t, p.withRetries(context.Background(), func(context.Context) error { return nil }))
+	start = time.Now()
+	var called bool
+	err := p.withRetries(context.Background(), func(context.Context) error {
+		called = true
+		return nil
+	})
+	require.ErrorContains(t, err, "max_imds_rps")
+	require.False(t, called)
+	require.Less(t, time.Since(start), 100*time.Millisecond)
+}
+
+func TestMaxIMDSRPSInvalid(t *testing.T) {
+	p := newAwsIMDSProcessor()
+	p.Log = &testutil.Logger{}
+	p.ImdsTags = []string{"region"}
+	p.MaxIMDSRPS = -1
+	require.Error(t, p.Init())
+}
@@ -0,0 +1,113 @@
+package aws
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/feature/ec2/imds"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+)
+
+// rootDeviceTag is the tag telling whether the root device is an EBS volume
+// or an instance store volume.
+const rootDeviceTag = "rootDeviceType"
+
+// blockDeviceMappingPath is the meta-data path listing the instance's block
+// device mapping, e.g. "ami", "root", "ebs1" and "ephemeral0".
+const blockDeviceMappingPath = "block-device-mapping"
+
+// instanceStoreRootFamilies are the instance families able to boot instance
+// store-backed AMIs. All other instances have an EBS root device.
+var instanceStoreRootFamilies = map[string]struct{}{
+	"c1": {},
+	"c3": {},
+	"d2": {},
+	"i2": {},
+	"m1": {},
+	"m2": {},
+	"m3": {},
+	"r3": {},
+	"x1": {},
+}
+
+// mayHaveInstanceStoreRoot reports whether the instance type can have an
+// instance store root device.
+func mayHaveInstanceStoreRoot(instanceType string) bool {
+	family, _, _ := strings.Cut(instanceType, ".")
+	_, ok := instanceStoreRootFamilies[family]
+	return ok
+}
+
+// resolveRootDeviceType returns "ebs" or "instance-store". It is derived from
+// the instance type of the identity document where possible, so only
+// instances of families supporting instance store roots look at the block
+// device mapping. document is nil if unavailable. An empty value is returned
+// if neither tells the root device type.
+func (r *AwsIMDSProcessor) resolveRootDeviceType(
+	ctx context.Context,
+	document *imds.GetInstanceIdentityDocumentOutput,
+) (string, error) {
+	if document != nil && document.InstanceType != "" && !mayHaveInstanceStoreRoot(document.InstanceType) {
+		return "ebs", nil
+	}
+	return r.rootDeviceTypeFromMapping(ctx)
+}
+
+// rootDeviceTypeFromMapping looks up the root device in the block device
+// mapping. The root device is EBS if it is one of the mapped EBS volumes and
+// an instance store volume otherwise. Instances without a mapping report no
+// root device type.
+func (r *AwsIMDSProcessor) rootDeviceTypeFromMapping(ctx context.Context) (string, error) {
+	listing, err := r.getMetadata(ctx, blockDeviceMappingPath+"/")
+	if isNotFound(err) {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+
+	var root string
+	var volumes []string
+	for _, name := range strings.Split(listing, "\n") {
+		name = strings.TrimSpace(strings.TrimSuffix(name, "/"))
+		switch {
+		case name == "root" || (name == "ami" && root == ""):
+			root = name
+		case strings.HasPrefix(name, "ebs"):
+			volumes = append(volumes, name)
+		}
+	}
+	if root == "" {
+		return "", nil
+	}
+
+	rootDevice, err := r.getMetadata(ctx, blockDeviceMappingPath+"/"+root)
+	if err != nil {
+		return "", fmt.Errorf("getting root device: %w", err)
+	}
+	rootDevice = normalizeDeviceName(rootDevice)
+	for _, volume := range volumes {
+		device, err := r.getMetadata(ctx, blockDeviceMappingPath+"/"+volume)
+		if err != nil {
+			return "", fmt.Errorf("getting device of %s: %w", volume, err)
+		}
+		if normalizeDeviceName(device) == rootDevice {
+			return "ebs", nil
+		}
+	}
+	return "instance-store", nil
+}
+
+// normalizeDeviceName strips the "/dev/" prefix the mapping reports for some
+// devices but not others, e.g. "/dev/sda1" for root and "sda1" for ami.
+func normalizeDeviceName(device string) string {
+	return strings.TrimPrefix(strings.TrimSpace(device), "/dev/")
+}
+
+// isNotFound reports whether IMDS responded that the path doesn't exist.
+func isNotFound(err error) bool {
+	var respErr *smithyhttp.ResponseError
+	return errors.As(err, &respErr) && respErr.HTTPStatusCode() == http.StatusNotFound
+}
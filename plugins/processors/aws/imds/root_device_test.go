@@ -0,0 +1,84 @@
+package aws
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/feature/ec2/imds"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRootDeviceType(t *testing.T) {
+	tests := []struct {
+		name     string
+		client   *mockIMDSClient
+		expected map[string]string
+		calls    int32
+	}{
+		{
+			name: "ebs from instance type",
+			client: &mockIMDSClient{
+				document: imds.InstanceIdentityDocument{InstanceType: "m5.large"},
+			},
+			expected: map[string]string{"rootDeviceType": "ebs"},
+			calls:    1,
+		},
+		{
+			name: "ebs from mapping",
+			client: &mockIMDSClient{
+				document: imds.InstanceIdentityDocument{InstanceType: "m3.medium"},
+				metadata: map[string]string{
+					"block-device-mapping/":           "ami\nebs1\nephemeral0\nroot",
+					"block-device-mapping/ami":        "sda1",
+					"block-device-mapping/root":       "/dev/sda1",
+					"block-device-mapping/ebs1":       "sda1",
+					"block-device-mapping/ephemeral0": "sdb",
+				},
+			},
+			expected: map[string]string{"rootDeviceType": "ebs"},
+			calls:    4,
+		},
+		{
+			name: "instance store from mapping",
+			client: &mockIMDSClient{
+				document: imds.InstanceIdentityDocument{InstanceType: "m3.medium"},
+				metadata: map[string]string{
+					"block-device-mapping/":           "ami\nephemeral0\nroot",
+					"block-device-mapping/ami":        "sda1",
+					"block-device-mapping/root":       "/dev/sda1",
+					"block-device-mapping/ephemeral0": "sdb",
+				},
+			},
+			expected: map[string]string{"rootDeviceType": "instance-store"},
+			calls:    3,
+		},
+		{
+			name: "no mapping",
+			client: &mockIMDSClient{
+				document: imds.InstanceIdentityDocument{InstanceType: "c3.large"},
+			},
+			expected: map[string]string{},
+			calls:    2,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newTestProcessor(t, tt.client, "rootDeviceType")
+			m := p.LookupIMDSTags(newTestMetric())
+			require.Equal(t, tt.expected, m.Tags())
+			require.EqualValues(t, tt.calls, tt.client.calls)
+		})
+	}
+}
+
+func TestRootDeviceTypeAlongsideDocumentTags(t *testing.T) {
+	client := &mockIMDSClient{
+		document: imds.InstanceIdentityDocument{Region: "us-east-1", InstanceType: "t3.micro"},
+	}
+	p := newTestProcessor(t, client, "region", "rootDeviceType")
+
+	// The identity document fetched for region tells the root device type.
+	m := p.LookupIMDSTags(newTestMetric())
+	require.Equal(t, map[string]string{"region": "us-east-1", "rootDeviceType": "ebs"}, m.Tags())
+	require.EqualValues(t, 1, client.calls)
+}
@@ -0,0 +1,83 @@
+package aws
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/aws/smithy-go/middleware"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+)
+
+// attemptsKey is the context key of the per-operation attempt counter.
+type attemptsKey struct{}
+
+// sdkStats counts the IMDS requests made by the SDK, including its retries,
+// which the processor's own counters don't see.
+type sdkStats struct {
+	r               *AwsIMDSProcessor
+	operations      *counter
+	attempts        *counter
+	retries         *counter
+	transportErrors *counter
+}
+
+func (r *AwsIMDSProcessor) newSDKStats() *sdkStats {
+	return &sdkStats{
+		r:               r,
+		operations:      r.counter("sdk_operations", map[string]string{}),
+		attempts:        r.counter("sdk_attempts", map[string]string{}),
+		retries:         r.counter("sdk_retries", map[string]string{}),
+		transportErrors: r.counter("sdk_transport_errors", map[string]string{}),
+	}
+}
+
+// responseStat returns the counter of responses with the given status code.
+func (s *sdkStats) responseStat(code int) *counter {
+	return s.r.counter("sdk_responses", map[string]string{"code": strconv.Itoa(code)})
+}
+
+// addMiddleware registers the counting middlewares. Operations are counted
+// once in the initialize step, attempts in the deserialize step, which the
+// SDK's retry middleware runs once per attempt.
+func (s *sdkStats) addMiddleware(stack *middleware.Stack) error {
+	err := stack.Initialize.Add(middleware.InitializeMiddlewareFunc("CountOperations",
+		func(
+			ctx context.Context,
+			in middleware.InitializeInput,
+			next middleware.InitializeHandler,
+		) (middleware.InitializeOutput, middleware.Metadata, error) {
+			s.operations.Incr(1)
+			ctx = middleware.WithStackValue(ctx, attemptsKey{}, new(int32))
+			return next.HandleInitialize(ctx, in)
+		}), middleware.Before)
+	if err != nil {
+		return err
+	}
+
+	return stack.Deserialize.Add(middleware.DeserializeMiddlewareFunc("CountAttempts",
+		func(
+			ctx context.Context,
+			in middleware.DeserializeInput,
+			next middleware.DeserializeHandler,
+		) (middleware.DeserializeOutput, middleware.Metadata, error) {
+			s.attempts.Incr(1)
+			if n, ok := middleware.GetStackValue(ctx, attemptsKey{}).(*int32); ok && atomic.AddInt32(n, 1) > 1 {
+				s.retries.Incr(1)
+			}
+
+			out, metadata, err := next.HandleDeserialize(ctx, in)
+			if resp, ok := out.RawResponse.(*smithyhttp.Response); ok {
+				s.responseStat(resp.StatusCode).Incr(1)
+			} else if err != nil {
+				var respErr *smithyhttp.ResponseError
+				if errors.As(err, &respErr) {
+					s.responseStat(respErr.HTTPStatusCode()).Incr(1)
+				} else {
+					s.transportErrors.Incr(1)
+				}
+			}
+			return out, metadata, err
+		}), middleware.After)
+}
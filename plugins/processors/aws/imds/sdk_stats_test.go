@@ -0,0 +1,75 @@
+package aws
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/influxdata/telegraf/selfstat"
+	"github.com/influxdata/telegraf/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReportStats(t *testing.T) {
+	var requests int32
+	mux := http.NewServeMux()
+	mux.HandleFunc("/latest/api/token", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Aws-Ec2-Metadata-Token-Ttl-Seconds", "21600")
+		_, _ = w.Write([]byte("token"))
+	})
+	mux.HandleFunc("/latest/dynamic/instance-identity/document", func(w http.ResponseWriter, r *http.Request) {
+		// Fail the first request, so the SDK retries.
+		if atomic.AddInt32(&requests, 1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = w.Write([]byte(`{"instanceId": "i-0123456789abcdef0"}`))
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	p := newAwsIMDSProcessor()
+	p.Log = &testutil.Logger{}
+	p.ImdsTags = []string{"instanceId"}
+	p.Endpoint = server.URL
+	p.ReportStats = true
+	require.NoError(t, p.Init())
+
+	require.NoError(t, p.Start(&testutil.Accumulator{}))
+	p.Stop()
+
+	// The token and the document were fetched, the document in two attempts.
+	// The stats are the instance's own, not those of other tests.
+	stats := p.newSDKStats()
+	require.Equal(t, int64(2), stats.operations.Get())
+	require.Equal(t, int64(3), stats.attempts.Get())
+	require.Equal(t, int64(1), stats.retries.Get())
+	require.Equal(t, int64(1), stats.responseStat(http.StatusServiceUnavailable).Get())
+	require.Equal(t, int64(2), stats.responseStat(http.StatusOK).Get())
+}
+
+func TestStatsPerInstance(t *testing.T) {
+	first := newAwsIMDSProcessor()
+	first.Log = &testutil.Logger{}
+	first.ImdsTags = []string{"region"}
+	require.NoError(t, first.Init())
+	second := newAwsIMDSProcessor()
+	second.Log = &testutil.Logger{}
+	second.ImdsTags = []string{"region"}
+	require.NoError(t, second.Init())
+
+	first.imdsRequests.Incr(2)
+	second.imdsRequests.Incr(1)
+	require.Equal(t, int64(2), first.imdsRequests.Get())
+	require.Equal(t, int64(1), second.imdsRequests.Get())
+
+	// Aliased instances are told apart by their alias.
+	aliased := newAwsIMDSProcessor()
+	aliased.Log = &testutil.Logger{}
+	aliased.ImdsTags = []string{"region"}
+	aliased.Alias = "test_stats_per_instance"
+	require.NoError(t, aliased.Init())
+	require.Same(t, aliased.imdsRequests.stat,
+		selfstat.Register("aws_imds", "imds_requests", map[string]string{"alias": "test_stats_per_instance"}))
+}
@@ -0,0 +1,122 @@
+package aws
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/coocood/freecache"
+)
+
+// snapshotEntry is a cached entry along with its expiry, zero if it never
+// expires.
+type snapshotEntry struct {
+	entry   cacheEntry
+	expires time.Time
+}
+
+// tagCache holds the resolved values. The entries are stored in a freecache,
+// which bounds their memory and expires them, but are read from an immutable
+// snapshot of all entries. The snapshot is rebuilt on the first read after
+// an entry changed, so reading the values for every metric takes no lock as
+// long as nothing is refreshed.
+type tagCache struct {
+	*freecache.Cache
+
+	mu       sync.Mutex
+	snapshot atomic.Pointer[map[string]snapshotEntry]
+	hits     int64
+	misses   int64
+}
+
+func newTagCache(size int) *tagCache {
+	return &tagCache{Cache: freecache.NewCache(size)}
+}
+
+// Set stores the entry and invalidates the snapshot.
+func (c *tagCache) Set(key, value []byte, expireSeconds int) error {
+	defer c.invalidate()
+	return c.Cache.Set(key, value, expireSeconds)
+}
+
+// Del removes the entry and invalidates the snapshot.
+func (c *tagCache) Del(key []byte) bool {
+	defer c.invalidate()
+	return c.Cache.Del(key)
+}
+
+// Clear removes all entries and invalidates the snapshot.
+func (c *tagCache) Clear() {
+	defer c.invalidate()
+	c.Cache.Clear()
+}
+
+// invalidate drops the snapshot. It takes the lock held while building a
+// snapshot, so a snapshot built concurrently with a change doesn't outlive
+// the change.
+func (c *tagCache) invalidate() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.snapshot.Store(nil)
+}
+
+// lookup returns the entry of the key unless it expired at now.
+func (c *tagCache) lookup(key string, now time.Time) (cacheEntry, bool) {
+	s, ok := c.load()[key]
+	if !ok || (!s.expires.IsZero() && !now.Before(s.expires)) {
+		atomic.AddInt64(&c.misses, 1)
+		return cacheEntry{}, false
+	}
+	atomic.AddInt64(&c.hits, 1)
+	return s.entry, true
+}
+
+// load returns the current snapshot, building it if invalidated.
+func (c *tagCache) load() map[string]snapshotEntry {
+	if s := c.snapshot.Load(); s != nil {
+		return *s
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if s := c.snapshot.Load(); s != nil {
+		return *s
+	}
+	now := time.Now()
+	s := make(map[string]snapshotEntry, c.Cache.EntryCount())
+	it := c.Cache.NewIterator()
+	for entry := it.Next(); entry != nil; entry = it.Next() {
+		e, err := decodeCacheEntry(entry.Value)
+		if err != nil {
+			continue
+		}
+		ttl, err := c.Cache.TTL(entry.Key)
+		if err != nil {
+			continue
+		}
+		se := snapshotEntry{entry: e}
+		if ttl > 0 {
+			se.expires = now.Add(time.Duration(ttl) * time.Second)
+		}
+		s[string(entry.Key)] = se
+	}
+	c.snapshot.Store(&s)
+	return s
+}
+
+// HitCount returns the number of lookups finding an entry.
+func (c *tagCache) HitCount() int64 {
+	return atomic.LoadInt64(&c.hits)
+}
+
+// MissCount returns the number of lookups finding no entry.
+func (c *tagCache) MissCount() int64 {
+	return atomic.LoadInt64(&c.misses)
+}
+
+// ResetStatistics resets the lookup counts along with the cache's own.
+func (c *tagCache) ResetStatistics() {
+	atomic.StoreInt64(&c.hits, 0)
+	atomic.StoreInt64(&c.misses, 0)
+	c.Cache.ResetStatistics()
+}
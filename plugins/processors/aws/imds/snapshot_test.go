@@ -0,0 +1,120 @@
+package aws
+
+import (
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/feature/ec2/imds"
+	"github.com/influxdata/telegraf/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTagCacheSnapshot(t *testing.T) {
+	c := newTagCache(DefaultCacheSize)
+	now := time.Now()
+	e := cacheEntry{value: "us-east-1", fetched: now}
+
+	_, ok := c.lookup("region", now)
+	require.False(t, ok)
+
+	// Changes invalidate the snapshot.
+	require.NoError(t, c.Set([]byte("region"), e.encode(), 60))
+	got, ok := c.lookup("region", now)
+	require.True(t, ok)
+	require.Equal(t, "us-east-1", got.value)
+
+	e.value = "us-west-2"
+	require.NoError(t, c.Set([]byte("region"), e.encode(), 0))
+	got, ok = c.lookup("region", now)
+	require.True(t, ok)
+	require.Equal(t, "us-west-2", got.value)
+
+	c.Del([]byte("region"))
+	_, ok = c.lookup("region", now)
+	require.False(t, ok)
+
+	require.NoError(t, c.Set([]byte("region"), e.encode(), 60))
+	c.Clear()
+	_, ok = c.lookup("region", now)
+	require.False(t, ok)
+
+	// Entries expire in the snapshot like in the cache.
+	require.NoError(t, c.Set([]byte("region"), e.encode(), 60))
+	_, ok = c.lookup("region", now.Add(59*time.Second))
+	require.True(t, ok)
+	_, ok = c.lookup("region", now.Add(61*time.Second))
+	require.False(t, ok)
+
+	require.Equal(t, int64(3), c.HitCount())
+	require.Equal(t, int64(4), c.MissCount())
+}
+
+func newBenchmarkProcessor(b *testing.B) *AwsIMDSProcessor {
+	client := &mockIMDSClient{
+		document: imds.InstanceIdentityDocument{
+			AccountID:        "123456789012",
+			AvailabilityZone: "us-east-1a",
+			InstanceID:       "i-0123456789abcdef0",
+			InstanceType:     "m5.large",
+			Region:           "us-east-1",
+		},
+		metadata: map[string]string{"mac": "0e:12:34:56:78:9a", "placement/group-name": "web"},
+	}
+	p := newAwsIMDSProcessor()
+	p.Log = &testutil.Logger{}
+	p.ImdsTags = []string{"accountId", "availabilityZone", "instanceId", "instanceType", "region"}
+	p.MetadataPaths = map[string]string{"mac": "mac", "placementGroup": "placement/group-name"}
+	if err := p.Init(); err != nil {
+		b.Fatal(err)
+	}
+	p.tagCache = newTagCache(p.TagCacheSize)
+	p.imdsClient = client
+	p.LookupIMDSTags(newTestMetric())
+	return p
+}
+
+// BenchmarkAsyncAdd measures enriching metrics with cached values, the path
+// every metric takes.
+func BenchmarkAsyncAdd(b *testing.B) {
+	p := newBenchmarkProcessor(b)
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			p.asyncAdd(newTestMetric())
+		}
+	})
+}
+
+// BenchmarkCacheRead compares reading a cached value from the freecache,
+// which locks a segment and copies the entry, to reading it from the
+// snapshot.
+func BenchmarkCacheRead(b *testing.B) {
+	p := newBenchmarkProcessor(b)
+
+	b.Run("freecache", func(b *testing.B) {
+		b.ReportAllocs()
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				v, err := p.tagCache.Get([]byte("region"))
+				if err != nil {
+					b.Fatal(err)
+				}
+				if _, err := decodeCacheEntry(v); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	})
+
+	b.Run("snapshot", func(b *testing.B) {
+		b.ReportAllocs()
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				if _, ok := p.tagCache.lookup("region", time.Now()); !ok {
+					b.Fatal("region not cached")
+				}
+			}
+		})
+	})
+}
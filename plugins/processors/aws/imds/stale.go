@@ -0,0 +1,35 @@
+package aws
+
+import "time"
+
+// keepsLastKnown reports whether the last fetched value of the tag is kept
+// beyond its cache entry, for required_tags or stale_grace_period.
+func (r *AwsIMDSProcessor) keepsLastKnown(tag string) bool {
+	if r.StaleGracePeriod > 0 {
+		return true
+	}
+	_, ok := r.requiredTags[tag]
+	return ok
+}
+
+// useStale resolves failed tags from their last known values if these
+// expired no longer than stale_grace_period ago, and returns the tags still
+// failed. The values are looked up again with every lookup, so fresh values
+// replace them as soon as IMDS recovers.
+func (r *AwsIMDSProcessor) useStale(values map[string]cacheEntry, failed []string) []string {
+	r.lastKnownMu.Lock()
+	defer r.lastKnownMu.Unlock()
+
+	grace := time.Duration(r.StaleGracePeriod)
+	remaining := failed[:0]
+	for _, tag := range failed {
+		e, ok := r.lastKnown[tag]
+		if ok && !r.tooOld(e) && time.Since(e.fetched) <= r.cacheTTL(tag)+grace {
+			values[tag] = e
+			r.staleServed.Incr(1)
+			continue
+		}
+		remaining = append(remaining, tag)
+	}
+	return remaining
+}
@@ -0,0 +1,61 @@
+package aws
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/influxdata/telegraf"
+)
+
+// initRemoveOnFailure maps the keys in remove_on_failure to the tags added
+// under them.
+func (r *AwsIMDSProcessor) initRemoveOnFailure(tc *tagConfig) error {
+	r.removeOnFailure = make(map[string]string, len(r.RemoveOnFailure))
+	for _, key := range r.RemoveOnFailure {
+		var found bool
+		for _, tags := range []map[string]struct{}{tc.imdsTagsMap, tc.lookupTags} {
+			for tag := range tags {
+				if tc.tagKey(tag) == key {
+					r.removeOnFailure[tag] = key
+					found = true
+				}
+			}
+		}
+		if !found {
+			return fmt.Errorf("remove_on_failure key %s is not added by any configured tag", key)
+		}
+	}
+	return nil
+}
+
+// removeStaleTags removes the keys in remove_on_failure of the failed tags
+// from the metric, so values added by other layers don't outlive a failover.
+// Tags with a fallback value are kept. Removal is logged once per outage.
+func (r *AwsIMDSProcessor) removeStaleTags(metric telegraf.Metric, failed []string) {
+	var removed []string
+	for _, tag := range failed {
+		key, ok := r.removeOnFailure[tag]
+		if !ok {
+			continue
+		}
+		if _, ok := r.FallbackValues[tag]; ok {
+			continue
+		}
+		if metric.HasTag(key) {
+			metric.RemoveTag(key)
+			removed = append(removed, key)
+		}
+	}
+
+	if len(removed) == 0 {
+		if len(failed) == 0 {
+			r.staleRemovalLogged.Store(false)
+		}
+		return
+	}
+	if r.staleRemovalLogged.CompareAndSwap(false, true) {
+		sort.Strings(removed)
+		r.Log.Warnf("Metadata lookup failed, removing stale tags from metrics: %s", strings.Join(removed, ", "))
+	}
+}
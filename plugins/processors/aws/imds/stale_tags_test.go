@@ -0,0 +1,44 @@
+package aws
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/influxdata/telegraf/metric"
+	"github.com/influxdata/telegraf/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRemoveOnFailure(t *testing.T) {
+	client := &mockIMDSClient{err: errors.New("connection refused")}
+	p := newTestProcessor(t, client, "region", "availabilityZone")
+	p.RemoveOnFailure = []string{"region", "availabilityZone"}
+	p.FallbackValues = map[string]string{"availabilityZone": "unknown"}
+	require.NoError(t, p.Init())
+
+	m := metric.New("m", map[string]string{
+		"region":           "us-east-1",
+		"availabilityZone": "us-east-1a",
+		"host":             "a",
+	}, map[string]interface{}{"v": 1}, time.Unix(0, 0))
+	out := p.asyncAdd(m)
+	require.Len(t, out, 1)
+	require.Equal(t, map[string]string{"availabilityZone": "unknown", "host": "a"}, out[0].Tags())
+	require.True(t, p.staleRemovalLogged.Load())
+
+	// Successful lookups end the outage.
+	p.setCached("region", "us-west-2", time.Now())
+	p.setCached("availabilityZone", "us-west-2a", time.Now())
+	out = p.asyncAdd(newTestMetric())
+	require.Equal(t, map[string]string{"region": "us-west-2", "availabilityZone": "us-west-2a"}, out[0].Tags())
+	require.False(t, p.staleRemovalLogged.Load())
+}
+
+func TestInvalidRemoveOnFailure(t *testing.T) {
+	p := newAwsIMDSProcessor()
+	p.Log = &testutil.Logger{}
+	p.ImdsTags = []string{"region"}
+	p.RemoveOnFailure = []string{"ec2_region"}
+	require.Error(t, p.Init())
+}
@@ -0,0 +1,54 @@
+package aws
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/feature/ec2/imds"
+	"github.com/influxdata/telegraf/config"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStaleGracePeriod(t *testing.T) {
+	client := &mockIMDSClient{document: imds.InstanceIdentityDocument{Region: "us-east-1"}}
+	p := newTestProcessor(t, client, "region")
+	p.CacheTTL = config.Duration(time.Hour)
+	p.StaleGracePeriod = config.Duration(10 * time.Minute)
+
+	m := p.LookupIMDSTags(newTestMetric())
+	require.Equal(t, map[string]string{"region": "us-east-1"}, m.Tags())
+
+	// The value expired a minute ago and the refresh fails.
+	p.tagCache.Clear()
+	p.rememberValue("region", cacheEntry{value: "us-east-1", fetched: time.Now().Add(-61 * time.Minute)})
+	client.err = errors.New("connection refused")
+	before := p.staleServed.Get()
+	m = p.LookupIMDSTags(newTestMetric())
+	require.Equal(t, map[string]string{"region": "us-east-1"}, m.Tags())
+	require.Equal(t, before+1, p.staleServed.Get())
+
+	// Once the grace period passed, the tag is given up.
+	p.rememberValue("region", cacheEntry{value: "us-east-1", fetched: time.Now().Add(-71 * time.Minute)})
+	m = p.LookupIMDSTags(newTestMetric())
+	require.Empty(t, m.Tags())
+
+	// IMDS recovered.
+	p.rememberValue("region", cacheEntry{value: "us-east-1", fetched: time.Now().Add(-61 * time.Minute)})
+	client.err = nil
+	client.document.Region = "us-west-2"
+	m = p.LookupIMDSTags(newTestMetric())
+	require.Equal(t, map[string]string{"region": "us-west-2"}, m.Tags())
+	require.Equal(t, before+1, p.staleServed.Get())
+}
+
+func TestStaleGracePeriodDisabled(t *testing.T) {
+	client := &mockIMDSClient{document: imds.InstanceIdentityDocument{Region: "us-east-1"}}
+	p := newTestProcessor(t, client, "region")
+
+	p.LookupIMDSTags(newTestMetric())
+	p.tagCache.Clear()
+	client.err = errors.New("connection refused")
+	m := p.LookupIMDSTags(newTestMetric())
+	require.Empty(t, m.Tags())
+}
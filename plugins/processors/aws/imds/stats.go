@@ -0,0 +1,147 @@
+package aws
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/influxdata/telegraf"
+	"github.com/influxdata/telegraf/selfstat"
+)
+
+// statsMetricName is the name of the metric holding the internal stats.
+const statsMetricName = "aws_imds_stats"
+
+// counter is an internal stat of the processor. It is reported as a
+// monotonic total or, with stats_as_rate, as the count of the last
+// stats_interval.
+type counter struct {
+	stat     selfstat.Stat
+	rate     bool
+	total    int64
+	reported int64
+}
+
+// Incr adds n to the counter.
+func (c *counter) Incr(n int64) {
+	atomic.AddInt64(&c.total, n)
+	if !c.rate {
+		c.stat.Incr(n)
+	}
+}
+
+// Get returns the reported value.
+func (c *counter) Get() int64 {
+	return c.stat.Get()
+}
+
+// report sets the reported value to the count since the last report. It is
+// only called from the stats worker.
+func (c *counter) report() {
+	total := atomic.LoadInt64(&c.total)
+	c.stat.Set(total - c.reported)
+	c.reported = total
+}
+
+// instances numbers the plugin instances of the process, to tell apart the
+// internal stats of instances without an alias.
+var instances int64
+
+// counter returns the internal stat of the given name and tags, registering
+// it on first use. The stat is tagged with the alias of the instance, or its
+// number if it has none, as selfstat shares stats of the same name and tags.
+func (r *AwsIMDSProcessor) counter(name string, tags map[string]string) *counter {
+	key := name + fmt.Sprint(tags)
+	r.statsMu.Lock()
+	defer r.statsMu.Unlock()
+	if c, ok := r.counters[key]; ok {
+		return c
+	}
+	if r.counters == nil {
+		r.counters = make(map[string]*counter)
+	}
+	statTags := make(map[string]string, len(tags)+1)
+	for k, v := range tags {
+		statTags[k] = v
+	}
+	if r.Alias != "" {
+		statTags["alias"] = r.Alias
+	} else {
+		statTags["instance"] = strconv.FormatInt(r.instance, 10)
+	}
+	c := &counter{
+		stat: selfstat.Register("aws_imds", name, statTags),
+		rate: r.StatsAsRate,
+	}
+	r.counters[key] = c
+	return c
+}
+
+// reportStats reports the counters every stats_interval, as counts of the
+// interval with stats_as_rate, and adds them as a metric with emit_stats.
+func (r *AwsIMDSProcessor) reportStats(ctx context.Context, acc telegraf.Accumulator) {
+	ticker := time.NewTicker(time.Duration(r.StatsInterval))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if r.StatsAsRate {
+				r.statsMu.Lock()
+				for _, c := range r.counters {
+					c.report()
+				}
+				r.statsMu.Unlock()
+			}
+			if r.EmitStats {
+				r.emitStats(acc)
+			}
+		}
+	}
+}
+
+// emitStats adds the reported values of the counters as a metric per tag
+// set, tagged with the "instance_id" if known. Internal stats only reach the
+// internal input of the process registering them, which under the execd shim
+// is the shim rather than Telegraf.
+func (r *AwsIMDSProcessor) emitStats(acc telegraf.Accumulator) {
+	r.identityMu.Lock()
+	instanceID := r.instanceID
+	r.identityMu.Unlock()
+
+	type statsMetric struct {
+		tags   map[string]string
+		fields map[string]interface{}
+	}
+	metrics := make(map[string]*statsMetric)
+	r.statsMu.Lock()
+	for _, c := range r.counters {
+		tags := c.stat.Tags()
+		if instanceID != "" {
+			tags["instance_id"] = instanceID
+		}
+		key := fmt.Sprint(tags)
+		m, ok := metrics[key]
+		if !ok {
+			m = &statsMetric{tags: tags, fields: make(map[string]interface{})}
+			metrics[key] = m
+		}
+		m.fields[c.stat.FieldName()] = c.Get()
+	}
+	r.statsMu.Unlock()
+
+	keys := make([]string, 0, len(metrics))
+	for key := range metrics {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	now := time.Now()
+	for _, key := range keys {
+		acc.AddFields(statsMetricName, metrics[key].fields, metrics[key].tags, now)
+	}
+}
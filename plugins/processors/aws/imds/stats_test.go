@@ -0,0 +1,115 @@
+package aws
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/feature/ec2/imds"
+	"github.com/influxdata/telegraf/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStatsAsRate(t *testing.T) {
+	p := newAwsIMDSProcessor()
+	p.Log = &testutil.Logger{}
+	p.ImdsTags = []string{"region"}
+	p.StatsAsRate = true
+	require.NoError(t, p.Init())
+
+	c := p.counter("test_rate", map[string]string{})
+	require.Same(t, c, p.counter("test_rate", map[string]string{}))
+
+	// Counts are only reported per interval.
+	c.Incr(3)
+	require.Equal(t, int64(0), c.Get())
+	c.report()
+	require.Equal(t, int64(3), c.Get())
+	c.Incr(2)
+	c.report()
+	require.Equal(t, int64(2), c.Get())
+	c.report()
+	require.Equal(t, int64(0), c.Get())
+
+	p = newAwsIMDSProcessor()
+	p.Log = &testutil.Logger{}
+	p.ImdsTags = []string{"region"}
+	p.StatsAsRate = true
+	p.StatsInterval = 0
+	require.Error(t, p.Init())
+}
+
+func TestStatsMonotonic(t *testing.T) {
+	p := newAwsIMDSProcessor()
+	p.Log = &testutil.Logger{}
+	p.ImdsTags = []string{"region"}
+	require.NoError(t, p.Init())
+
+	c := p.counter("test_monotonic", map[string]string{})
+	c.Incr(3)
+	c.Incr(2)
+	require.Equal(t, int64(5), c.Get())
+}
+
+func TestEmitStats(t *testing.T) {
+	p := newAwsIMDSProcessor()
+	p.Log = &testutil.Logger{}
+	p.ImdsTags = []string{"region"}
+	p.Alias = "emit_stats"
+	p.EmitStats = true
+	require.NoError(t, p.Init())
+	p.instanceID = "i-0123456789abcdef0"
+
+	p.cacheHits.Incr(3)
+	p.counter("sdk_responses", map[string]string{"code": "200"}).Incr(2)
+	acc := &testutil.Accumulator{}
+	p.emitStats(acc)
+
+	// Stats with further tags are added as a metric of their own.
+	metrics := acc.GetTelegrafMetrics()
+	require.Len(t, metrics, 2)
+	require.Equal(t, statsMetricName, metrics[0].Name())
+	require.Equal(t, map[string]string{
+		"alias":       "emit_stats",
+		"code":        "200",
+		"instance_id": "i-0123456789abcdef0",
+	}, metrics[0].Tags())
+	require.Equal(t, map[string]interface{}{"sdk_responses": int64(2)}, metrics[0].Fields())
+	require.Equal(t, map[string]string{"alias": "emit_stats", "instance_id": "i-0123456789abcdef0"}, metrics[1].Tags())
+	v, ok := metrics[1].GetField("cache_hits")
+	require.True(t, ok)
+	require.Equal(t, int64(3), v)
+	require.True(t, metrics[1].HasField("imds_requests"))
+
+	p = newAwsIMDSProcessor()
+	p.Log = &testutil.Logger{}
+	p.ImdsTags = []string{"region"}
+	p.EmitStats = true
+	p.StatsInterval = 0
+	require.Error(t, p.Init())
+}
+
+func TestCacheStats(t *testing.T) {
+	client := &mockIMDSClient{document: imds.InstanceIdentityDocument{Region: "us-east-1"}}
+	p := newTestProcessor(t, client, "region", "reservationId")
+
+	// The stats are registered globally, so compare the increments.
+	hits, misses := p.cacheHits.Get(), p.cacheMisses.Get()
+	negativeHits, requests := p.negativeHits.Get(), p.imdsRequests.Get()
+
+	// The first lookup misses both tags, the reservation ID doesn't exist.
+	m := p.LookupIMDSTags(newTestMetric())
+	require.Equal(t, map[string]string{"region": "us-east-1"}, m.Tags())
+	require.Equal(t, hits, p.cacheHits.Get())
+	require.Equal(t, misses+2, p.cacheMisses.Get())
+	require.Equal(t, negativeHits, p.negativeHits.Get())
+	require.Equal(t, requests+2, p.imdsRequests.Get())
+
+	// The second lookup is answered from the cache, the reservation ID by
+	// its cached absence.
+	m = p.LookupIMDSTags(newTestMetric())
+	require.Equal(t, map[string]string{"region": "us-east-1"}, m.Tags())
+	require.Equal(t, hits+2, p.cacheHits.Get())
+	require.Equal(t, misses+2, p.cacheMisses.Get())
+	require.Equal(t, negativeHits+1, p.negativeHits.Get())
+	require.Equal(t, requests+2, p.imdsRequests.Get())
+	require.EqualValues(t, 2, client.calls)
+}
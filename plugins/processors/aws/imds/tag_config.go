@@ -0,0 +1,61 @@
+package aws
+
+// tagConfig holds the tags to look up and the keys to add them under. It is
+// built by Init and replaced as a whole when instance tags are discovered,
+// but never modified once published, so metrics are enriched according to
+// one consistent configuration without taking a lock. Configurations only
+// grow and a tag's entries don't change once published, so a later
+// configuration agrees with an earlier one on the tags of both.
+type tagConfig struct {
+	// imdsTagsMap holds all tags which may be added to metrics.
+	imdsTagsMap map[string]struct{}
+	pathTags    map[string]metadataTag
+	// defaultTags are added to metrics of measurements not listed in
+	// tags_by_measurement, lookupTags additionally hold set_host_tag_from.
+	defaultTags map[string]struct{}
+	lookupTags  map[string]struct{}
+	tagKeys     map[string]string
+	tagOrder    []string
+	conflicts   map[string]string
+	shadowed    map[string]string
+}
+
+func newTagConfig() *tagConfig {
+	return &tagConfig{imdsTagsMap: make(map[string]struct{})}
+}
+
+// clone returns a copy of the configuration to extend before publishing it.
+// The keys of the new tags and the order are left to buildTagKeys.
+func (tc *tagConfig) clone() *tagConfig {
+	return &tagConfig{
+		imdsTagsMap: cloneMap(tc.imdsTagsMap),
+		pathTags:    cloneMap(tc.pathTags),
+		tagKeys:     cloneMap(tc.tagKeys),
+		defaultTags: cloneMap(tc.defaultTags),
+		lookupTags:  cloneMap(tc.lookupTags),
+		conflicts:   cloneMap(tc.conflicts),
+		shadowed:    cloneMap(tc.shadowed),
+	}
+}
+
+// tagKey returns the metric tag key to use for the given metadata tag.
+func (tc *tagConfig) tagKey(tag string) string {
+	if key, ok := tc.tagKeys[tag]; ok {
+		return key
+	}
+	return tag
+}
+
+// loadTags returns the tag configuration in effect. Metrics load it once,
+// so all steps of enriching a metric see the same tags.
+func (r *AwsIMDSProcessor) loadTags() *tagConfig {
+	return r.tags.Load()
+}
+
+func cloneMap[K comparable, V any](m map[K]V) map[K]V {
+	c := make(map[K]V, len(m))
+	for k, v := range m {
+		c[k] = v
+	}
+	return c
+}
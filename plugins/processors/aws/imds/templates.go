@@ -0,0 +1,86 @@
+package aws
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"text/template"
+)
+
+// tagTemplate is a compiled computed_tags entry.
+type tagTemplate struct {
+	key  string
+	tmpl *template.Template
+}
+
+func (r *AwsIMDSProcessor) initComputedTags(tc *tagConfig) error {
+	keys := make([]string, 0, len(r.ComputedTags))
+	for key := range r.ComputedTags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	// Try the templates against placeholder values, so references to tags
+	// that are never resolved fail here rather than on every metric. Instance
+	// tags collected with "*" aren't known up front.
+	placeholders := make(map[string]string, len(tc.imdsTagsMap))
+	for tag := range tc.imdsTagsMap {
+		placeholders[tag] = ""
+	}
+	data := r.templateData(placeholders)
+
+	r.tagTemplates = make([]tagTemplate, 0, len(keys))
+	for _, key := range keys {
+		if key == "" {
+			return errors.New("empty key in computed_tags")
+		}
+		tmpl, err := template.New(key).Option("missingkey=error").Parse(r.ComputedTags[key])
+		if err != nil {
+			return fmt.Errorf("invalid computed_tags template for %s: %w", key, err)
+		}
+		if !r.collectAllInstanceTags {
+			if err := tmpl.Execute(&strings.Builder{}, data); err != nil {
+				return fmt.Errorf("invalid computed_tags template for %s: %w", key, err)
+			}
+		}
+		r.tagTemplates = append(r.tagTemplates, tagTemplate{key: key, tmpl: tmpl})
+	}
+	return nil
+}
+
+// templateData returns the raw values available to computed_tags templates.
+// Pseudonymized and masked values are left out, so templates can't reveal
+// them.
+func (r *AwsIMDSProcessor) templateData(values map[string]string) map[string]string {
+	data := make(map[string]string, len(values))
+	for tag, value := range values {
+		if _, ok := r.pseudonymizeTagsMap[tag]; ok {
+			continue
+		}
+		if _, ok := r.maskTagsMap[tag]; ok {
+			continue
+		}
+		data[tag] = value
+	}
+	return data
+}
+
+// computeTags adds the computed_tags to keyed. Templates referencing a value
+// that wasn't resolved, e.g. as its lookup failed, add nothing.
+func (r *AwsIMDSProcessor) computeTags(keyed, values map[string]string) {
+	if len(r.tagTemplates) == 0 {
+		return
+	}
+	data := r.templateData(values)
+	for _, t := range r.tagTemplates {
+		var b strings.Builder
+		if err := t.tmpl.Execute(&b, data); err != nil {
+			r.Log.Debugf("Not adding computed tag %s: %v", t.key, err)
+			continue
+		}
+		if v, ok := r.limitLength(b.String()); ok && v != "" {
+			r.mergeValue(keyed, t.key, v)
+		}
+	}
+}
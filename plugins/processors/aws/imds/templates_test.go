@@ -0,0 +1,70 @@
+package aws
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/feature/ec2/imds"
+	"github.com/influxdata/telegraf/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestComputedTags(t *testing.T) {
+	client := &mockIMDSClient{
+		document: imds.InstanceIdentityDocument{Region: "eu-west-1", InstanceType: "m5.large"},
+	}
+	p := newAwsIMDSProcessor()
+	p.Log = &testutil.Logger{}
+	p.ImdsTags = []string{"region", "instanceType"}
+	p.TagRename = map[string]string{"region": "aws_region"}
+	p.ComputedTags = map[string]string{
+		"cluster": "{{.region}}-{{.instanceType}}",
+		"family":  `{{index . "instanceType" | printf "%.2s"}}`,
+	}
+	require.NoError(t, p.Init())
+	p.tagCache = newTagCache(p.TagCacheSize)
+	p.imdsClient = client
+
+	m := p.LookupIMDSTags(newTestMetric())
+	require.Equal(t, map[string]string{
+		"aws_region":   "eu-west-1",
+		"instanceType": "m5.large",
+		"cluster":      "eu-west-1-m5.large",
+		"family":       "m5",
+	}, m.Tags())
+}
+
+func TestComputedTagsUnresolved(t *testing.T) {
+	p := newAwsIMDSProcessor()
+	p.Log = &testutil.Logger{}
+	p.ImdsTags = []string{"region", "instanceType"}
+	p.ComputedTags = map[string]string{"cluster": "{{.region}}-{{.instanceType}}"}
+	require.NoError(t, p.Init())
+	p.tagCache = newTagCache(p.TagCacheSize)
+	p.imdsClient = &mockIMDSClient{err: errors.New("connection refused")}
+
+	m := p.LookupIMDSTags(newTestMetric())
+	require.Empty(t, m.Tags())
+}
+
+func TestComputedTagsInvalid(t *testing.T) {
+	tests := []struct {
+		name     string
+		template string
+	}{
+		{"syntax", "{{.region"},
+		{"unknown tag", "{{.region}}-{{.accountId}}"},
+		{"masked tag", "{{.instanceId}}"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newAwsIMDSProcessor()
+			p.Log = &testutil.Logger{}
+			p.ImdsTags = []string{"region", "instanceId"}
+			p.MaskTags = []string{"instanceId"}
+			p.ComputedTags = map[string]string{"cluster": tt.template}
+			require.ErrorContains(t, p.Init(), "invalid computed_tags template for cluster")
+		})
+	}
+}
@@ -0,0 +1,49 @@
+package aws
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// terminationCacheTTL bounds how long the spot and Auto Scaling lifecycle
+// state is cached, so a termination notice is noticed within seconds.
+const terminationCacheTTL = 5 * time.Second
+
+// terminationTags are the tags telling whether the instance is terminating.
+var terminationTags = map[string]struct{}{
+	"spotInstanceAction":   {},
+	"targetLifecycleState": {},
+}
+
+// spotInstanceAction is the spot/instance-action document, only present
+// once the spot instance is about to be interrupted.
+type spotInstanceAction struct {
+	Action string `json:"action"`
+	Time   string `json:"time"`
+}
+
+func parseSpotInstanceAction(s string) (string, error) {
+	if s == "" {
+		return "", nil
+	}
+	var a spotInstanceAction
+	if err := json.Unmarshal([]byte(s), &a); err != nil {
+		return "", fmt.Errorf("parsing spot instance action: %w", err)
+	}
+	return a.Action, nil
+}
+
+// terminating reports whether a spot termination notice was issued or Auto
+// Scaling moves the instance to the Terminated state. Failed lookups don't
+// count as terminating. The first detection is logged.
+func (r *AwsIMDSProcessor) terminating(tc *tagConfig) bool {
+	values, _ := r.resolveTags(r.lookupCtx, tc, terminationTags, false)
+	if values["spotInstanceAction"].value != "terminate" && values["targetLifecycleState"].value != "Terminated" {
+		return false
+	}
+	if r.terminationLogged.CompareAndSwap(false, true) {
+		r.Log.Warn("Instance is terminating, dropping metrics")
+	}
+	return true
+}
@@ -0,0 +1,63 @@
+package aws
+
+import (
+	"testing"
+
+	"github.com/influxdata/telegraf"
+	"github.com/influxdata/telegraf/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDropWhenTerminating(t *testing.T) {
+	tests := []struct {
+		name     string
+		metadata map[string]string
+		dropped  bool
+	}{
+		{
+			name:     "running",
+			metadata: map[string]string{"autoscaling/target-lifecycle-state": "InService"},
+		},
+		{
+			name:     "spot stop",
+			metadata: map[string]string{"spot/instance-action": `{"action": "stop", "time": "2017-09-18T08:22:00Z"}`},
+		},
+		{
+			name:     "spot terminate",
+			metadata: map[string]string{"spot/instance-action": `{"action": "terminate", "time": "2017-09-18T08:22:00Z"}`},
+			dropped:  true,
+		},
+		{
+			name:     "lifecycle terminated",
+			metadata: map[string]string{"autoscaling/target-lifecycle-state": "Terminated"},
+			dropped:  true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &mockIMDSClient{metadata: tt.metadata}
+			client.metadata["placement/group-name"] = "group"
+			p := newAwsIMDSProcessor()
+			p.Log = &testutil.Logger{}
+			p.MetadataPaths = map[string]string{"placementGroup": "placement/group-name"}
+			p.DropWhenTerminating = true
+			require.NoError(t, p.Init())
+			p.tagCache = newTagCache(p.TagCacheSize)
+			p.imdsClient = client
+
+			var metrics []telegraf.Metric
+			for i := 0; i < 3; i++ {
+				metrics = append(metrics, p.asyncAdd(newTestMetric())...)
+			}
+			if tt.dropped {
+				require.Empty(t, metrics)
+				return
+			}
+			require.Len(t, metrics, 3)
+			require.Equal(t, map[string]string{"placementGroup": "group"}, metrics[0].Tags())
+			// The state is cached, so both paths and the tag are looked up once.
+			require.EqualValues(t, 3, client.calls)
+		})
+	}
+}
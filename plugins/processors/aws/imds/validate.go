@@ -0,0 +1,52 @@
+package aws
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// validateTags resolves the tags added to metrics by default and the
+// required tags for validate_on_start. The returned error names each tag IMDS
+// failed to serve, and each required tag that doesn't exist on the instance.
+// Other tags may lack a value by design, e.g. kernelId on Nitro instances or
+// scheduledMaintenanceCode without a scheduled event.
+func (r *AwsIMDSProcessor) validateTags(ctx context.Context) error {
+	tc := r.loadTags()
+	tags := make(map[string]struct{}, len(tc.lookupTags)+len(r.requiredTags))
+	for _, m := range []map[string]struct{}{tc.lookupTags, r.requiredTags} {
+		for tag := range m {
+			tags[tag] = struct{}{}
+		}
+	}
+	values, _, errs := r.resolveTagErrors(ctx, tc, tags, false)
+
+	var unreachable, missing []string
+	for tag := range tags {
+		if _, ok := values[tag]; ok {
+			continue
+		}
+		// Paths not found failed rather than resolving to no value if
+		// negative caching is disabled.
+		if err, ok := errs[tag]; ok && !isNotFound(err) {
+			unreachable = append(unreachable, tag)
+		} else if _, ok := r.requiredTags[tag]; ok {
+			missing = append(missing, tag)
+		}
+	}
+	if len(unreachable) == 0 && len(missing) == 0 {
+		return nil
+	}
+
+	sort.Strings(unreachable)
+	sort.Strings(missing)
+	var problems []string
+	if len(unreachable) > 0 {
+		problems = append(problems, "IMDS unreachable or failing for "+strings.Join(unreachable, ", "))
+	}
+	if len(missing) > 0 {
+		problems = append(problems, "no such path or value on this instance for "+strings.Join(missing, ", "))
+	}
+	return fmt.Errorf("validating tags failed: %s", strings.Join(problems, "; "))
+}
@@ -0,0 +1,132 @@
+package aws
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/feature/ec2/imds"
+	"github.com/influxdata/telegraf/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidateTags(t *testing.T) {
+	client := &mockIMDSClient{
+		document: imds.InstanceIdentityDocument{Region: "eu-west-1"},
+		metadata: map[string]string{
+			"placement/group-name":         "web",
+			"events/maintenance/scheduled": "[]",
+		},
+	}
+	p := newAwsIMDSProcessor()
+	p.Log = &testutil.Logger{}
+	p.ImdsTags = []string{
+		"region",
+		"kernelId",
+		"scheduledMaintenanceCode",
+		"detailedMonitoring",
+		"spotInstanceAction",
+		"targetLifecycleState",
+	}
+	p.MetadataPaths = map[string]string{
+		"placementGroup": "placement/group-name",
+		"lifecycle":      "instance-life-cycle",
+	}
+	require.NoError(t, p.Init())
+	p.tagCache = newTagCache(p.TagCacheSize)
+	p.imdsClient = client
+
+	// Tags may lack a value by design unless required.
+	require.NoError(t, p.validateTags(context.Background()))
+
+	p.RequiredTags = []string{"region", "kernelId", "lifecycle"}
+	require.NoError(t, p.Init())
+	p.tagCache = newTagCache(p.TagCacheSize)
+	err := p.validateTags(context.Background())
+	require.EqualError(t, err, "validating tags failed: no such path or value on this instance for kernelId, lifecycle")
+
+	client.metadata["instance-life-cycle"] = "spot"
+	client.document.KernelID = "aki-12345678"
+	p.tagCache = newTagCache(p.TagCacheSize)
+	require.NoError(t, p.validateTags(context.Background()))
+}
+
+func TestValidateTagsWithoutNegativeCache(t *testing.T) {
+	client := &mockIMDSClient{document: imds.InstanceIdentityDocument{Region: "eu-west-1"}}
+	p := newAwsIMDSProcessor()
+	p.Log = &testutil.Logger{}
+	p.ImdsTags = []string{"region"}
+	p.MetadataPaths = map[string]string{"lifecycle": "instance-life-cycle"}
+	p.RequiredTags = []string{"lifecycle"}
+	p.NegativeCacheTTL = 0
+	p.MaxRetries = 0
+	require.NoError(t, p.Init())
+	p.tagCache = newTagCache(p.TagCacheSize)
+	p.imdsClient = client
+
+	// The failed lookup is classified without looking the path up again.
+	err := p.validateTags(context.Background())
+	require.EqualError(t, err, "validating tags failed: no such path or value on this instance for lifecycle")
+	require.EqualValues(t, 2, client.calls)
+}
+
+func TestValidateTagsUnreachable(t *testing.T) {
+	client := &mockIMDSClient{err: errors.New("connection refused")}
+	p := newAwsIMDSProcessor()
+	p.Log = &testutil.Logger{}
+	p.ImdsTags = []string{"region"}
+	p.MetadataPaths = map[string]string{"placementGroup": "placement/group-name"}
+	require.NoError(t, p.Init())
+	p.tagCache = newTagCache(p.TagCacheSize)
+	p.imdsClient = client
+
+	err := p.validateTags(context.Background())
+	require.EqualError(t, err, "validating tags failed: IMDS unreachable or failing for placementGroup, region")
+}
+
+func TestValidateTagsByMeasurement(t *testing.T) {
+	client := &mockIMDSClient{
+		document: imds.InstanceIdentityDocument{Region: "eu-west-1"},
+		pathErrs: map[string]error{"placement/group-name": errors.New("connection reset")},
+	}
+	p := newAwsIMDSProcessor()
+	p.Log = &testutil.Logger{}
+	p.ImdsTags = []string{"region"}
+	p.MetadataPaths = map[string]string{"placementGroup": "placement/group-name"}
+	p.TagsByMeasurement = map[string][]string{"net": {"placementGroup"}}
+	require.NoError(t, p.Init())
+	p.tagCache = newTagCache(p.TagCacheSize)
+	p.imdsClient = client
+
+	// Only the tags added to all metrics are validated, unless required.
+	require.NoError(t, p.validateTags(context.Background()))
+
+	p.RequiredTags = []string{"placementGroup"}
+	require.NoError(t, p.Init())
+	p.tagCache = newTagCache(p.TagCacheSize)
+	err := p.validateTags(context.Background())
+	require.EqualError(t, err, "validating tags failed: IMDS unreachable or failing for placementGroup")
+}
+
+func TestValidateOnStart(t *testing.T) {
+	server := newIMDSServer(t, `{"instanceId": "i-0123456789abcdef0", "region": "eu-west-1"}`)
+
+	p := newAwsIMDSProcessor()
+	p.Log = &testutil.Logger{}
+	p.ImdsTags = []string{"region"}
+	p.MetadataPaths = map[string]string{"placementGroup": "placement/group-name"}
+	p.RequiredTags = []string{"placementGroup"}
+	p.Endpoint = server.URL
+	p.ValidateOnStart = true
+	require.NoError(t, p.Init())
+	err := p.Start(&testutil.Accumulator{})
+	require.ErrorContains(t, err, "no such path or value on this instance for placementGroup")
+
+	// Without IMDS, validation fails rather than running degraded.
+	unreachable := newIMDSServer(t, "")
+	p.Endpoint = unreachable.URL
+	p.MetadataPaths = nil
+	p.RequiredTags = nil
+	require.NoError(t, p.Init())
+	require.ErrorContains(t, p.Start(&testutil.Accumulator{}), "IMDS unreachable")
+}
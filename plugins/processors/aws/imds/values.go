@@ -0,0 +1,243 @@
+package aws
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"hash/fnv"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/influxdata/telegraf"
+	"github.com/influxdata/telegraf/config"
+)
+
+// addTags adds the resolved metadata values, keyed by tag, to the metric
+// under the configured keys and returns the added tags. At most
+// max_added_tags tags are added, in sorted key order.
+func (r *AwsIMDSProcessor) addTags(tc *tagConfig, metric telegraf.Metric, values map[string]string) map[string]string {
+	keyed := r.keyedValues(tc, values)
+	keys := make([]string, 0, len(keyed))
+	for key, value := range keyed {
+		if _, ok := r.fieldKeys[key]; ok {
+			metric.AddField(key, value)
+		} else {
+			keys = append(keys, key)
+		}
+	}
+
+	if len(keys) > r.MaxAddedTags {
+		sort.Strings(keys)
+		omitted := keys[r.MaxAddedTags:]
+		keys = keys[:r.MaxAddedTags]
+		r.omittedTags.Incr(int64(len(omitted)))
+		if r.omittedTagsLogged.CompareAndSwap(false, true) {
+			r.Log.Warnf("Resolved more than max_added_tags = %d tags, omitting %s", r.MaxAddedTags, strings.Join(omitted, ", "))
+		}
+	}
+	added := make(map[string]string, len(keys))
+	for _, key := range keys {
+		metric.AddTag(key, keyed[key])
+		added[key] = keyed[key]
+	}
+	return added
+}
+
+// tagSetHash returns a stable hash of the given tags, the FNV-1a hash of the
+// sorted keys and values in hex.
+func tagSetHash(tags map[string]string) string {
+	keys := make([]string, 0, len(tags))
+	for key := range tags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	h := fnv.New64a()
+	for _, key := range keys {
+		// NUL separated, as it can't appear in keys or values.
+		h.Write([]byte(key))
+		h.Write([]byte{0})
+		h.Write([]byte(tags[key]))
+		h.Write([]byte{0})
+	}
+	return strconv.FormatUint(h.Sum64(), 16)
+}
+
+// keyedValues maps and transforms the resolved metadata values, keyed by tag,
+// and returns them under the configured keys. Tags sharing a key are resolved
+// according to merge_strategy in the order computed by orderTags.
+func (r *AwsIMDSProcessor) keyedValues(tc *tagConfig, values map[string]string) map[string]string {
+	keyed := make(map[string]string, len(values))
+	for _, tag := range tc.tagOrder {
+		value, ok := values[tag]
+		if !ok {
+			continue
+		}
+		if g, ok := r.gates[tag]; ok && !g.allows(value) {
+			continue
+		}
+		if winner, ok := tc.shadowed[tag]; ok {
+			if _, ok := values[winner]; ok {
+				continue
+			}
+		}
+		if _, ok := r.fieldTags[tag]; ok {
+			// Fields are added verbatim, e.g. to keep documents verifiable.
+			r.mergeValue(keyed, tc.tagKey(tag), value)
+			continue
+		}
+
+		if tag == "region" {
+			value = r.mapRegion(value)
+		}
+		if m, ok := r.ValueMap[tag]; ok && m.Dest != "" {
+			// Keep the raw value and add the mapped one under its own key.
+			if v, ok := r.limitLength(m.apply(value)); ok {
+				r.mergeValue(keyed, m.Dest, v)
+			}
+		} else if ok {
+			value = m.apply(value)
+		}
+
+		if v, ok := r.transformValue(tag, value); ok {
+			r.mergeValue(keyed, tc.tagKey(tag), v)
+		}
+	}
+
+	for _, e := range r.extractors {
+		value, ok := values[e.source]
+		if !ok {
+			continue
+		}
+		for key, v := range e.extract(value) {
+			if v, ok := r.limitLength(v); ok {
+				r.mergeValue(keyed, key, v)
+			}
+		}
+	}
+	r.computeTags(keyed, values)
+	return keyed
+}
+
+// mergeValue sets key to value unless merge_strategy keeps an earlier value.
+func (r *AwsIMDSProcessor) mergeValue(keyed map[string]string, key, value string) {
+	if _, exists := keyed[key]; exists && r.MergeStrategy == "first" {
+		return
+	}
+	keyed[key] = value
+}
+
+// ValueMapping translates raw metadata values into other values, e.g. account
+// IDs into environment names.
+type ValueMapping struct {
+	// Dest is the key to add the mapped value under, keeping the raw value
+	// under the tag's own key. If empty, the mapped value replaces the raw
+	// value.
+	Dest string `toml:"dest"`
+	// Default is used for values without a mapping. If empty, such values
+	// pass through unchanged.
+	Default string            `toml:"default"`
+	Values  map[string]string `toml:"values"`
+}
+
+func (m ValueMapping) apply(value string) string {
+	if v, ok := m.Values[value]; ok {
+		return v
+	}
+	if m.Default != "" {
+		return m.Default
+	}
+	return value
+}
+
+// transformValue applies the configured value transformations and length
+// limits to a resolved metadata value. It returns false if the value must be
+// skipped. Values are cached untransformed, so transformations stay stable
+// when the cache is flushed.
+func (r *AwsIMDSProcessor) transformValue(tag, value string) (string, bool) {
+	if _, ok := r.pseudonymizeTagsMap[tag]; ok {
+		v, err := r.pseudonymize(value)
+		if err != nil {
+			r.Log.Errorf("Error when pseudonymizing tag %s, skipping it: %v", tag, err)
+			return "", false
+		}
+		value = v
+	} else if _, ok := r.maskTagsMap[tag]; ok {
+		value = maskValue(value, r.MaskKeepChars)
+	}
+
+	return r.limitLength(value)
+}
+
+// limitLength enforces max_value_length, truncating or dropping the value.
+func (r *AwsIMDSProcessor) limitLength(value string) (string, bool) {
+	if r.maxValueLength > 0 && len(value) > r.maxValueLength {
+		if r.DropOverlong {
+			r.droppedValues.Incr(1)
+			return "", false
+		}
+		value = truncateValue(value, r.maxValueLength, r.TruncateSuffix)
+		r.truncatedValues.Incr(1)
+	}
+	return value, true
+}
+
+// truncateValue shortens value to at most limit bytes including the suffix,
+// cutting on a rune boundary. The suffix is omitted if it doesn't fit.
+func truncateValue(value string, limit int, suffix string) string {
+	if len(value) <= limit {
+		return value
+	}
+	if len(suffix) >= limit {
+		suffix = ""
+	}
+
+	n := limit - len(suffix)
+	for n > 0 && !utf8.RuneStart(value[n]) {
+		n--
+	}
+	return value[:n] + suffix
+}
+
+// maskValue replaces all letters and digits of value except the last keep
+// ones by asterisks. Separators are kept, so "1234-5678-3456" becomes
+// "****-****-3456".
+func maskValue(value string, keep int) string {
+	runes := []rune(value)
+	for i := len(runes) - 1; i >= 0; i-- {
+		if !unicode.IsLetter(runes[i]) && !unicode.IsDigit(runes[i]) {
+			continue
+		}
+		if keep > 0 {
+			keep--
+			continue
+		}
+		runes[i] = '*'
+	}
+	return string(runes)
+}
+
+// pseudonymize replaces value by the hex encoded HMAC-SHA256 of the value
+// keyed with pseudonymize_key, truncated to pseudonymize_length characters.
+// Results are memoized as the number of distinct values is small.
+func (r *AwsIMDSProcessor) pseudonymize(value string) (string, error) {
+	if v, ok := r.pseudonyms.Load(value); ok {
+		return v.(string), nil
+	}
+
+	key, err := r.PseudonymizeKey.Get()
+	if err != nil {
+		return "", err
+	}
+	defer config.ReleaseSecret(key)
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(value))
+	v := hex.EncodeToString(mac.Sum(nil))[:r.PseudonymizeLength]
+
+	r.pseudonyms.Store(value, v)
+	return v, nil
+}
@@ -0,0 +1,280 @@
+package aws
+
+import (
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/feature/ec2/imds"
+	"github.com/influxdata/telegraf/config"
+	"github.com/influxdata/telegraf/metric"
+	"github.com/influxdata/telegraf/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTruncateValue(t *testing.T) {
+	tests := []struct {
+		name     string
+		value    string
+		limit    int
+		suffix   string
+		expected string
+	}{
+		{"short", "abc", 5, "", "abc"},
+		{"exact", "abcde", 5, "…", "abcde"},
+		{"plain", "abcdefgh", 5, "", "abcde"},
+		{"suffix", "abcdefgh", 5, "…", "ab…"},
+		{"suffix too long", "abcdefgh", 2, "…", "ab"},
+		{"rune boundary", "aéééé", 4, "", "aé"},
+		{"rune boundary with suffix", "éééééé", 6, "…", "é…"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			actual := truncateValue(tt.value, tt.limit, tt.suffix)
+			require.Equal(t, tt.expected, actual)
+			require.LessOrEqual(t, len(actual), tt.limit)
+		})
+	}
+}
+
+func TestAddTagLengthLimit(t *testing.T) {
+	p := newAwsIMDSProcessor()
+	p.Log = &testutil.Logger{}
+	p.ImdsTags = []string{"region"}
+	p.MaxValueLength = 4
+	require.NoError(t, p.Init())
+
+	m := metric.New("m", map[string]string{}, map[string]interface{}{"v": 1}, time.Unix(0, 0))
+	before := p.truncatedValues.Get()
+	p.addTags(p.loadTags(), m, map[string]string{"region": "us-east-1"})
+	require.Equal(t, map[string]string{"region": "us-e"}, m.Tags())
+	require.Equal(t, before+1, p.truncatedValues.Get())
+
+	p.DropOverlong = true
+	m = metric.New("m", map[string]string{}, map[string]interface{}{"v": 1}, time.Unix(0, 0))
+	before = p.droppedValues.Get()
+	p.addTags(p.loadTags(), m, map[string]string{"region": "us-east-1"})
+	require.Empty(t, m.Tags())
+	require.Equal(t, before+1, p.droppedValues.Get())
+}
+
+func TestDropOverlongRequiresLimit(t *testing.T) {
+	p := newAwsIMDSProcessor()
+	p.Log = &testutil.Logger{}
+	p.ImdsTags = []string{"region"}
+	p.DropOverlong = true
+	require.Error(t, p.Init())
+}
+
+func TestPseudonymize(t *testing.T) {
+	client := &mockIMDSClient{
+		document: imds.InstanceIdentityDocument{AccountID: "123456789012", Region: "us-east-1"},
+	}
+	p := newAwsIMDSProcessor()
+	p.Log = &testutil.Logger{}
+	p.ImdsTags = []string{"accountId", "region"}
+	p.PseudonymizeTags = []string{"accountId"}
+	p.PseudonymizeKey = config.NewSecret([]byte("secret"))
+	require.NoError(t, p.Init())
+	p.tagCache = newTagCache(p.TagCacheSize)
+	p.imdsClient = client
+
+	// echo -n 123456789012 | openssl dgst -sha256 -hmac secret
+	expected := map[string]string{"accountId": "ea8ef11d8eafbbfc", "region": "us-east-1"}
+
+	m := p.LookupIMDSTags(newTestMetric())
+	require.Equal(t, expected, m.Tags())
+
+	// The cache holds the raw value, flushing it doesn't change the output.
+	e, ok := p.getCached("accountId")
+	require.True(t, ok)
+	require.Equal(t, "123456789012", e.value)
+	p.tagCache.Clear()
+	m = p.LookupIMDSTags(newTestMetric())
+	require.Equal(t, expected, m.Tags())
+}
+
+func TestPseudonymizeRequiresKey(t *testing.T) {
+	p := newAwsIMDSProcessor()
+	p.Log = &testutil.Logger{}
+	p.ImdsTags = []string{"accountId"}
+	p.PseudonymizeTags = []string{"accountId"}
+	require.Error(t, p.Init())
+}
+
+func TestMaskValue(t *testing.T) {
+	tests := []struct {
+		value    string
+		keep     int
+		expected string
+	}{
+		{"123456789012", 4, "********9012"},
+		{"1234-5678-3456", 4, "****-****-3456"},
+		{"i-0123456789abcdef0", 6, "*-***********bcdef0"},
+		{"abc", 4, "abc"},
+		{"abc", 0, "***"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			require.Equal(t, tt.expected, maskValue(tt.value, tt.keep))
+		})
+	}
+}
+
+func TestMaskTags(t *testing.T) {
+	client := &mockIMDSClient{
+		document: imds.InstanceIdentityDocument{AccountID: "123456789012", Region: "us-east-1"},
+	}
+	p := newTestProcessor(t, client, "accountId", "region")
+	p.maskTagsMap = map[string]struct{}{"accountId": {}}
+
+	m := p.LookupIMDSTags(newTestMetric())
+	require.Equal(t, map[string]string{"accountId": "********9012", "region": "us-east-1"}, m.Tags())
+}
+
+func TestMaskAndPseudonymizeExclusive(t *testing.T) {
+	p := newAwsIMDSProcessor()
+	p.Log = &testutil.Logger{}
+	p.ImdsTags = []string{"accountId"}
+	p.PseudonymizeTags = []string{"accountId"}
+	p.PseudonymizeKey = config.NewSecret([]byte("secret"))
+	p.MaskTags = []string{"accountId"}
+	require.ErrorContains(t, p.Init(), "both masked and pseudonymized")
+}
+
+func TestValueMapDestTransformedTag(t *testing.T) {
+	p := newAwsIMDSProcessor()
+	p.Log = &testutil.Logger{}
+	p.ImdsTags = []string{"accountId"}
+	p.PseudonymizeTags = []string{"accountId"}
+	p.PseudonymizeKey = config.NewSecret([]byte("secret"))
+	p.ValueMap = map[string]ValueMapping{"accountId": {Dest: "environment"}}
+	require.ErrorContains(t, p.Init(), "pseudonymized or masked tag: accountId")
+
+	p = newAwsIMDSProcessor()
+	p.Log = &testutil.Logger{}
+	p.ImdsTags = []string{"accountId"}
+	p.MaskTags = []string{"accountId"}
+	p.ValueMap = map[string]ValueMapping{"accountId": {Dest: "environment"}}
+	require.ErrorContains(t, p.Init(), "pseudonymized or masked tag: accountId")
+
+	// Mapping the value in place transforms the mapped value.
+	p = newAwsIMDSProcessor()
+	p.Log = &testutil.Logger{}
+	p.ImdsTags = []string{"accountId"}
+	p.MaskTags = []string{"accountId"}
+	p.ValueMap = map[string]ValueMapping{"accountId": {Values: map[string]string{"1": "123456789012"}}}
+	require.NoError(t, p.Init())
+	require.Equal(t, map[string]string{"accountId": "********9012"},
+		p.keyedValues(p.loadTags(), map[string]string{"accountId": "1"}))
+}
+
+func TestValueMap(t *testing.T) {
+	p := newAwsIMDSProcessor()
+	p.Log = &testutil.Logger{}
+	p.ImdsTags = []string{"accountId", "region", "instanceType"}
+	p.ValueMap = map[string]ValueMapping{
+		"accountId": {
+			Dest:    "environment",
+			Default: "unknown",
+			Values:  map[string]string{"123456789012": "prod"},
+		},
+		"region": {
+			Values: map[string]string{"us-east-1": "virginia"},
+		},
+	}
+	require.NoError(t, p.Init())
+
+	tests := []struct {
+		name     string
+		values   map[string]string
+		expected map[string]string
+	}{
+		{
+			name:   "mapped",
+			values: map[string]string{"accountId": "123456789012", "region": "us-east-1", "instanceType": "m5.large"},
+			expected: map[string]string{
+				"accountId":    "123456789012",
+				"environment":  "prod",
+				"region":       "virginia",
+				"instanceType": "m5.large",
+			},
+		},
+		{
+			name:     "default and pass through",
+			values:   map[string]string{"accountId": "210987654321", "region": "eu-west-1"},
+			expected: map[string]string{"accountId": "210987654321", "environment": "unknown", "region": "eu-west-1"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := metric.New("m", map[string]string{}, map[string]interface{}{"v": 1}, time.Unix(0, 0))
+			p.addTags(p.loadTags(), m, tt.values)
+			require.Equal(t, tt.expected, m.Tags())
+		})
+	}
+}
+
+func TestValueMapUnknownTag(t *testing.T) {
+	p := newAwsIMDSProcessor()
+	p.Log = &testutil.Logger{}
+	p.ImdsTags = []string{"region"}
+	p.ValueMap = map[string]ValueMapping{"accountId": {Values: map[string]string{"1": "a"}}}
+	require.Error(t, p.Init())
+}
+
+func TestMaxAddedTags(t *testing.T) {
+	client := &mockIMDSClient{document: imds.InstanceIdentityDocument{
+		AccountID:        "123456789012",
+		AvailabilityZone: "us-east-1a",
+		InstanceID:       "i-0123456789abcdef0",
+		Region:           "us-east-1",
+	}}
+	p := newTestProcessor(t, client, "region", "accountId", "availabilityZone", "instanceId")
+	p.MaxAddedTags = 2
+	require.NoError(t, p.Init())
+
+	// Tags are added in sorted key order up to the cap.
+	before := p.omittedTags.Get()
+	m := p.LookupIMDSTags(newTestMetric())
+	require.Equal(t, map[string]string{
+		"accountId":        "123456789012",
+		"availabilityZone": "us-east-1a",
+	}, m.Tags())
+	require.Equal(t, before+2, p.omittedTags.Get())
+	require.True(t, p.omittedTagsLogged.Load())
+
+	p.MaxAddedTags = 0
+	require.Error(t, p.Init())
+}
+
+func TestTagSetHash(t *testing.T) {
+	client := &mockIMDSClient{
+		document: imds.InstanceIdentityDocument{Region: "us-east-1", InstanceType: "m5.large"},
+	}
+	p := newTestProcessor(t, client, "region", "instanceType")
+	p.AddTagSetHash = true
+
+	m1 := p.LookupIMDSTags(newTestMetric())
+	hash, ok := m1.GetField("imds_tag_set_hash")
+	require.True(t, ok)
+	require.Equal(t, tagSetHash(map[string]string{"region": "us-east-1", "instanceType": "m5.large"}), hash)
+
+	// The hash only depends on the added tags, not on other tags or the
+	// order of the values.
+	m := newTestMetric()
+	m.AddTag("host", "a")
+	m2 := p.LookupIMDSTags(m)
+	require.Equal(t, m1.Fields()["imds_tag_set_hash"], m2.Fields()["imds_tag_set_hash"])
+
+	require.NotEqual(t,
+		tagSetHash(map[string]string{"a": "b=c"}),
+		tagSetHash(map[string]string{"a=b": "c"}),
+	)
+	require.NotEqual(t,
+		tagSetHash(map[string]string{"region": "us-east-1"}),
+		tagSetHash(map[string]string{"region": "us-east-2"}),
+	)
+}